@@ -0,0 +1,529 @@
+package commands
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/google/subcommands"
+)
+
+var (
+	// resourceLocationRE matches namespaced identifiers (e.g., "minecraft:stone"),
+	// which must not have player names substituted within them.
+	resourceLocationRE = regexp.MustCompile(`^[a-z0-9_.\-]+:[a-z0-9_.\-/]+$`)
+
+	// profileNameRE matches the NBT paths that hold the name of the player a
+	// player head belongs to, in both the compound and the older plain string
+	// forms.
+	profileNameRE = regexp.MustCompile(`(^|/)(skullowner|owner|minecraft:profile|profile)(/name)?$`)
+)
+
+// uuid is a UUID in the form used by NBT data: four 32-bit integers, most
+// significant first. See https://minecraft.wiki/w/Universally_unique_identifier.
+type uuid [4]int32
+
+// parseUUID parses a UUID in either hyphenated or unhyphenated hexadecimal
+// form.
+func parseUUID(s string) (uuid, bool) {
+	var u uuid
+	switch len(s) {
+	case 36:
+		if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+			return u, false
+		}
+		s = strings.Replace(s, "-", "", -1)
+	case 32:
+	default:
+		return u, false
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 16 {
+		return u, false
+	}
+	return uuidFromBytes(b), true
+}
+
+// uuidFromBytes converts 16 bytes to a UUID.
+func uuidFromBytes(b []byte) uuid {
+	var u uuid
+	for i := range u {
+		u[i] = int32(uint32(b[4*i])<<24 | uint32(b[4*i+1])<<16 | uint32(b[4*i+2])<<8 | uint32(b[4*i+3]))
+	}
+	return u
+}
+
+// uuidFromMostLeast converts the pair of 64-bit integers used to store UUIDs
+// prior to 1.16 to a UUID.
+func uuidFromMostLeast(most, least int64) uuid {
+	return uuid{int32(most >> 32), int32(most), int32(least >> 32), int32(least)}
+}
+
+// mostLeast returns the pair of 64-bit integers used to store a UUID prior to
+// 1.16.
+func (u uuid) mostLeast() (most, least int64) {
+	most = int64(u[0])<<32 | int64(uint32(u[1]))
+	least = int64(u[2])<<32 | int64(uint32(u[3]))
+	return most, least
+}
+
+// String returns the hyphenated hexadecimal form of a UUID.
+func (u uuid) String() string {
+	h := fmt.Sprintf("%08x%08x%08x%08x", uint32(u[0]), uint32(u[1]), uint32(u[2]), uint32(u[3]))
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// player is a pseudonymous identity assigned to a real player.
+type player struct {
+	name  string // The real name, if known.
+	uuid  uuid   // The pseudonymous UUID.
+	alias string // The pseudonymous name.
+}
+
+// Anonymize implements the anonymize command.
+type Anonymize struct {
+	world         string
+	userCache     string
+	salt          string
+	stripTextures bool
+	mapping       string
+	skipConfirm   bool
+	force         bool
+
+	// keepTimestamps indicates that the chunk timestamp table should not be
+	// updated when chunks are written (see writeChunk).
+	keepTimestamps bool
+
+	// players maps the UUIDs of real players to their pseudonymous identities.
+	players map[uuid]*player
+	// names maps the lowercase names of real players to their pseudonymous
+	// names.
+	names   map[string]string
+	namesRE *regexp.Regexp
+	updates int
+
+	// shouldCompact indicates whether any chunks required resizing or relocating.
+	// If so, notify the user that they should compact the world.
+	shouldCompact bool
+}
+
+func (*Anonymize) Name() string {
+	return "anonymize"
+}
+
+func (*Anonymize) Synopsis() string {
+	return "Replace player identities in a Minecraft world with pseudonyms."
+}
+
+func (*Anonymize) Usage() string {
+	return `anonymize [<flags>...] <world>
+Replace player identities in a Minecraft world with pseudonyms.
+
+WARNING: This command will modify your world in-place. You should make a backup
+of your world before proceeding.
+
+Anonymize consistently replaces each player's name and UUID with a pseudonymous
+name and UUID throughout the Minecraft world located in the directory <world>.
+This should be the directory containing level.dat.
+
+The players are those having files in the playerdata directory, as well as
+those listed in the server's usercache.json file (see -usercache), which is also
+used to find the names of players. Player UUIDs are replaced wherever they
+appear (e.g., owners of tamed pets, player heads, thrown items), as are player
+names in player heads and in text (e.g., signs, books, custom names), but not in
+other strings, such as identifiers. Within JSON text components, only the text
+is changed, not the keys or other attributes. The player data, statistics, and advancements files for each player
+are renamed accordingly.
+
+Pseudonyms are derived from the real UUIDs and the -salt flag, so running this
+command with the same salt on several worlds assigns the same pseudonyms to the
+same players. Use -mapping to record the pseudonym assigned to each player.
+
+The timestamp of each chunk which is changed is updated in the region file's
+timestamp table, unless -keep_timestamps is specified.
+
+`
+}
+
+func (a *Anonymize) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&a.userCache, "usercache", "", "The server's usercache.json file, listing player names and UUIDs (default: usercache.json in the parent of <world>, if present)")
+	f.StringVar(&a.salt, "salt", "", "Secret used to derive pseudonyms")
+	f.BoolVar(&a.stripTextures, "strip_textures", false, "Remove skin textures from player heads")
+	f.StringVar(&a.mapping, "mapping", "", "CSV file to write the pseudonym assigned to each player to")
+	f.BoolVar(&a.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&a.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+	f.BoolVar(&a.keepTimestamps, "keep_timestamps", false, "Do not update the timestamps of the chunks which are changed.")
+}
+
+func (a *Anonymize) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		log.Error("<world> is required.")
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 1 {
+		log.Error("Extra positional arguments found.")
+		return subcommands.ExitUsageError
+	}
+	a.world = f.Arg(0)
+	if err := a.loadPlayers(); err != nil {
+		log.Errorf("Cannot load players: %v", err)
+		return subcommands.ExitFailure
+	}
+	if len(a.players) == 0 && !a.stripTextures {
+		log.Info("No players found. Nothing to do.")
+		return subcommands.ExitSuccess
+	}
+	if !a.skipConfirm {
+		confirm()
+	}
+	lock, err := lockWorld(a.world, a.force)
+	if err != nil {
+		log.Errorf("Anonymize: %v", err)
+		return subcommands.ExitFailure
+	}
+	defer lock.unlock()
+	if err := a.run(); err != nil {
+		log.Errorf("Anonymize: %v", err)
+		return subcommands.ExitFailure
+	}
+	log.Infof("Anonymized %d players (%d updates).", len(a.players), a.updates)
+	if a.shouldCompact {
+		log.Info("Some chunks were resized or relocated. It is recommended to compact the world.")
+	}
+	return subcommands.ExitSuccess
+}
+
+// loadPlayers finds the players of the world and assigns pseudonyms to them.
+func (a *Anonymize) loadPlayers() error {
+	a.players = make(map[uuid]*player)
+	a.names = make(map[string]string)
+	add := func(u uuid, name string) {
+		p, ok := a.players[u]
+		if !ok {
+			mac := hmac.New(sha256.New, []byte(a.salt))
+			mac.Write([]byte("uuid:" + u.String()))
+			b := mac.Sum(nil)[:16]
+			b[6] = b[6]&0x0f | 0x40 // Version 4 (random).
+			b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant.
+			p = &player{uuid: uuidFromBytes(b), alias: "Player_" + pseudonym(a.salt, "name:"+u.String())}
+			a.players[u] = p
+		}
+		if name != "" {
+			p.name = name
+			a.names[strings.ToLower(name)] = p.alias
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(a.world, "playerdata"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if u, ok := parseUUID(strings.SplitN(entry.Name(), ".", 2)[0]); ok {
+			add(u, "")
+		}
+	}
+
+	path := a.userCache
+	if path == "" {
+		path = filepath.Join(a.world, "..", "usercache.json")
+		if _, err := os.Stat(path); err != nil {
+			path = ""
+		}
+	}
+	if path != "" {
+		log.Infof("Reading player names from %q.", path)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var cache []struct {
+			Name string `json:"name"`
+			UUID string `json:"uuid"`
+		}
+		if err := json.Unmarshal(data, &cache); err != nil {
+			return fmt.Errorf("cannot parse %q: %v", path, err)
+		}
+		for _, entry := range cache {
+			u, ok := parseUUID(entry.UUID)
+			if !ok {
+				return fmt.Errorf("invalid UUID in %q: %q", path, entry.UUID)
+			}
+			add(u, entry.Name)
+		}
+	}
+
+	if len(a.names) > 0 {
+		var names []string
+		for name := range a.names {
+			names = append(names, name)
+		}
+		a.namesRE = wordsRE(names)
+	}
+	return nil
+}
+
+// run anonymizes the world.
+func (a *Anonymize) run() error {
+	for _, kind := range []string{"region", "entities"} {
+		if err := walkWorld(a.world, kind, a.anonymizeRegion); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{"level.dat", "level.dat_old"} {
+		if err := a.anonymizeFile(filepath.Join(a.world, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	dataFiles, err := filepath.Glob(filepath.Join(a.world, "data", "*.dat"))
+	if err != nil {
+		return err
+	}
+	for _, path := range dataFiles {
+		if err := a.anonymizeFile(path); err != nil {
+			log.Warnf("Skipping data file: %v", err)
+		}
+	}
+	if err := a.anonymizePlayerFiles("playerdata", true); err != nil {
+		return err
+	}
+	for _, dir := range []string{"stats", "advancements"} {
+		if err := a.anonymizePlayerFiles(dir, false); err != nil {
+			return err
+		}
+	}
+	if a.mapping != "" {
+		if err := a.writeMapping(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anonymizeRegion anonymizes the chunks in a single region file.
+func (a *Anonymize) anonymizeRegion(_, _, _ int, path string) error {
+	updates, resized, err := rewriteRegion(path, a.keepTimestamps, nil, func(_ int, tree map[string]interface{}) int {
+		_, n := a.anonymize(dataVersion(tree), "", "", tree)
+		return n
+	})
+	a.updates += updates
+	if resized {
+		a.shouldCompact = true
+	}
+	return err
+}
+
+// anonymizeFile anonymizes a gzip-compressed NBT file.
+func (a *Anonymize) anonymizeFile(path string) error {
+	tree, err := readNBTFile(path)
+	if err != nil {
+		return err
+	}
+	if _, n := a.anonymize(dataVersion(tree), "", "", tree); n > 0 {
+		log.Debugf("Anonymizing %q (%d updates).", path, n)
+		a.updates += n
+		return writeNBTFile(path, tree)
+	}
+	return nil
+}
+
+// anonymizePlayerFiles renames the files in the specified directory of the
+// world that are named after the UUID of a player. If nbt is true, the contents
+// of the files are gzip-compressed NBT data, which is anonymized as well.
+func (a *Anonymize) anonymizePlayerFiles(dir string, nbt bool) error {
+	dir = filepath.Join(a.world, dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry.Name(), ".", 2)
+		u, ok := parseUUID(parts[0])
+		if !ok {
+			continue
+		}
+		p, ok := a.players[u]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if nbt {
+			if err := a.anonymizeFile(path); err != nil {
+				return err
+			}
+		}
+		newName := p.uuid.String()
+		if len(parts) > 1 {
+			newName += "." + parts[1]
+		}
+		newPath := filepath.Join(dir, newName)
+		if _, err := os.Stat(newPath); err == nil {
+			return fmt.Errorf("cannot rename %q: %q already exists", path, newPath)
+		}
+		log.Debugf("Renaming %q to %q.", path, newPath)
+		if err := os.Rename(path, newPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMapping writes the pseudonym assigned to each player to the file
+// specified by the -mapping flag.
+func (a *Anonymize) writeMapping() error {
+	f, err := os.Create(a.mapping)
+	if err != nil {
+		return fmt.Errorf("cannot open file %q for writing: %v", a.mapping, err)
+	}
+	defer f.Close()
+	var uuids []uuid
+	for u := range a.players {
+		uuids = append(uuids, u)
+	}
+	sort.Slice(uuids, func(i, j int) bool { return uuids[i].String() < uuids[j].String() })
+	w := csv.NewWriter(f)
+	w.Write([]string{"uuid", "name", "anonymized_uuid", "anonymized_name"})
+	for _, u := range uuids {
+		p := a.players[u]
+		w.Write([]string{u.String(), p.name, p.uuid.String(), p.alias})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("cannot write %q: %v", a.mapping, err)
+	}
+	return f.Close()
+}
+
+// isProfileTextures determines if the tag named k, within a TAG_Compound named
+// parent, holds the skin textures of a player head.
+func isProfileTextures(parent, k string) bool {
+	switch parent {
+	case "SkullOwner", "Owner":
+		return k == "Properties"
+	case "minecraft:profile", "profile":
+		return k == "properties"
+	}
+	return false
+}
+
+// replaceNames replaces the names of players within a string with their
+// pseudonyms. Within JSON text components (e.g., sign text and custom names),
+// only the text is changed (see textSpans), so that a player named, e.g.,
+// "color" or "text" does not damage the component. The string is left
+// unchanged if the result would not be valid JSON.
+func (a *Anonymize) replaceNames(v string) string {
+	var b strings.Builder
+	copied := 0 // Bytes of v copied to b so far.
+	for _, span := range textSpans(v) {
+		b.WriteString(v[copied:span[0]])
+		b.WriteString(replaceWords(a.namesRE, v[span[0]:span[1]], func(name string) string {
+			return a.names[strings.ToLower(name)]
+		}))
+		copied = span[1]
+	}
+	b.WriteString(v[copied:])
+	s := b.String()
+	if s != v && json.Valid([]byte(v)) && !json.Valid([]byte(s)) {
+		log.Debugf("Not replacing player names in %q: the result would not be valid JSON: %s", v, s)
+		return v
+	}
+	return s
+}
+
+// isPlayerNameText determines if the string tag at the NBT path k, in a chunk
+// with the specified DataVersion, may contain the names of players: text (see
+// isTextComponent and isUserTextPath) or the owner of a player head. Names are
+// not replaced elsewhere, so that, e.g., an identifier that happens to equal a
+// player's name is left alone.
+func isPlayerNameText(dataVersion int32, k, v string) bool {
+	return profileNameRE.MatchString(clean(k)) || isUserTextPath(dataVersion, k) || isTextComponent(dataVersion, k, v)
+}
+
+// anonymize replaces player identities within an NBT object named key, at the
+// NBT path k, in a chunk with the specified DataVersion. It returns the new
+// value for the object, and the number of changes made. Note that TAG_Compounds
+// and TAG_Lists are modified in place.
+func (a *Anonymize) anonymize(dataVersion int32, k, key string, x interface{}) (interface{}, int) {
+	updates := 0
+	switch value := x.(type) {
+	case map[string]interface{}:
+		var keys []string
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, name := range keys {
+			if a.stripTextures && isProfileTextures(key, name) {
+				delete(value, name)
+				updates++
+				continue
+			}
+			// Prior to 1.16, UUIDs were stored as pairs of longs named <x>Most and
+			// <x>Least.
+			if strings.HasSuffix(name, "Most") {
+				lk := strings.TrimSuffix(name, "Most") + "Least"
+				most, ok1 := value[name].(int64)
+				least, ok2 := value[lk].(int64)
+				if ok1 && ok2 {
+					if p, ok := a.players[uuidFromMostLeast(most, least)]; ok {
+						value[name], value[lk] = p.uuid.mostLeast()
+						updates++
+					}
+					continue
+				}
+			}
+			path := formatKey(name)
+			if k != "" {
+				path = k + "/" + path
+			}
+			if v, n := a.anonymize(dataVersion, path, name, value[name]); n > 0 {
+				value[name] = v
+				updates += n
+			}
+		}
+	case []interface{}:
+		for i, v := range value {
+			if v, n := a.anonymize(dataVersion, fmt.Sprintf("%s[%d]", k, i), "", v); n > 0 {
+				value[i] = v
+				updates += n
+			}
+		}
+	case [4]int32:
+		if p, ok := a.players[uuid(value)]; ok {
+			return [4]int32(p.uuid), 1
+		}
+	case string:
+		if u, ok := parseUUID(value); ok {
+			if p, ok := a.players[u]; ok {
+				s := p.uuid.String()
+				if !strings.Contains(value, "-") {
+					s = strings.Replace(s, "-", "", -1)
+				}
+				return s, 1
+			}
+			return value, 0
+		}
+		if a.namesRE == nil || resourceLocationRE.MatchString(value) || !isPlayerNameText(dataVersion, k, value) {
+			return value, 0
+		}
+		if s := a.replaceNames(value); s != value {
+			return s, 1
+		}
+	}
+	return x, updates
+}
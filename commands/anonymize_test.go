@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnonymizeNames(t *testing.T) {
+	a := &Anonymize{
+		players: map[uuid]*player{},
+		names:   map[string]string{"steve": "Player_abc"},
+		namesRE: wordsRE([]string{"Steve"}),
+	}
+	tree := map[string]interface{}{
+		"DataVersion": int32(3465),
+		"block_entities": []interface{}{
+			map[string]interface{}{
+				"id": "minecraft:sign",
+				"front_text": map[string]interface{}{
+					"messages": []interface{}{`"hi Steve"`, `{"text":"Steve","color":"red"}`, `""`, `""`},
+				},
+			},
+			map[string]interface{}{
+				"id":         "minecraft:skull",
+				"SkullOwner": map[string]interface{}{"Name": "Steve"},
+			},
+		},
+		"Entities": []interface{}{
+			map[string]interface{}{
+				"CustomName": `{"text":"Steve's dog"}`,
+				"Tags":       []interface{}{"steve"},
+				"Team":       "Steve",
+			},
+		},
+	}
+	want := map[string]interface{}{
+		"DataVersion": int32(3465),
+		"block_entities": []interface{}{
+			map[string]interface{}{
+				"id": "minecraft:sign",
+				"front_text": map[string]interface{}{
+					"messages": []interface{}{`"hi Player_abc"`, `{"text":"Player_abc","color":"red"}`, `""`, `""`},
+				},
+			},
+			map[string]interface{}{
+				"id":         "minecraft:skull",
+				"SkullOwner": map[string]interface{}{"Name": "Player_abc"},
+			},
+		},
+		"Entities": []interface{}{
+			map[string]interface{}{
+				"CustomName": `{"text":"Player_abc's dog"}`,
+				"Tags":       []interface{}{"steve"},
+				"Team":       "Steve",
+			},
+		},
+	}
+	if _, n := a.anonymize(dataVersion(tree), "", "", tree); n != 4 {
+		t.Errorf("anonymize made %d updates, want 4", n)
+	}
+	if !reflect.DeepEqual(tree, want) {
+		t.Errorf("anonymize = %v, want %v", tree, want)
+	}
+}
+
+func TestIsPlayerNameText(t *testing.T) {
+	for _, tc := range []struct {
+		k, v string
+		want bool
+	}{
+		{"SkullOwner", "Steve", true},
+		{"Inventory[0]/tag/SkullOwner/Name", "Steve", true},
+		{"Items[0]/components/minecraft:profile/name", "Steve", true},
+		{"Items[0]/components/minecraft:profile", "Steve", true},
+		{"Level/TileEntities[0]/Text1", `{"text":"Steve"}`, true},
+		{"Entities[0]/CustomName", "Steve", true},
+		{"Entities[0]/Tags[0]", "Steve", false},
+		{"Entities[0]/Team", "Steve", false},
+		{"Level/Structures/References/steve", "Steve", false},
+	} {
+		if got := isPlayerNameText(3465, tc.k, tc.v); got != tc.want {
+			t.Errorf("isPlayerNameText(%q, %q) = %v, want %v", tc.k, tc.v, got, tc.want)
+		}
+	}
+}
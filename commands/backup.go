@@ -0,0 +1,218 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bwkimmel/mcstrings/log"
+)
+
+// manifestName is the name of the manifest file, relative to the backup
+// directory.
+const manifestName = "manifest.json"
+
+// backupManifest lists the files saved in a backup directory.
+type backupManifest struct {
+	World   string        `json:"world"`   // Absolute path to the world.
+	Command string        `json:"command"` // The command which made the backup.
+	Created time.Time     `json:"created"`
+	Files   []*backupFile `json:"files"`
+}
+
+// backupFile is a single file saved in a backup directory.
+type backupFile struct {
+	// Path is the path to the file relative to the world directory, using
+	// forward slashes. The copy is saved at the same path relative to the backup
+	// directory.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// backup saves copies of the files in a world before they are modified, so
+// that they can be restored using the restore command. Only the files which
+// are about to change are copied, so a backup is much smaller than a copy of
+// the whole world. It is safe for concurrent use.
+type backup struct {
+	mu       sync.Mutex
+	dir      string
+	world    string
+	manifest backupManifest
+	saved    map[string]bool
+}
+
+// newBackup prepares the directory dir for a backup of the world. The directory
+// is created if necessary, but must not already contain a backup.
+func newBackup(dir, world, command string) (*backup, error) {
+	abs, err := filepath.Abs(world)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestName)); err == nil {
+		return nil, fmt.Errorf("backup directory %q already contains a backup", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create backup directory: %v", err)
+	}
+	b := &backup{
+		dir:   dir,
+		world: world,
+		manifest: backupManifest{
+			World:   abs,
+			Command: command,
+			Created: time.Now().UTC(),
+		},
+		saved: make(map[string]bool),
+	}
+	// Write an empty manifest now, so that the directory cannot be reused for
+	// another backup.
+	if err := b.writeManifest(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// openBackup reopens the backup of the world in the directory dir, so that
+// more files may be added to it. Files which are already in the backup are not
+// saved again, so the backup keeps their original contents.
+func openBackup(dir, world string) (*backup, error) {
+	abs, err := filepath.Abs(world)
+	if err != nil {
+		return nil, err
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m.World != abs {
+		return nil, fmt.Errorf("backup directory %q contains a backup of a different world (%q)", dir, m.World)
+	}
+	b := &backup{
+		dir:      dir,
+		world:    world,
+		manifest: *m,
+		saved:    make(map[string]bool),
+	}
+	for _, f := range m.Files {
+		b.saved[f.Path] = true
+	}
+	return b, nil
+}
+
+// save copies the file at path, within the world, to the backup directory
+// unless it has already been saved. The manifest is updated after each file is
+// saved, so that the backup is usable even if the command is interrupted. It is
+// a no-op if b is nil (i.e., no backup was requested).
+func (b *backup) save(path string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rel, err := filepath.Rel(b.world, path)
+	if err != nil {
+		return fmt.Errorf("cannot find %q in world: %v", path, err)
+	}
+	rel = filepath.ToSlash(rel)
+	if b.saved[rel] {
+		return nil
+	}
+	dest := filepath.Join(b.dir, filepath.FromSlash(rel))
+	log.Debugf("Backing up %q to %q.", path, dest)
+	size, sum, err := copyFile(dest, path)
+	if err != nil {
+		return fmt.Errorf("cannot back up %q: %v", path, err)
+	}
+	b.manifest.Files = append(b.manifest.Files, &backupFile{Path: rel, Size: size, SHA256: sum})
+	b.saved[rel] = true
+	return b.writeManifest()
+}
+
+// writeManifest writes the manifest to the backup directory.
+func (b *backup) writeManifest() error {
+	data, err := json.MarshalIndent(&b.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode backup manifest: %v", err)
+	}
+	path := filepath.Join(b.dir, manifestName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("cannot write backup manifest: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("cannot write backup manifest: %v", err)
+	}
+	return nil
+}
+
+// readManifest reads the manifest from a backup directory.
+func readManifest(dir string) (*backupManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read backup manifest: %v", err)
+	}
+	m := &backupManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest: %v", err)
+	}
+	return m, nil
+}
+
+// copyFile copies the file at src to dest, creating any missing directories,
+// and waits for the copy to reach the disk. It returns the size and SHA-256 hash
+// (hex-encoded) of the data copied.
+func copyFile(dest, src string) (int64, string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return 0, "", err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), in)
+	if err != nil {
+		out.Close()
+		return 0, "", err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return 0, "", err
+	}
+	if err := out.Close(); err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the size and SHA-256 hash (hex-encoded) of the file at path.
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
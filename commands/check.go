@@ -0,0 +1,289 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/google/subcommands"
+)
+
+// Check implements the check command.
+type Check struct {
+	jobs int
+
+	regions  int // Number of region files checked.
+	chunks   int // Number of chunks checked.
+	problems int // Number of problems found.
+	bad      int // Number of region files with problems.
+}
+
+// regionKinds lists the directories within each dimension which contain region
+// files: chunk data, entities, and points of interest.
+var regionKinds = []string{"region", "entities", "poi"}
+
+func (*Check) Name() string {
+	return "check"
+}
+
+func (*Check) Synopsis() string {
+	return "Check the region files of a Minecraft world for corruption."
+}
+
+func (*Check) Usage() string {
+	return `check [-jobs <n>] <world>
+Check the region files of a Minecraft world for corruption.
+
+Check reads every region file in the world (including the entities and poi
+region files) and reports every problem it finds, rather than stopping at the
+first one as the other commands do. The world is not modified. The problems
+reported are:
+
+  - region files whose size is not a whole number of 4kB sectors;
+  - chunk location entries which lie outside the file (or overlap the
+    location and timestamp tables), or which overlap another chunk;
+  - chunks whose length does not fit in the sectors allocated to them, or
+    which are allocated more sectors than their length requires;
+  - chunks with an unknown compression type;
+  - chunks which cannot be decompressed, or whose NBT data cannot be decoded;
+  - chunks whose position (xPos and zPos, or the Position of an entities
+    chunk) does not match their slot in the region file.
+
+Each problem is logged, followed by a summary. The exit status is non-zero if
+any problems were found, so that check can be used in scripts. Use the repair
+command to fix the problems found. See
+https://minecraft.gamepedia.com/wiki/Region_file_format.
+
+If -jobs is greater than 1, that many region files are checked at a time.
+
+`
+}
+
+func (c *Check) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&c.jobs, "jobs", 1, "Number of region files to check concurrently.")
+}
+
+func (c *Check) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		log.Errorf("<world> is required.")
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 1 {
+		log.Error("Extra positional arguments found.")
+		return subcommands.ExitUsageError
+	}
+	if c.jobs < 1 {
+		log.Errorf("Invalid value for -jobs (%d), must be at least 1.", c.jobs)
+		return subcommands.ExitUsageError
+	}
+	if err := c.checkWorld(f.Arg(0)); err != nil {
+		log.Errorf("Check: %v", err)
+		return subcommands.ExitFailure
+	}
+	log.Infof("Checked %d chunks in %d region files: found %d problems in %d region files.", c.chunks, c.regions, c.problems, c.bad)
+	if c.problems > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// checkJob identifies a region file to check, and the kind of data it holds
+// (see regionKinds).
+type checkJob struct {
+	*regionRef
+	kind string
+}
+
+// listCheckJobs returns the non-empty region files of each kind (see
+// regionKinds) in the world located in the specified path.
+func listCheckJobs(path string) ([]*checkJob, error) {
+	var jobs []*checkJob
+	for _, kind := range regionKinds {
+		regions, err := listRegions(path, kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range regions {
+			jobs = append(jobs, &checkJob{r, kind})
+		}
+	}
+	return jobs, nil
+}
+
+// nextCheckJob returns a function which returns each of the jobs in turn, and
+// then io.EOF. See pipeline.
+func nextCheckJob(jobs []*checkJob) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if len(jobs) == 0 {
+			return nil, io.EOF
+		}
+		j := jobs[0]
+		jobs = jobs[1:]
+		return j, nil
+	}
+}
+
+// checkResult holds the outcome of checking a region file.
+type checkResult struct {
+	path     string
+	chunks   int      // Number of chunks checked.
+	problems []string // Descriptions of the problems found.
+}
+
+// checkWorld checks all region files in a world, up to c.jobs at a time, and
+// logs the problems found in each one in turn.
+func (c *Check) checkWorld(path string) error {
+	jobs, err := listCheckJobs(path)
+	if err != nil {
+		return err
+	}
+	return pipeline(c.jobs, nextCheckJob(jobs), func(job interface{}) (interface{}, error) {
+		j := job.(*checkJob)
+		return checkRegion(j.rx, j.rz, j.path, j.kind)
+	}, func(result interface{}) error {
+		r := result.(*checkResult)
+		c.regions++
+		c.chunks += r.chunks
+		c.problems += len(r.problems)
+		if len(r.problems) > 0 {
+			c.bad++
+		}
+		for _, p := range r.problems {
+			log.Warnf("Region file %q: %s.", r.path, p)
+		}
+		return nil
+	})
+}
+
+// checkRegion checks the region file at the specified path, holding data of the
+// specified kind for region (rx, rz). An error is only returned if the file
+// cannot be read at all; problems with its contents are returned in the
+// result.
+func checkRegion(rx, rz int, path, kind string) (*checkResult, error) {
+	res := &checkResult{path: path}
+	problemf := func(format string, args ...interface{}) {
+		res.problems = append(res.problems, fmt.Sprintf(format, args...))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open region file %q: %v", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat region file %q: %v", path, err)
+	}
+	size := fi.Size()
+	if size%sectorSize != 0 {
+		problemf("size (%d bytes) is not a multiple of the sector size (%d bytes)", size, sectorSize)
+	}
+	if size < 2*sectorSize {
+		problemf("file is too short to hold the chunk location and timestamp tables")
+		return res, nil
+	}
+	locs, err := readLocations(f)
+	if err != nil {
+		return nil, fmt.Errorf("region file %q: %v", path, err)
+	}
+
+	// owner records the slot of the first chunk found to occupy each sector
+	// within the file, or -1 if there is none.
+	owner := make([]int, (size+sectorSize-1)/sectorSize)
+	for i := range owner {
+		owner[i] = -1
+	}
+	for i, loc := range locs {
+		if loc == 0 {
+			continue
+		}
+		dx, dz := i%32, i/32
+		x, z := rx*32+dx, rz*32+dz
+		chunkf := func(format string, args ...interface{}) {
+			problemf("chunk (%d, %d): %s", x, z, fmt.Sprintf(format, args...))
+		}
+		res.chunks++
+		start, n := int(loc>>8), locSectors(loc)
+		if n == 0 {
+			chunkf("location entry at sector %d has no sectors", start)
+			continue
+		}
+		if start < 2 {
+			chunkf("sectors %d-%d overlap the chunk location and timestamp tables", start, start+n-1)
+			continue
+		}
+		if start+n > len(owner) {
+			chunkf("sectors %d-%d lie beyond the end of the file (%d sectors)", start, start+n-1, len(owner))
+			continue
+		}
+		overlaps := make(map[int]bool)
+		for s := start; s < start+n; s++ {
+			if owner[s] < 0 {
+				owner[s] = i
+			} else if !overlaps[owner[s]] {
+				overlaps[owner[s]] = true
+				chunkf("sectors %d-%d overlap chunk (%d, %d)", start, start+n-1, rx*32+owner[s]%32, rz*32+owner[s]/32)
+			}
+		}
+		for _, p := range checkChunk(f, loc, filepath.Dir(path), x, z, kind) {
+			chunkf("%s", p)
+		}
+	}
+	return res, nil
+}
+
+// checkChunk checks the chunk data referenced by a chunk location entry for
+// chunk (x, z), which must lie within the region file. Dir is the directory
+// containing the region file, and kind is the kind of data it holds (see
+// regionKinds). It returns descriptions of the problems found.
+func checkChunk(f io.ReaderAt, loc uint32, dir string, x, z int, kind string) []string {
+	r := io.NewSectionReader(f, locOffset(loc), int64(locSectors(loc))*sectorSize)
+	length, compression, err := readChunkHeader(r)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	n := locSectors(loc)
+	need := chunkSectors(length)
+	if length < 1 || need > n {
+		return []string{fmt.Sprintf("length (%d bytes) does not fit in the %d sectors allocated to the chunk", length, n)}
+	}
+	var problems []string
+	if need < n {
+		problems = append(problems, fmt.Sprintf("%d sectors are allocated to the chunk, but its length (%d bytes) only requires %d", n, length, need))
+	}
+	tree, err := decodeChunkData(r, length, compression, externalChunkPath(dir, x, z))
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if cx, cz, ok := recordedPos(tree, kind); ok && (cx != x || cz != z) {
+		problems = append(problems, fmt.Sprintf("chunk data is for chunk (%d, %d)", cx, cz))
+	}
+	return problems
+}
+
+// recordedPos returns the position recorded in the NBT tree of a chunk holding
+// data of the specified kind (see regionKinds), if there is one: the xPos and
+// zPos tags (within the Level tag before 1.18) for chunk data, and the
+// Position tag for entities. See https://minecraft.gamepedia.com/Chunk_format.
+func recordedPos(tree map[string]interface{}, kind string) (x, z int, ok bool) {
+	switch kind {
+	case "region":
+		if _, ok := tree["xPos"]; !ok {
+			if level, ok := tree["Level"].(map[string]interface{}); ok {
+				tree = level
+			}
+		}
+		x, xok := tree["xPos"].(int32)
+		z, zok := tree["zPos"].(int32)
+		return int(x), int(z), xok && zok
+	case "entities":
+		// Int arrays are decoded as Go arrays of the same length.
+		if pos, ok := tree["Position"].([2]int32); ok {
+			return int(pos[0]), int(pos[1]), true
+		}
+	}
+	return 0, 0, false
+}
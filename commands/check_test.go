@@ -0,0 +1,192 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/subcommands"
+)
+
+func TestCheckRegion(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		build func(t *testing.T, r *testRegion)
+		want  []string // Substrings of the problems expected, in order.
+	}{
+		{
+			name: "valid",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.put(33, 3, testChunk(t, 1, 1))
+			},
+		},
+		{
+			name: "overlap",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.setLoc(1, 2<<8|1)
+			},
+			want: []string{"chunk (1, 0): sectors 2-2 overlap chunk (0, 0)", "chunk (1, 0): chunk data is for chunk (0, 0)"},
+		},
+		{
+			name: "beyond end of file",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.setLoc(1, 10<<8|1)
+			},
+			want: []string{"chunk (1, 0): sectors 10-10 lie beyond the end of the file (3 sectors)"},
+		},
+		{
+			name: "overlaps tables",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.setLoc(1, 1<<8|1)
+			},
+			want: []string{"chunk (1, 0): sectors 1-1 overlap the chunk location and timestamp tables"},
+		},
+		{
+			name: "no sectors",
+			build: func(t *testing.T, r *testRegion) {
+				r.setLoc(0, 2<<8)
+			},
+			want: []string{"chunk (0, 0): location entry at sector 2 has no sectors"},
+		},
+		{
+			name: "length too long for sectors",
+			build: func(t *testing.T, r *testRegion) {
+				data := testChunk(t, 0, 0)
+				copy(data, []byte{0, 0, 0x20, 0})
+				r.put(0, 2, data)
+			},
+			want: []string{"chunk (0, 0): length (8192 bytes) does not fit in the 1 sectors allocated to the chunk"},
+		},
+		{
+			name: "too many sectors",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, append(testChunk(t, 0, 0), make([]byte, sectorSize)...))
+			},
+			want: []string{"chunk (0, 0): 2 sectors are allocated to the chunk, but its length"},
+		},
+		{
+			name: "unknown compression type",
+			build: func(t *testing.T, r *testRegion) {
+				data := testChunk(t, 0, 0)
+				data[4] = 9
+				r.put(0, 2, data)
+			},
+			want: []string{"chunk (0, 0): cannot decompress chunk data: invalid compression type: 9"},
+		},
+		{
+			name: "bad compressed data",
+			build: func(t *testing.T, r *testRegion) {
+				data := testChunk(t, 0, 0)
+				copy(data[5:], "not zlib data")
+				r.put(0, 2, data)
+			},
+			want: []string{"chunk (0, 0): cannot decompress chunk data"},
+		},
+		{
+			name: "truncated compressed data",
+			build: func(t *testing.T, r *testRegion) {
+				data := testChunk(t, 0, 0)
+				copy(data, []byte{0, 0, 0, 8})
+				r.put(0, 2, data)
+			},
+			want: []string{"chunk (0, 0): cannot decompress chunk data"},
+		},
+		{
+			name: "position mismatch",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.put(1, 3, testChunk(t, 5, 7))
+			},
+			want: []string{"chunk (1, 0): chunk data is for chunk (5, 7)"},
+		},
+		{
+			name: "partial sector",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.f.data = append(r.f.data, 1, 2, 3)
+			},
+			want: []string{"size (12291 bytes) is not a multiple of the sector size"},
+		},
+	} {
+		r := newTestRegion(t)
+		tc.build(t, r)
+		path := filepath.Join(t.TempDir(), "region", "r.0.0.mca")
+		r.save(path)
+		res, err := checkRegion(0, 0, path, "region")
+		if err != nil {
+			t.Errorf("%s: checkRegion failed: %v", tc.name, err)
+			continue
+		}
+		if len(res.problems) != len(tc.want) {
+			t.Errorf("%s: problems = %q, want %q", tc.name, res.problems, tc.want)
+			continue
+		}
+		for i, p := range res.problems {
+			if !strings.Contains(p, tc.want[i]) {
+				t.Errorf("%s: problem %d = %q, want %q", tc.name, i, p, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestRecordedPos(t *testing.T) {
+	for _, tc := range []struct {
+		kind  string
+		tree  map[string]interface{}
+		wantX int
+		wantZ int
+		ok    bool
+	}{
+		{"region", map[string]interface{}{"xPos": int32(1), "zPos": int32(-2)}, 1, -2, true},
+		{"region", map[string]interface{}{"Level": map[string]interface{}{"xPos": int32(3), "zPos": int32(4)}}, 3, 4, true},
+		{"region", map[string]interface{}{}, 0, 0, false},
+		{"entities", map[string]interface{}{"Position": [2]int32{5, 6}}, 5, 6, true},
+		{"poi", map[string]interface{}{"xPos": int32(1), "zPos": int32(2)}, 0, 0, false},
+	} {
+		x, z, ok := recordedPos(tc.tree, tc.kind)
+		if got, want := []interface{}{x, z, ok}, []interface{}{tc.wantX, tc.wantZ, tc.ok}; !reflect.DeepEqual(got, want) {
+			t.Errorf("recordedPos(%v, %q) = %v, want %v", tc.tree, tc.kind, got, want)
+		}
+	}
+}
+
+func TestCheckExitStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		loc      uint32 // The location entry for chunk 1.
+		problems int
+		want     subcommands.ExitStatus
+	}{
+		{"valid", 0, 0, subcommands.ExitSuccess},
+		{"damaged", 10<<8 | 1, 1, subcommands.ExitFailure},
+	} {
+		world := t.TempDir()
+		for _, kind := range []string{"region", "entities"} {
+			r := newTestRegion(t)
+			r.put(0, 2, testChunk(t, 0, 0))
+			if kind == "region" {
+				r.setLoc(1, tc.loc)
+			}
+			r.save(filepath.Join(world, kind, "r.0.0.mca"))
+		}
+		c := &Check{}
+		fs := flag.NewFlagSet("check", flag.ContinueOnError)
+		c.SetFlags(fs)
+		if err := fs.Parse([]string{"-jobs", "2", world}); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Execute(context.Background(), fs); got != tc.want {
+			t.Errorf("%s: exit status = %v, want %v", tc.name, got, tc.want)
+		}
+		if c.regions != 2 || c.problems != tc.problems {
+			t.Errorf("%s: checked %d regions with %d problems, want 2 regions with %d problems", tc.name, c.regions, c.problems, tc.problems)
+		}
+	}
+}
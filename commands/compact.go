@@ -1,14 +1,15 @@
 package commands
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/csv"
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
-	"sort"
-	"strings"
+	"strconv"
 
 	"github.com/bwkimmel/mcstrings/log"
 	"github.com/google/subcommands"
@@ -17,6 +18,41 @@ import (
 // Compact implements the compact command.
 type Compact struct {
 	skipConfirm bool
+	force       bool
+	backupDir   string
+	backup      *backup
+	jobs        int
+
+	// scrub indicates that all bytes of the region files not covered by the
+	// data of a chunk should be zeroed, as well as orphaned sectors being
+	// removed.
+	scrub bool
+
+	// dryRun indicates that the space which would be freed should be
+	// reported, without modifying the world.
+	dryRun     bool
+	reportFile string
+	report     *csv.Writer
+	total      compactStats
+}
+
+// compactStats describes the space freed by compacting a region file, or which
+// would be freed in a dry run.
+type compactStats struct {
+	regions  int   // Number of region files.
+	orphaned int   // Number of orphaned sectors.
+	freed    int64 // Number of bytes by which the file shrinks.
+	moved    int   // Number of chunks relocated.
+	zeroed   int64 // Number of stale bytes overwritten with zeros (see scrubRegion).
+}
+
+// add adds the counts in o to s.
+func (s *compactStats) add(o *compactStats) {
+	s.regions += o.regions
+	s.orphaned += o.orphaned
+	s.freed += o.freed
+	s.moved += o.moved
+	s.zeroed += o.zeroed
 }
 
 func (*Compact) Name() string {
@@ -28,7 +64,7 @@ func (*Compact) Synopsis() string {
 }
 
 func (*Compact) Usage() string {
-	return `compact <world>
+	return `compact [-backup <dir>] [-scrub] [-dry_run] [-report <file>] <world>
 Compact removes unused sectors from a Minecraft world.
 
 WARNING: This command will modify your world in-place. You should make a backup
@@ -42,11 +78,58 @@ These orphaned sectors could contain stale data. The compact command removes
 this data and shrinks the region files accordingly. See 
 https://minecraft.gamepedia.com/wiki/Region_file_format.
 
+Each region file with orphaned sectors is rewritten to a temporary file
+alongside it, with its chunks in order (which keeps neighbouring chunks close
+together in the file). The temporary file is flushed to disk and then renamed
+over the original, so that the region file is not damaged if compaction is
+interrupted (e.g., by a crash or power loss).
+
+If -backup is specified, each region file is copied to the given directory
+before it is compacted, so that it can be put back using the restore command.
+Region files that contain no orphaned sectors (and, with -scrub, no stale
+bytes) are left untouched, and are not copied.
+
+If -scrub is specified, every byte of each region file which does not hold the
+data of a chunk is also overwritten with zeros. This includes the unused space
+at the end of each chunk's last sector, which may hold data from an earlier,
+larger version of the chunk, and the timestamps of chunks which no longer
+exist. Compaction alone leaves these untouched.
+
+If -dry_run is specified, the world is not modified. Instead, the number of
+orphaned sectors, the number of bytes which would be freed, and the number of
+chunks which would be moved are logged for each region file which would change,
+followed by the totals for the world. With -scrub, the number of stale bytes
+which would be zeroed is included as well.
+
+If -report is specified, the same figures are written to the given CSV file,
+with a row for every region file (whether or not it would change), so that
+worlds with a lot of stale data can be found. The columns are:
+
+  dimension        - The dimension containing the region file (0=overworld,
+                     -1=nether, 1=the end).
+  region_x         - The X coordinate of the region.
+  region_z         - The Z coordinate of the region.
+  path             - The path to the region file.
+  orphaned_sectors - The number of 4kB sectors not used by any chunk.
+  bytes_freed      - The number of bytes by which the file shrinks.
+  chunks_moved     - The number of chunks relocated within the file.
+  stale_bytes      - The number of stale bytes zeroed (with -scrub, else 0).
+
+Without -dry_run, the report describes the changes which were made.
+
+If -jobs is greater than 1, that many region files are compacted at a time.
+
 `
 }
 
 func (c *Compact) SetFlags(f *flag.FlagSet) {
 	f.BoolVar(&c.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&c.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+	f.StringVar(&c.backupDir, "backup", "", "Directory to save a copy of each region file to before it is modified (see the restore command).")
+	f.IntVar(&c.jobs, "jobs", 1, "Number of region files to compact concurrently.")
+	f.BoolVar(&c.scrub, "scrub", false, "Also zero all bytes which do not hold chunk data, such as the unused space at the end of each chunk.")
+	f.BoolVar(&c.dryRun, "dry_run", false, "Report the space which would be freed, without modifying the world.")
+	f.StringVar(&c.reportFile, "report", "", "CSV file to write the space freed in each region file to.")
 }
 
 func (c *Compact) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -58,173 +141,297 @@ func (c *Compact) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 		log.Error("Extra positional arguments found.")
 		return subcommands.ExitUsageError
 	}
-	if !c.skipConfirm {
+	if c.jobs < 1 {
+		log.Errorf("Invalid value for -jobs (%d), must be at least 1.", c.jobs)
+		return subcommands.ExitUsageError
+	}
+	if !c.skipConfirm && !c.dryRun {
 		confirm()
 	}
-	if err := compactWorld(f.Arg(0)); err != nil {
+	if !c.dryRun {
+		lock, err := lockWorld(f.Arg(0), c.force)
+		if err != nil {
+			log.Errorf("Compact: %v", err)
+			return subcommands.ExitFailure
+		}
+		defer lock.unlock()
+	}
+	if c.backupDir != "" && !c.dryRun {
+		var err error
+		if c.backup, err = newBackup(c.backupDir, f.Arg(0), "compact"); err != nil {
+			log.Errorf("Compact: %v", err)
+			return subcommands.ExitFailure
+		}
+	}
+	if c.reportFile != "" {
+		out, err := os.Create(c.reportFile)
+		if err != nil {
+			log.Errorf("Compact: cannot open file %q for writing: %v", c.reportFile, err)
+			return subcommands.ExitFailure
+		}
+		defer out.Close()
+		c.report = csv.NewWriter(out)
+		c.report.Write([]string{"dimension", "region_x", "region_z", "path", "orphaned_sectors", "bytes_freed", "chunks_moved", "stale_bytes"})
+	}
+	err := c.compactWorld(f.Arg(0))
+	if c.report != nil {
+		c.report.Flush()
+		if werr := c.report.Error(); werr != nil && err == nil {
+			err = fmt.Errorf("cannot write %q: %v", c.reportFile, werr)
+		}
+	}
+	if err != nil {
 		log.Errorf("Compact: %v", err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
 
-// compactWorld compacts all region files in a world.
-func compactWorld(path string) error {
-	if err := compactDimension(filepath.Join(path, "region")); err != nil {
+// compactWorld compacts all region files in a world, up to c.jobs at a time.
+// If there is a backup, each region file is saved to it before it is modified.
+func (c *Compact) compactWorld(path string) error {
+	regions, err := listRegions(path, "region")
+	if err != nil {
 		return err
 	}
-	if err := compactDimension(filepath.Join(path, "DIM-1", "region")); err != nil {
+	err = pipeline(c.jobs, nextRegion(regions), func(job interface{}) (interface{}, error) {
+		r := job.(*regionRef)
+		stats, err := c.compactRegion(r.path)
+		if err != nil {
+			return nil, fmt.Errorf("region file %q: %v", r.path, err)
+		}
+		return []interface{}{r, stats}, nil
+	}, func(result interface{}) error {
+		v := result.([]interface{})
+		c.reportRegion(v[0].(*regionRef), v[1].(*compactStats))
+		return nil
+	})
+	if err != nil {
 		return err
 	}
-	if err := compactDimension(filepath.Join(path, "DIM1", "region")); err != nil {
-		return err
+	if c.dryRun {
+		t := &c.total
+		msg := fmt.Sprintf("%d of %d region files would change: %d orphaned sectors, %d bytes would be freed, %d chunks would move", t.regions, len(regions), t.orphaned, t.freed, t.moved)
+		if c.scrub {
+			msg += fmt.Sprintf(", %d stale bytes would be zeroed", t.zeroed)
+		}
+		log.Infof("%s.", msg)
 	}
 	return nil
 }
 
-// compactDimension compacts all region files in a dimension.
-func compactDimension(path string) error {
-	dir, err := os.ReadDir(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return fmt.Errorf("cannot read contents of directory %q: %v", path, err)
+// reportRegion records the space freed by compacting a region file: in the
+// totals, in the log in a dry run, and in the report if requested.
+func (c *Compact) reportRegion(r *regionRef, stats *compactStats) {
+	changed := stats.orphaned > 0 || stats.freed > 0 || stats.moved > 0 || stats.zeroed > 0
+	if changed {
+		stats.regions = 1
 	}
-
-	for _, entry := range dir {
-		if !strings.HasSuffix(entry.Name(), ".mca") {
-			continue
-		}
-		region := filepath.Join(path, entry.Name())
-		if fi, err := os.Stat(region); err != nil {
-			return fmt.Errorf("cannot stat region file %q: %v", region, err)
-		} else if fi.Size() == 0 {
-			log.Infof("Skipping empty region file %q", region)
-			continue
-		}
-		var x, z int
-		if _, err := fmt.Sscanf(entry.Name(), "r.%d.%d.mca", &x, &z); err != nil {
-			return fmt.Errorf("invalid region file name %q", region)
-		}
-		if err := compactRegion(region); err != nil {
-			return fmt.Errorf("region file %q: %v", region, err)
+	c.total.add(stats)
+	if c.dryRun && changed {
+		msg := fmt.Sprintf("Region file %q: %d orphaned sectors, %d bytes would be freed, %d chunks would move", r.path, stats.orphaned, stats.freed, stats.moved)
+		if c.scrub {
+			msg += fmt.Sprintf(", %d stale bytes would be zeroed", stats.zeroed)
 		}
+		log.Infof("%s.", msg)
+	}
+	if c.report != nil {
+		c.report.Write([]string{
+			strconv.Itoa(r.dim),
+			strconv.Itoa(r.rx),
+			strconv.Itoa(r.rz),
+			r.path,
+			strconv.Itoa(stats.orphaned),
+			strconv.FormatInt(stats.freed, 10),
+			strconv.Itoa(stats.moved),
+			strconv.FormatInt(stats.zeroed, 10),
+		})
 	}
-	return nil
 }
 
-// compactRegion file compacts the specified region file.
-func compactRegion(path string) error {
-	f, err := os.OpenFile(path, os.O_RDWR, 0)
+// compactRegion file compacts the specified region file, and scrubs it if
+// requested (see scrubRegion). In a dry run, the file is left untouched. It
+// returns the space which was (or would be) freed.
+//
+// A region file is compacted by writing a copy of it with the chunks in slot
+// order, immediately after the chunk location and timestamp tables, so that
+// neighbouring chunks are close together in the file. The copy replaces the
+// original file only once it is complete (see replaceFile), so that the file is
+// not damaged if compaction is interrupted.
+func (c *Compact) compactRegion(path string) (*compactStats, error) {
+	mode := os.O_RDWR
+	if c.dryRun {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, mode, 0)
 	if err != nil {
-		return fmt.Errorf("cannot open file: %v", err)
+		return nil, fmt.Errorf("cannot open file: %v", err)
 	}
 	defer f.Close()
-
-	// Read the chunk locations from the first 4kB of the file.
-	locs := make([]uint32, 1024)
-	if err := binary.Read(f, binary.BigEndian, locs); err != nil {
-		return fmt.Errorf("cannot read chunk locations: %v", err)
+	locs, err := readLocations(f)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat file: %v", err)
 	}
 
-	// sectors lists the occupied 4kB sectors in the file. The first two 4kB
-	// sectors are always occupied -- they contain the chunk location data and
-	// chunk timestamps. See
-	// https://minecraft.gamepedia.com/wiki/Region_file_format#Structure
-	sectors := []int32{0, 1}
+	// A use count above one indicates that there are overlapping sectors in the
+	// file (see sectorMap).
+	m := newSectorMap(locs)
+	for _, used := range m.used {
+		if used > 1 {
+			return nil, fmt.Errorf("found overlapping sectors in region file")
+		}
+	}
+	oldSize := fi.Size()
+	fileSectors := int((oldSize + sectorSize - 1) / sectorSize)
+	stats := &compactStats{}
+	for i := 0; i < fileSectors; i++ {
+		if i >= len(m.used) || m.used[i] == 0 {
+			stats.orphaned++
+		}
+	}
 
-	// reloc maps original sectors to their new location. It will only be
-	// populated for sectors which are the starts of chunk data.
-	reloc := make(map[int32]int32)
-	for _, loc := range locs {
+	// newLocs is the chunk location table of the compacted file.
+	newLocs := make([]uint32, len(locs))
+	next := 2 // Next free sector, after the location and timestamp tables.
+	for i, loc := range locs {
 		if loc == 0 {
 			continue
 		}
-		start := int32((loc & 0xffffff00) >> 8)
-		end := start + int32(loc&0xff)
-		reloc[start] = -1 // Add placeholder for now.
-		for sector := start; sector < end; sector++ {
-			sectors = append(sectors, sector)
-		}
+		newLocs[i] = uint32(next<<8) | loc&0xff
+		next += locSectors(loc)
 	}
+	newSize := int64(next) * sectorSize
 
-	// After sorting the list of occupied sectors, the index into this array will
-	// represent the sector index after compaction, and the value will represent
-	// the original sector index.
-	sort.Slice(sectors, func(i, j int) bool {
-		return sectors[i] < sectors[j]
-	})
-
-	// Sanity check: if a sector appears more than once, then there are
-	// overlapping sectors in the file.
-	prev := int32(-1)
-	for _, sector := range sectors {
-		if sector == prev {
-			return fmt.Errorf("found overlapping sectors in region file")
+	// Leave the file untouched if it has no orphaned sectors.
+	compact := stats.orphaned == 0 && oldSize == newSize
+	if compact {
+		log.Debugf("Region file %q is already compact.", path)
+	} else {
+		stats.freed = oldSize - newSize
+		for i, loc := range locs {
+			if loc>>8 != newLocs[i]>>8 {
+				stats.moved++
+			}
 		}
-		prev = sector
 	}
-
-	buf := make([]byte, 4096)   // Buffer for transferring sector data.
-	for i, j := range sectors { // i = new sector, j = old sector
-		if _, ok := reloc[j]; ok { // Check for placeholder.
-			reloc[j] = int32(i)
+	if compact || c.dryRun {
+		if c.scrub {
+			stats.zeroed, err = c.scrubRegion(f, path, locs)
 		}
-		if int32(i) > j {
-			return fmt.Errorf("cannot relocate sector later in file")
-		} else if int32(i) == j {
-			continue // No relocation necessary for this sector.
+		return stats, err
+	}
+	if err := c.backup.save(path); err != nil {
+		return nil, err
+	}
+	logLevel := log.Debugf
+	if newSize < oldSize {
+		logLevel = log.Infof
+	}
+	logLevel("Removing %d bytes from region file %q.", oldSize-newSize, path)
+	timestamps, err := readTimestamps(f)
+	if err != nil {
+		return nil, err
+	}
+	err = replaceFile(path, func(tmp *os.File) error {
+		if err := writeLocations(tmp, newLocs); err != nil {
+			return err
 		}
-		if _, err := f.Seek(int64(j)*4096, 0); err != nil {
-			return fmt.Errorf("cannot seek to sector %d: %v", j, err)
+		if err := writeTimestamps(tmp, timestamps); err != nil {
+			return err
 		}
-		if n, err := f.Read(buf); err != nil {
-			return fmt.Errorf("cannot read sector %d: %v", j, err)
-		} else if n != 4096 {
-			return fmt.Errorf("sector %d: invalid length: %d", j, n)
+		for i, loc := range locs {
+			if loc == 0 {
+				continue
+			}
+			data := make([]byte, locSectors(loc)*sectorSize)
+			if _, err := f.ReadAt(data, locOffset(loc)); err != nil {
+				return fmt.Errorf("cannot read chunk %d: %v", i, err)
+			}
+			if _, err := tmp.WriteAt(data, locOffset(newLocs[i])); err != nil {
+				return fmt.Errorf("cannot write chunk %d: %v", i, err)
+			}
 		}
-		if _, err := f.Seek(int64(i)*4096, 0); err != nil {
-			return fmt.Errorf("cannot seek to sector %d: %v", i, err)
+		// Close the original file, so that it can be replaced.
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("cannot close file: %v", err)
 		}
-		if _, err := f.Write(buf); err != nil {
-			return fmt.Errorf("cannot write sector %d: %v", i, err)
+		if c.scrub {
+			stats.zeroed, err = c.scrubRegion(tmp, path, newLocs)
 		}
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return stats, nil
+}
 
-	// Rebuild the chunk location table and write the updated table back to the
-	// first 4kB of the file.
+// scrubRegion overwrites the bytes of a compacted region file which do not hold
+// chunk data with zeros: the unused space after the data of each chunk, up to
+// the end of the sectors allocated to it, and the timestamps of chunks which do
+// not exist. Locs is the chunk location table. Path is the region file which f
+// holds, or is about to replace (see compactRegion), which is saved to the
+// backup before anything is written. It returns the number of bytes zeroed, or
+// which would be zeroed in a dry run. See
+// https://minecraft.gamepedia.com/wiki/Region_file_format#Chunk_data.
+func (c *Compact) scrubRegion(f *os.File, path string, locs []uint32) (int64, error) {
+	type span struct{ off, n int64 }
+	var stale []span
+	timestamps, err := readTimestamps(f)
+	if err != nil {
+		return 0, err
+	}
 	for i, loc := range locs {
 		if loc == 0 {
+			if timestamps[i] != 0 {
+				stale = append(stale, span{sectorSize + int64(4*i), 4})
+			}
 			continue
 		}
-		start := int32((loc & 0xffffff00) >> 8)
-		count := int32(loc & 0xff)
-		newStart, ok := reloc[start]
-		if !ok {
-			return fmt.Errorf("cannot find new location for sector %d", start)
+		var length int32
+		if err := binary.Read(io.NewSectionReader(f, locOffset(loc), 4), binary.BigEndian, &length); err != nil {
+			return 0, fmt.Errorf("cannot read length of chunk %d: %v", i, err)
+		}
+		// The data comprises the length itself and length bytes following it.
+		end := int64(locSectors(loc)) * sectorSize
+		used := 4 + int64(length)
+		if length < 1 || used > end {
+			log.Warnf("Not scrubbing chunk %d in region file %q: invalid length (%d).", i, path, length)
+			continue
+		}
+		if used < end {
+			stale = append(stale, span{locOffset(loc) + used, end - used})
 		}
-		locs[i] = uint32(newStart<<8) | uint32(count)
-	}
-
-	if _, err := f.Seek(0, 0); err != nil {
-		return fmt.Errorf("cannot seek to start of file: %v", err)
-	}
-	if err := binary.Write(f, binary.BigEndian, locs); err != nil {
-		return fmt.Errorf("cannot write new chunk locations: %v", err)
 	}
-
-	// Truncate the now-unoccupied end of the file to its new length after
-	// compaction.
-	oldSize := int64(sectors[len(sectors)-1]) * 4096
-	newSize := int64(len(sectors)-1) * 4096
-	logLevel := log.Debugf
-	if newSize < oldSize {
-		logLevel = log.Infof
+	zeroed := int64(0)
+	buf := make([]byte, sectorSize)
+	zeros := make([]byte, sectorSize)
+	for _, s := range stale {
+		// Leave bytes which are already zero untouched, so that scrubbing a
+		// clean file does not modify it.
+		if _, err := f.ReadAt(buf[:s.n], s.off); err != nil {
+			return 0, fmt.Errorf("cannot read offset %d: %v", s.off, err)
+		}
+		if bytes.Equal(buf[:s.n], zeros[:s.n]) {
+			continue
+		}
+		zeroed += s.n
+		if c.dryRun {
+			continue
+		}
+		if err := c.backup.save(path); err != nil {
+			return 0, err
+		}
+		if _, err := f.WriteAt(zeros[:s.n], s.off); err != nil {
+			return 0, fmt.Errorf("cannot write offset %d: %v", s.off, err)
+		}
 	}
-	logLevel("Removing %d bytes from region file %q.", oldSize-newSize, path)
-	if err := f.Truncate(newSize); err != nil {
-		return fmt.Errorf("cannot truncate region file: %v", err)
+	if zeroed > 0 && !c.dryRun {
+		log.Infof("Zeroed %d stale bytes in region file %q.", zeroed, path)
 	}
-	return nil
+	return zeroed, nil
 }
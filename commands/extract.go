@@ -5,96 +5,66 @@ import (
 	"compress/gzip"
 	"compress/zlib"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/csv"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/bwkimmel/mcstrings/log"
 	"github.com/google/subcommands"
 	"github.com/sandertv/gophertunnel/minecraft/nbt"
 )
 
-var (
-	// outputFilters defines the predicates used for filtering NBT data from the
-	// emitted results.
-	outputFilters = map[string]func(k, v string) bool{
-		"all":       func(_, _ string) bool { return true },
-		"user_text": containsUserText,
-	}
-
-	pagesRE = regexp.MustCompile(`.*/pages\[\d+\]$`)
-	signRE  = regexp.MustCompile(`.*/text\d+$`)
-)
-
 // Extract implements the extract command.
 type Extract struct {
+	filterFlags
 	world  string
-	filter string
-	invert bool
 	header bool
 	output string
-	csv    *csv.Writer
-	keep   func(k, v string) bool
-}
+	keep   filter
+	column string
 
-// validOutputFilters returns a comma-separated list of valid output filter
-// names for usage documentation.
-func validOutputFilters() string {
-	var names []string
-	for k, _ := range outputFilters {
-		names = append(names, k)
-	}
-	return strings.Join(names, ", ")
-}
+	// anchors indicates whether list elements in the nbt_path column should be
+	// identified by anchors rather than indices where possible (see
+	// anchorPath).
+	anchors bool
 
-// clean canonicalizes a string for comparisons by trimming whitespace and
-// converting it to lowercase.
-func clean(s string) string {
-	return strings.ToLower(strings.TrimSpace(s))
+	// original determines whether the original value of each string is written
+	// to an extra column, so that patch can detect strings which have changed
+	// since they were extracted. See originalColumns.
+	original string
+
+	// timestamp determines whether the time each chunk was last saved,
+	// according to the region file's timestamp table, is written to an extra
+	// timestamp column.
+	timestamp bool
+
+	// jobs is the number of region files to read concurrently.
+	jobs int
 }
 
-// containsUserText determines if a NBT entry likely contains user-generated
-// text. This includes sign text, book contents & titles, renamed items, etc.,
-// but excludes entries with empty values (empty strings, null JSON objects,
-// signs with empty text).
-func containsUserText(k, v string) bool {
-	v = clean(v)
-	if v == "" {
-		return false
-	}
-	if v == "null" {
-		return false
-	}
-	if v == `{"text":""}` {
-		return false
-	}
+// originalColumns maps each valid value of the -original flag to the name of
+// the column it adds to the output.
+var originalColumns = map[string]string{
+	"none":  "",
+	"value": "original_value",
+	"hash":  "original_sha256",
+}
 
-	k = clean(k)
-	if strings.HasSuffix(k, "/display/name") {
-		return true
-	}
-	if strings.HasSuffix(k, "/customname") {
-		return true
-	}
-	if strings.HasSuffix(k, "/title") {
-		return true
-	}
-	if pagesRE.MatchString(k) {
-		return true
-	}
-	if signRE.MatchString(k) {
-		return true
-	}
-	return false
+// hashString returns the hex-encoded SHA-256 hash of a string, as written to
+// the original_sha256 column.
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
 }
 
 // wrapReader wraps a reader to apply the specified decompression algorithm. See
@@ -108,12 +78,16 @@ func wrapReader(r io.Reader, compression int8) (io.ReadCloser, error) {
 		return zlib.NewReader(r)
 	case 3:
 		return ioutil.NopCloser(r), nil
+	case 4:
+		return newLZ4Reader(r), nil
 	default:
 		return nil, fmt.Errorf("invalid compression type: %d", compression)
 	}
 }
 
-// join combines two segments of an NBT path.
+// join combines two segments of an NBT path. A is the (formatted) name of a tag
+// or a list index in square brackets, and b is the path to a string within that
+// tag (see parsePath).
 func join(a, b string) string {
 	if len(b) == 0 {
 		return a
@@ -150,7 +124,7 @@ func findStrings(x interface{}, cb func(path, value string)) {
 		for _, k := range keys {
 			v := value[k]
 			findStrings(v, func(path, value string) {
-				cb(join(k, path), value)
+				cb(join(formatKey(k), path), value)
 			})
 		}
 	case []interface{}:
@@ -162,63 +136,81 @@ func findStrings(x interface{}, cb func(path, value string)) {
 	}
 }
 
-// readWorld processes the Minecraft world contained in the specified path. The
-// path should point to the directory containing the world's level.dat file.
-// See https://minecraft.gamepedia.com/Java_Edition_level_format.
-func (e *Extract) readWorld(path string) error {
-	if err := e.readDimension(0, filepath.Join(path, "region")); err != nil {
-		return err
-	}
-	if err := e.readDimension(-1, filepath.Join(path, "DIM-1", "region")); err != nil {
-		return err
-	}
-	if err := e.readDimension(1, filepath.Join(path, "DIM1", "region")); err != nil {
-		return err
+// replaceStrings replaces the strings within an NBT object, calling the
+// provided callback function with the path and value of each string (as for
+// findStrings) and replacing the string with the returned value. It returns the
+// number of strings that were changed.
+func replaceStrings(x interface{}, cb func(path, value string) string) int {
+	updates := 0
+	switch value := x.(type) {
+	case map[string]interface{}:
+		var keys []string
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if s, ok := value[k].(string); ok {
+				if r := cb(formatKey(k), s); r != s {
+					value[k] = r
+					updates++
+				}
+				continue
+			}
+			updates += replaceStrings(value[k], func(path, value string) string {
+				return cb(join(formatKey(k), path), value)
+			})
+		}
+	case []interface{}:
+		for i, v := range value {
+			if s, ok := v.(string); ok {
+				if r := cb(fmt.Sprintf("[%d]", i), s); r != s {
+					value[i] = r
+					updates++
+				}
+				continue
+			}
+			updates += replaceStrings(v, func(path, value string) string {
+				return cb(join(fmt.Sprintf("[%d]", i), path), value)
+			})
+		}
 	}
-	return nil
+	return updates
 }
 
-// readDimension processes the Minecraft dimension contained in the specified
-// path. The path should point to the directory containing the .mca files for
-// the dimension. Dim indicates which dimension is being processed, and should
-// be 0 for overworld, -1 for nether, and 1 for the end.
-func (e *Extract) readDimension(dim int, path string) error {
-	dir, err := os.ReadDir(path)
+// readWorld processes the Minecraft world contained in the specified path. The
+// path should point to the directory containing the world's level.dat file.
+// Up to e.jobs region files are read concurrently, but the output is written
+// in the same order as if they were read one at a time.
+// See https://minecraft.gamepedia.com/Java_Edition_level_format.
+func (e *Extract) readWorld(path string, w io.Writer) error {
+	regions, err := listRegions(path, "region")
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return fmt.Errorf("cannot read contents of directory %q: %v", path, err)
+		return err
 	}
-
-	for _, entry := range dir {
-		if !strings.HasSuffix(entry.Name(), ".mca") {
-			continue
-		}
-		region := filepath.Join(path, entry.Name())
-		if fi, err := os.Stat(region); err != nil {
-			return fmt.Errorf("cannot stat region file %q: %v", region, err)
-		} else if fi.Size() == 0 {
-			log.Infof("Skipping empty region file %q", region)
-			continue
-		}
-		var x, z int
-		if _, err := fmt.Sscanf(entry.Name(), "r.%d.%d.mca", &x, &z); err != nil {
-			return fmt.Errorf("invalid region file name %q", region)
+	return pipeline(e.jobs, nextRegion(regions), func(job interface{}) (interface{}, error) {
+		r := job.(*regionRef)
+		var buf bytes.Buffer
+		out := csv.NewWriter(&buf)
+		if err := e.readRegion(r.dim, r.rx, r.rz, r.path, out); err != nil {
+			return nil, err
 		}
-		if err := e.readRegion(dim, x, z, region); err != nil {
-			return err
+		out.Flush()
+		return buf.Bytes(), out.Error()
+	}, func(result interface{}) error {
+		if _, err := w.Write(result.([]byte)); err != nil {
+			return fmt.Errorf("cannot write output: %v", err)
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 // readRegion processes a single region contained in the specified file. The
 // path should point to an .mca file. Dim indicates the dimension containing
-// this region (see readDimension). X and Z are the coordinates of the region
-// (which are part of the file name).
+// this region (see walkDimension). X and Z are the coordinates of the region
+// (which are part of the file name). The strings found are written to out.
 // See https://minecraft.gamepedia.com/Region_file_format.
-func (e *Extract) readRegion(dim, x, z int, path string) error {
+func (e *Extract) readRegion(dim, x, z int, path string, out *csv.Writer) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("cannot open region file %q: %v", path, err)
@@ -234,6 +226,12 @@ func (e *Extract) readRegion(dim, x, z int, path string) error {
 	if err := binary.Read(f, binary.BigEndian, &locs); err != nil {
 		return fmt.Errorf("cannot read location data from region file %q: %v", path, err)
 	}
+	var timestamps []uint32
+	if e.timestamp {
+		if timestamps, err = readTimestamps(f); err != nil {
+			return fmt.Errorf("region file %q: %v", path, err)
+		}
+	}
 
 	for i, loc := range locs {
 		if loc == 0 {
@@ -245,34 +243,57 @@ func (e *Extract) readRegion(dim, x, z int, path string) error {
 		if _, err := f.Seek(offset, 0); err != nil {
 			return fmt.Errorf("cannot seek to chunk %d in region file %q: %v", i, path, err)
 		}
-		chunk, err := readChunk(&io.LimitedReader{f, size})
+		chunk, _, err := readChunk(&io.LimitedReader{R: f, N: size})
 		if err != nil {
 			return fmt.Errorf("cannot read chunk %d in region file %q: %v", i, path, err)
 		}
+		dv := dataVersion(chunk)
+		var saved string
+		if e.timestamp && timestamps[i] != 0 {
+			saved = time.Unix(int64(timestamps[i]), 0).UTC().Format(time.RFC3339)
+		}
 		findStrings(chunk, func(path, value string) {
-			if !e.keep(path, value) {
+			note, ok := e.keep(dv, path, value)
+			if !ok {
 				return
 			}
-			e.csv.Write([]string{
+			if e.anchors {
+				anchored, err := anchorPath(chunk, path)
+				if err != nil {
+					log.Warnf("Cannot anchor %s in dimension %d, chunk (%d, %d): %v", path, dim, x*32+dx, z*32+dz, err)
+				} else {
+					path = anchored
+				}
+			}
+			rec := []string{
 				strconv.Itoa(dim),
 				strconv.Itoa(x*32 + dx),
 				strconv.Itoa(z*32 + dz),
 				path,
 				value,
-			})
+			}
+			switch e.original {
+			case "value":
+				rec = append(rec, value)
+			case "hash":
+				rec = append(rec, hashString(value))
+			}
+			if e.timestamp {
+				rec = append(rec, saved)
+			}
+			if e.column != "" {
+				rec = append(rec, note)
+			}
+			out.Write(rec)
 		})
-		e.csv.Flush()
-		if err := e.csv.Error(); err != nil {
-			return fmt.Errorf("cannot write output: %v", err)
-		}
 	}
 	return nil
 }
 
-// readChunk reads chunk data and returns a map containing the chunk's NBT tree.
-// See https://minecraft.gamepedia.com/Region_file_format#Chunk_data,
+// readChunk reads chunk data and returns a map containing the chunk's NBT tree,
+// and the compression type used to store the chunk. See https://minecraft.gamepedia.com/Region_file_format#Chunk_data,
 // https://minecraft.gamepedia.com/Chunk_format.
-func readChunk(r io.Reader) (map[string]interface{}, error) {
+func readChunk(r io.Reader) (map[string]interface{}, int8, error) {
 	var (
 		length      int32
 		compression int8
@@ -281,34 +302,90 @@ func readChunk(r io.Reader) (map[string]interface{}, error) {
 	// excluding these four bytes, but including the compression type below.
 	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
 		if err == io.EOF {
-			return nil, err
+			return nil, 0, err
 		}
-		return nil, fmt.Errorf("cannot read chunk length: %v", err)
+		return nil, 0, fmt.Errorf("cannot read chunk length: %v", err)
 	}
 	// The next byte contains the compression type.
 	if err := binary.Read(r, binary.BigEndian, &compression); err != nil {
-		return nil, fmt.Errorf("cannot read compression type: %v", err)
+		return nil, 0, fmt.Errorf("cannot read compression type: %v", err)
 	}
 	// The remaining length-1 bytes contains the (possibly-compressed) chunk data
 	// in NBT format.
 	data := make([]byte, length-1)
 	if _, err := io.ReadFull(r, data); err != nil {
-		return nil, fmt.Errorf("cannot read chunk data: %v", err)
+		return nil, 0, fmt.Errorf("cannot read chunk data: %v", err)
 	}
 	nbtr, err := wrapReader(bytes.NewReader(data), compression)
 	if err != nil {
-		return nil, fmt.Errorf("cannot decompress chunk data: %v", err)
+		return nil, 0, fmt.Errorf("cannot decompress chunk data: %v", err)
 	}
 	defer nbtr.Close()
 	nbtData, err := ioutil.ReadAll(nbtr)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read NBT data: %v", err)
+		return nil, 0, fmt.Errorf("cannot read NBT data: %v", err)
 	}
 	var m map[string]interface{}
 	if err := nbt.UnmarshalEncoding(nbtData, &m, nbt.BigEndian); err != nil {
-		return nil, fmt.Errorf("cannot decode NBT data: %v", err)
+		return nil, 0, fmt.Errorf("cannot decode NBT data: %v", err)
+	}
+	return m, compression, nil
+}
+
+// extract writes the strings in the world to stdout, or to the file named by
+// e.output. The output file is only created once all of the strings have been
+// written to a temporary file alongside it, so that an error does not leave a
+// partially-written file behind.
+func (e *Extract) extract() (err error) {
+	w := os.Stdout
+	if e.output != "" {
+		dir, name := filepath.Split(e.output)
+		if dir == "" {
+			dir = "."
+		}
+		if w, err = ioutil.TempFile(dir, name+".*.tmp"); err != nil {
+			return fmt.Errorf("cannot create temporary output file: %v", err)
+		}
+		defer func() {
+			if err != nil {
+				w.Close()
+				os.Remove(w.Name())
+			}
+		}()
+	}
+	if e.header {
+		header := []string{"dimension", "chunk_x", "chunk_z", "nbt_path", "value"}
+		if col := originalColumns[e.original]; col != "" {
+			header = append(header, col)
+		}
+		if e.timestamp {
+			header = append(header, "timestamp")
+		}
+		if e.column != "" {
+			header = append(header, e.column)
+		}
+		out := csv.NewWriter(w)
+		out.Write(header)
+		if out.Flush(); out.Error() != nil {
+			return fmt.Errorf("cannot write output: %v", out.Error())
+		}
+	}
+	if err := e.readWorld(e.world, w); err != nil {
+		return err
+	}
+	if e.output == "" {
+		return nil
 	}
-	return m, nil
+	if err := w.Chmod(0644); err != nil {
+		return fmt.Errorf("cannot write output: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot write output: %v", err)
+	}
+	if err := os.Rename(w.Name(), e.output); err != nil {
+		return fmt.Errorf("cannot write output: %v", err)
+	}
+	return nil
 }
 
 func (*Extract) Name() string {
@@ -332,16 +409,49 @@ in CSV format with the following columns:
   chunk_x   - The x-coordinate of the chunk containing the string.
   chunk_z   - The z-coordinate of the chunk containing the string.
   nbt_path  - The path within the NBT data tree where the string is located.
+              Names of tags which are empty or contain '/', '[' or ']' are
+              enclosed in double quotes, with '\' escaping '"' and '\'.
   value     - The string.
 
+If -anchors is specified, elements of lists in the nbt_path column are identified
+by the values of identifying tags where possible, rather than by their index
+within the list: items by Slot (e.g., Items[{Slot:3b}]), block entities by
+position (e.g., block_entities[{x:1,y:64,z:-3}]), and entities by UUID (e.g.,
+Entities[{UUID:[I;1,2,3,4]}]). This is the same syntax as Minecraft's /data
+command. Such paths remain correct when other elements are added to, removed
+from or reordered within the list (e.g., when items are moved around a chest).
+
+If -original is "value" or "hash", an original_value or original_sha256 column
+is added, holding a copy of the string or its SHA-256 hash. Edit only the value
+column: the patch command uses the original column to skip (and report) strings
+which have changed in the world since they were extracted, rather than
+overwriting them.
+
+If -timestamp is specified, a timestamp column is added, holding the time the
+chunk containing the string was last saved, according to the region file's
+timestamp table (e.g., 2024-05-01T12:34:56Z, in UTC), or nothing if the chunk
+has no timestamp. The patch command ignores this column.
+
+Filters that explain their matches add a column describing why each string
+matched (e.g., the "pii" filter adds a pii_kind column). The patch command
+ignores this column.
+
+If -jobs is greater than 1, that many region files are read at a time. The
+output is the same, and in the same order, whatever the number of jobs. If
+-output is specified, the file is only created (or replaced) once all of the
+strings have been extracted, so an error does not leave it partially written.
+
 `
 }
 
 func (e *Extract) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&e.filter, "filter", "all", fmt.Sprintf("Only include entries matching a filter (one of: %s)", validOutputFilters()))
-	f.BoolVar(&e.invert, "invert", false, "Output entries *not* matching the filter")
+	e.filterFlags.SetFlags(f, "all")
 	f.BoolVar(&e.header, "header", true, "Include header row in the output")
 	f.StringVar(&e.output, "output", "", "File to write results to (if empty, results are written to stdout)")
+	f.BoolVar(&e.anchors, "anchors", false, "Identify list elements in nbt_path by Slot, position or UUID rather than by index, where possible")
+	f.StringVar(&e.original, "original", "none", "Add a column recording the original value of each string, for conflict detection by patch (one of: none, value, hash)")
+	f.BoolVar(&e.timestamp, "timestamp", false, "Add a column recording the time the chunk containing each string was last saved")
+	f.IntVar(&e.jobs, "jobs", 1, "Number of region files to read concurrently")
 }
 
 func (e *Extract) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -354,33 +464,22 @@ func (e *Extract) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 		return subcommands.ExitUsageError
 	}
 	e.world = f.Arg(0)
-	of, ok := outputFilters[e.filter]
-	if !ok {
-		log.Errorf("Invalid filter (%q), must be one of %s.", e.filter, validOutputFilters())
+	keep, column, err := e.filterFlags.build()
+	if err != nil {
+		log.Errorf("Invalid filter: %v", err)
 		return subcommands.ExitUsageError
 	}
-	if e.invert {
-		orig := of
-		of = func(k, v string) bool {
-			return !orig(k, v)
-		}
-	}
-	w := os.Stdout
-	if e.output != "" {
-		f, err := os.Create(e.output)
-		if err != nil {
-			log.Errorf("Cannot open file %q for writing: %v", e.output, err)
-			return subcommands.ExitFailure
-		}
-		defer f.Close()
-		w = f
+	if _, ok := originalColumns[e.original]; !ok {
+		log.Errorf("Invalid value for -original (%q), must be one of none, value, hash.", e.original)
+		return subcommands.ExitUsageError
 	}
-	e.csv = csv.NewWriter(w)
-	e.keep = of
-	if e.header {
-		e.csv.Write([]string{"dimension", "chunk_x", "chunk_z", "nbt_path", "value"})
+	if e.jobs < 1 {
+		log.Errorf("Invalid value for -jobs (%d), must be at least 1.", e.jobs)
+		return subcommands.ExitUsageError
 	}
-	if err := e.readWorld(e.world); err != nil {
+	e.keep = keep
+	e.column = column
+	if err := e.extract(); err != nil {
 		log.Errorf("Extract: %v", err)
 		return subcommands.ExitFailure
 	}
@@ -0,0 +1,206 @@
+package commands
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// filter selects NBT entries. It reports whether the entry having the NBT path
+// k and string value v, in a chunk with the specified DataVersion, matches the
+// filter. Filters which explain their matches also return a note describing
+// why the entry matched.
+type filter func(dataVersion int32, k, v string) (note string, ok bool)
+
+// outputFilter describes a filter that may be selected on the command line.
+type outputFilter struct {
+	// column is the name of the CSV column containing the notes returned by
+	// this filter, or "" if this filter does not return notes.
+	column string
+	// build constructs the filter using the options provided on the command
+	// line.
+	build func(ff *filterFlags) (filter, error)
+}
+
+var (
+	// outputFilters defines the predicates used for filtering NBT data from the
+	// emitted results.
+	outputFilters = map[string]outputFilter{
+		"all":       {build: func(*filterFlags) (filter, error) { return keepAll, nil }},
+		"user_text": {build: func(*filterFlags) (filter, error) { return containsUserText, nil }},
+		"pii":       {column: "pii_kind", build: newPIIFilter},
+		"wordlist":  {column: "matched_term", build: newWordlistFilter},
+	}
+
+	displayNameRE    = regexp.MustCompile(`.*/display/name$`)
+	customNameRE     = regexp.MustCompile(`.*/customname$`)
+	titleRE          = regexp.MustCompile(`.*/title$`)
+	pagesRE          = regexp.MustCompile(`.*/pages\[\d+\]$`)
+	signRE           = regexp.MustCompile(`.*/text\d+$`)
+	signMessagesRE   = regexp.MustCompile(`.*/(front|back)_text/(filtered_)?messages\[\d+\]$`)
+	componentNameRE  = regexp.MustCompile(`.*/components/minecraft:custom_name$`)
+	componentLoreRE  = regexp.MustCompile(`.*/components/minecraft:lore\[\d+\]$`)
+	componentPagesRE = regexp.MustCompile(`.*/components/minecraft:writ(ten|able)_book_content/pages\[\d+\](/(raw|filtered))?$`)
+	componentTitleRE = regexp.MustCompile(`.*/components/minecraft:written_book_content/title(/(raw|filtered))?$`)
+
+	// userTextRules lists the NBT paths that may contain user-generated text,
+	// according to the DataVersion of the chunk. The rules are ordered from
+	// newest to oldest, and the first rule whose minDataVersion does not exceed
+	// the chunk's DataVersion applies. See
+	// https://minecraft.wiki/w/Data_version.
+	userTextRules = []struct {
+		minDataVersion int32
+		paths          []*regexp.Regexp
+	}{
+		// 1.20.5 moved item data into components.
+		{dataVersion1_20_5, []*regexp.Regexp{customNameRE, signMessagesRE, componentNameRE, componentLoreRE, componentPagesRE, componentTitleRE}},
+		// 1.20 added text to the back of signs.
+		{dataVersion1_20, []*regexp.Regexp{displayNameRE, customNameRE, titleRE, pagesRE, signMessagesRE}},
+		{0, []*regexp.Regexp{displayNameRE, customNameRE, titleRE, pagesRE, signRE}},
+	}
+)
+
+// DataVersions of Minecraft releases that changed where user-generated text is
+// stored. See https://minecraft.wiki/w/Data_version.
+const (
+	dataVersion1_20   = 3463
+	dataVersion1_20_5 = 3837
+)
+
+// filterFlags holds the command line flags for selecting entries. Commands
+// that select entries the same way as the extract command embed this.
+type filterFlags struct {
+	filter    string
+	invert    bool
+	piiNames  string
+	wordlists string
+}
+
+// SetFlags registers the flags for selecting entries. DefaultFilter is the
+// filter to use if -filter is not specified.
+func (ff *filterFlags) SetFlags(f *flag.FlagSet, defaultFilter string) {
+	f.StringVar(&ff.filter, "filter", defaultFilter, fmt.Sprintf("Only include entries matching a filter (one of: %s)", validOutputFilters()))
+	f.BoolVar(&ff.invert, "invert", false, "Include only entries *not* matching the filter")
+	f.StringVar(&ff.piiNames, "pii_names", "", "File listing real names, one per line, for the pii filter to detect")
+	f.StringVar(&ff.wordlists, "wordlist", "", "Comma-separated list of files listing terms, one per line, for the wordlist filter to detect")
+}
+
+// build constructs the filter selected by the flags. Column is the name of the
+// CSV column for the notes returned by the filter, or "" if the filter does not
+// return notes.
+func (ff *filterFlags) build() (keep filter, column string, err error) {
+	of, ok := outputFilters[ff.filter]
+	if !ok {
+		return nil, "", fmt.Errorf("invalid filter (%q), must be one of %s", ff.filter, validOutputFilters())
+	}
+	keep, err = of.build(ff)
+	if err != nil {
+		return nil, "", fmt.Errorf("filter %s: %v", ff.filter, err)
+	}
+	if ff.invert {
+		orig := keep
+		keep = func(dv int32, k, v string) (string, bool) {
+			_, ok := orig(dv, k, v)
+			return "", !ok
+		}
+		// Inverted filters match entries for which there is nothing to explain.
+		return keep, "", nil
+	}
+	return keep, of.column, nil
+}
+
+// validOutputFilters returns a comma-separated list of valid output filter
+// names for usage documentation.
+func validOutputFilters() string {
+	var names []string
+	for k := range outputFilters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// readList reads a file containing one entry per line. Blank lines and lines
+// starting with '#' are ignored.
+func readList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// clean canonicalizes a string for comparisons by trimming whitespace and
+// converting it to lowercase.
+func clean(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// keepAll is a filter that matches every entry.
+func keepAll(_ int32, _, _ string) (string, bool) {
+	return "", true
+}
+
+// isEmptyText determines if a string is empty, or is a JSON text component
+// with no text.
+func isEmptyText(v string) bool {
+	switch clean(v) {
+	case "", "null", `""`, `{"text":""}`:
+		return true
+	}
+	return false
+}
+
+// containsUserText determines if a NBT entry likely contains user-generated
+// text. This includes sign text, book contents & titles, renamed items, etc.,
+// but excludes entries with empty values (empty strings, null JSON objects,
+// signs with empty text). DataVersion is the DataVersion of the chunk
+// containing the entry, which determines where user-generated text is stored.
+func containsUserText(dataVersion int32, k, v string) (string, bool) {
+	if isEmptyText(v) {
+		return "", false
+	}
+	return "", isUserTextPath(dataVersion, k)
+}
+
+// isUserTextPath determines if the NBT path k, in a chunk with the specified
+// DataVersion, is a location where user-generated text is stored.
+func isUserTextPath(dataVersion int32, k string) bool {
+	k = clean(k)
+	for _, rule := range userTextRules {
+		if dataVersion < rule.minDataVersion {
+			continue
+		}
+		for _, re := range rule.paths {
+			if re.MatchString(k) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// dataVersion returns the DataVersion of a chunk, or zero if the chunk predates
+// DataVersions (i.e., it was last saved before 1.9).
+func dataVersion(chunk map[string]interface{}) int32 {
+	v, _ := chunk["DataVersion"].(int32)
+	return v
+}
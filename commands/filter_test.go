@@ -0,0 +1,219 @@
+package commands
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// keptPaths returns the sorted paths of the strings in a chunk which are kept
+// by the user_text filter.
+func keptPaths(chunk map[string]interface{}) []string {
+	dv := dataVersion(chunk)
+	var paths []string
+	findStrings(chunk, func(path, value string) {
+		if _, ok := containsUserText(dv, path, value); ok {
+			paths = append(paths, path)
+		}
+	})
+	sort.Strings(paths)
+	return paths
+}
+
+func TestContainsUserText(t *testing.T) {
+	type m = map[string]interface{}
+	type l = []interface{}
+	for _, tc := range []struct {
+		name  string
+		chunk m
+		want  []string
+	}{
+		{
+			name: "pre-1.20",
+			chunk: m{
+				"DataVersion": int32(3337), // 1.19.4
+				"block_entities": l{
+					m{
+						"id":    "minecraft:sign",
+						"Color": "black",
+						"Text1": `{"text":"Hello"}`,
+						"Text2": `{"text":""}`,
+						"Text3": `""`,
+						"Text4": "null",
+					},
+					m{
+						"id": "minecraft:chest",
+						"Items": l{
+							m{
+								"id": "minecraft:written_book",
+								"tag": m{
+									"title":  "Diary",
+									"author": "Steve",
+									"pages":  l{`{"text":"Dear diary"}`, `""`},
+								},
+							},
+							m{
+								"id": "minecraft:diamond_sword",
+								"tag": m{
+									"display": m{"Name": `{"text":"Excalibur"}`},
+								},
+							},
+						},
+					},
+				},
+				"Entities": l{
+					m{"id": "minecraft:wolf", "CustomName": `{"text":"Rex"}`},
+				},
+			},
+			want: []string{
+				"Entities[0]/CustomName",
+				"block_entities[0]/Text1",
+				"block_entities[1]/Items[0]/tag/pages[0]",
+				"block_entities[1]/Items[0]/tag/title",
+				"block_entities[1]/Items[1]/tag/display/Name",
+			},
+		},
+		{
+			name: "pre-1.20 ignores front_text",
+			chunk: m{
+				"DataVersion": int32(3337),
+				"block_entities": l{
+					m{"id": "minecraft:sign", "front_text": m{"messages": l{`"Hello"`}}},
+				},
+			},
+			want: nil,
+		},
+		{
+			name: "1.20",
+			chunk: m{
+				"DataVersion": int32(dataVersion1_20),
+				"block_entities": l{
+					m{
+						"id": "minecraft:sign",
+						"front_text": m{
+							"color":             "black",
+							"messages":          l{`"Front"`, `""`, `{"text":""}`, `""`},
+							"filtered_messages": l{`"F***t"`, `""`, `""`, `""`},
+						},
+						"back_text": m{
+							"messages": l{`""`, `"Back"`, `""`, `""`},
+						},
+					},
+					// Old-style sign text is no longer where signs store text.
+					m{"id": "minecraft:sign", "Text1": `{"text":"Stale"}`},
+					m{
+						"id": "minecraft:chest",
+						"Items": l{
+							m{
+								"id": "minecraft:written_book",
+								"tag": m{
+									"title":   "Diary",
+									"author":  "Alex",
+									"pages":   l{`{"text":"Page one"}`},
+									"display": m{"Name": `{"text":"Renamed"}`},
+								},
+							},
+						},
+					},
+				},
+			},
+			want: []string{
+				"block_entities[0]/back_text/messages[1]",
+				"block_entities[0]/front_text/filtered_messages[0]",
+				"block_entities[0]/front_text/messages[0]",
+				"block_entities[2]/Items[0]/tag/display/Name",
+				"block_entities[2]/Items[0]/tag/pages[0]",
+				"block_entities[2]/Items[0]/tag/title",
+			},
+		},
+		{
+			name: "1.20.5",
+			chunk: m{
+				"DataVersion": int32(dataVersion1_20_5),
+				"block_entities": l{
+					m{
+						"id":         "minecraft:sign",
+						"front_text": m{"messages": l{`"Front"`, `""`, `""`, `""`}},
+						"back_text":  m{"messages": l{`""`, `""`, `""`, `""`}},
+					},
+					m{
+						"id": "minecraft:chest",
+						"Items": l{
+							m{
+								"id": "minecraft:written_book",
+								"components": m{
+									"minecraft:written_book_content": m{
+										"title":  m{"raw": "Diary", "filtered": "D***y"},
+										"author": "Alex",
+										"pages":  l{m{"raw": `"Page one"`, "filtered": `""`}},
+									},
+								},
+							},
+							m{
+								"id": "minecraft:writable_book",
+								"components": m{
+									"minecraft:writable_book_content": m{
+										"pages": l{m{"raw": "Draft"}},
+									},
+								},
+							},
+							m{
+								"id": "minecraft:diamond_sword",
+								"components": m{
+									"minecraft:custom_name": `"Excalibur"`,
+									"minecraft:lore":        l{`"Forged in fire"`, `""`},
+									"minecraft:item_name":   `"Sword"`,
+								},
+							},
+							// Item tags moved into components in 1.20.5.
+							m{
+								"id":  "minecraft:stick",
+								"tag": m{"display": m{"Name": `{"text":"Stale"}`}},
+							},
+							m{
+								"id":         "minecraft:stone",
+								"components": m{"minecraft:custom_name": `""`},
+							},
+						},
+					},
+				},
+				"Entities": l{
+					m{"id": "minecraft:cat", "CustomName": `"Tom"`},
+				},
+			},
+			want: []string{
+				"Entities[0]/CustomName",
+				"block_entities[0]/front_text/messages[0]",
+				"block_entities[1]/Items[0]/components/minecraft:written_book_content/pages[0]/raw",
+				"block_entities[1]/Items[0]/components/minecraft:written_book_content/title/filtered",
+				"block_entities[1]/Items[0]/components/minecraft:written_book_content/title/raw",
+				"block_entities[1]/Items[1]/components/minecraft:writable_book_content/pages[0]/raw",
+				"block_entities[1]/Items[2]/components/minecraft:custom_name",
+				"block_entities[1]/Items[2]/components/minecraft:lore[0]",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := keptPaths(tc.chunk); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("containsUserText kept %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestContainsUserTextEmpty(t *testing.T) {
+	for _, v := range []string{"", "  ", "null", `""`, `{"text":""}`, `{"TEXT":""}`} {
+		for _, tc := range []struct {
+			dataVersion int32
+			path        string
+		}{
+			{0, "Level/TileEntities[0]/Text1"},
+			{dataVersion1_20, "block_entities[0]/front_text/messages[0]"},
+			{dataVersion1_20_5, "block_entities[0]/Items[0]/components/minecraft:custom_name"},
+		} {
+			if _, ok := containsUserText(tc.dataVersion, tc.path, v); ok {
+				t.Errorf("containsUserText(%d, %q, %q) = true, want false", tc.dataVersion, tc.path, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"io"
+	"sync"
+)
+
+// pipeline processes a sequence of jobs (e.g., region files) using up to n
+// goroutines. Next is called to get each job in turn, and returns io.EOF once
+// there are none left. Work is called concurrently to process each job, and
+// emit is called with the result of each job, one at a time and in the order
+// the jobs were returned by next, so that the outcome is the same as if the jobs
+// were processed one after another. Processing stops at the first error (in
+// that order), which is returned.
+//
+// At most about 2n results are held waiting to be emitted, so that memory use
+// is bounded even if one job takes much longer than those which follow it.
+func pipeline(n int, next func() (interface{}, error), work func(job interface{}) (interface{}, error), emit func(result interface{}) error) error {
+	if n < 1 {
+		n = 1
+	}
+	type result struct {
+		value interface{}
+		err   error
+	}
+	type task struct {
+		job  interface{}
+		done chan<- result
+	}
+	tasks := make(chan task)
+	// order receives the channel for each job's result in the order the jobs
+	// were returned by next. Its capacity limits how far ahead of emit the
+	// workers can get.
+	order := make(chan chan result, n)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tasks {
+				v, err := work(t.job)
+				t.done <- result{v, err} // Buffered, so never blocks.
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(order)
+		defer close(tasks)
+		for {
+			job, err := next()
+			if err == io.EOF {
+				return
+			}
+			done := make(chan result, 1)
+			if err != nil {
+				done <- result{err: err}
+			}
+			select {
+			case order <- done:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+			select {
+			case tasks <- task{job, done}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var err error
+	for done := range order {
+		r := <-done
+		if err = r.err; err == nil {
+			err = emit(r.value)
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	return err
+}
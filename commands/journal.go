@@ -0,0 +1,381 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bwkimmel/mcstrings/log"
+)
+
+// journalName is the name of the journal file, relative to the world
+// directory.
+const journalName = "mcstrings.journal"
+
+// journalEntry is a single record in the journal. The journal is a file
+// containing one JSON-encoded entry per line.
+type journalEntry struct {
+	// Op is the type of entry, one of:
+	//   start  - The first entry in the journal, recording the options needed
+	//            to repeat the run.
+	//   begin  - The start of a transaction modifying a region file.
+	//   undo   - The original contents of a range of a region file which is
+	//            about to be overwritten.
+	//   commit - The end of the current transaction.
+	Op string `json:"op"`
+
+	// Strings, MaskWordlist, KeepTimestamps and BackupDir record the -strings,
+	// -mask_wordlist, -keep_timestamps and -backup flags of the patch command
+	// (start entries only).
+	Strings        string `json:"strings,omitempty"`
+	MaskWordlist   string `json:"mask_wordlist,omitempty"`
+	KeepTimestamps bool   `json:"keep_timestamps,omitempty"`
+	BackupDir      string `json:"backup_dir,omitempty"`
+	// StringsSHA256 and MaskWordlistSHA256 are the SHA-256 hashes of the
+	// -strings and -mask_wordlist files (see hashInputs), used to check that
+	// they have not changed before the run is finished (start entries only).
+	StringsSHA256      string `json:"strings_sha256,omitempty"`
+	MaskWordlistSHA256 string `json:"mask_wordlist_sha256,omitempty"`
+
+	// Region is the path to the region file, relative to the world directory
+	// (begin and undo entries only).
+	Region string `json:"region,omitempty"`
+	// Size is the size of the region file at the start of the transaction (begin
+	// entries only).
+	Size int64 `json:"size,omitempty"`
+	// Offset and Data are the location and original contents of the range of the
+	// region file which is about to be overwritten (undo entries only).
+	Offset int64  `json:"offset,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+
+	// Line is the number of rows of the strings file which have been applied
+	// to the world once the transaction is committed (commit entries only).
+	// Rows are counted in the order they are applied, which is sorted by region
+	// and chunk (see rowSorter).
+	Line int `json:"line,omitempty"`
+}
+
+// journal records the original contents of the region files modified by the
+// patch command, so that the changes may be rolled back if the command fails
+// or is interrupted. Each chunk is saved in its own transaction, so that an
+// interrupted run may be rolled back to the last chunk that was completely
+// saved and then finished.
+type journal struct {
+	world   string
+	path    string
+	f       *os.File
+	entries []*journalEntry
+
+	// region and size are the region file modified by the current transaction,
+	// and its size at the start of the transaction.
+	region string
+	size   int64
+}
+
+// createJournal creates the journal for a new run of the patch command on the
+// specified world. Start is the first entry in the journal. It is an error if
+// there is already a journal, as this indicates an earlier run was interrupted.
+func createJournal(world string, start *journalEntry) (*journal, error) {
+	path := filepath.Join(world, journalName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("found journal %q from an interrupted run; use the recover command to finish or undo it", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot create journal: %v", err)
+	}
+	j := &journal{world: world, path: path, f: f}
+	if err := j.append(start); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return j, nil
+}
+
+// loadJournal reads the journal left behind by an interrupted run of the patch
+// command on the specified world. It returns nil if there is no journal.
+func loadJournal(world string) (*journal, error) {
+	path := filepath.Join(world, journalName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot open journal: %v", err)
+	}
+	defer f.Close()
+	j := &journal{world: world, path: path}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A partially-written entry at the end of the journal was being written
+			// when the run was interrupted, so the write it describes never began.
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read journal: %v", err)
+		}
+		e := &journalEntry{}
+		if err := json.Unmarshal(bytes.TrimSpace(line), e); err != nil {
+			return nil, fmt.Errorf("invalid entry in journal: %v", err)
+		}
+		j.entries = append(j.entries, e)
+	}
+	if len(j.entries) == 0 || j.entries[0].Op != "start" {
+		return nil, fmt.Errorf("invalid journal %q: missing start entry", path)
+	}
+	return j, nil
+}
+
+// hashInputs returns the hex-encoded SHA-256 hashes of the comma-separated
+// list of files, separated by commas.
+func hashInputs(paths string) (string, error) {
+	if paths == "" {
+		return "", nil
+	}
+	var hashes []string
+	for _, path := range strings.Split(paths, ",") {
+		_, hash, err := hashFile(path)
+		if err != nil {
+			return "", fmt.Errorf("cannot hash %q: %v", path, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return strings.Join(hashes, ","), nil
+}
+
+// checkInputs determines if the -strings and -mask_wordlist files recorded in
+// the start entry of the journal are unchanged since the run began, so that the
+// rows which were already applied can be skipped when finishing the run.
+func (j *journal) checkInputs() error {
+	start := j.start()
+	for _, input := range []struct{ flag, paths, hash string }{
+		{"-strings", start.Strings, start.StringsSHA256},
+		{"-mask_wordlist", start.MaskWordlist, start.MaskWordlistSHA256},
+	} {
+		hash, err := hashInputs(input.paths)
+		if err != nil {
+			return err
+		}
+		if hash != input.hash {
+			return fmt.Errorf("the %s file %q has changed since the interrupted run; restore it or use -mode undo", input.flag, input.paths)
+		}
+	}
+	return nil
+}
+
+// start returns the first entry in the journal, which records the options used
+// for the run.
+func (j *journal) start() *journalEntry {
+	return j.entries[0]
+}
+
+// append adds an entry to the journal, and waits for it to reach the disk.
+func (j *journal) append(e *journalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("cannot encode journal entry: %v", err)
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("cannot write to journal: %v", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("cannot sync journal: %v", err)
+	}
+	j.entries = append(j.entries, e)
+	return nil
+}
+
+// begin starts a transaction which modifies the region file f. It returns a
+// regionFile which records the original contents of f in the journal before
+// any data is written to it.
+func (j *journal) begin(f *os.File) (regionFile, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat region file: %v", err)
+	}
+	region, err := filepath.Rel(j.world, f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("cannot find region file %q in world: %v", f.Name(), err)
+	}
+	j.region, j.size = region, fi.Size()
+	if err := j.append(&journalEntry{Op: "begin", Region: j.region, Size: j.size}); err != nil {
+		return nil, err
+	}
+	return &journaledFile{f, j}, nil
+}
+
+// commit ends the current transaction, once the changes to the region file f
+// have reached the disk. Line is the number of rows of the strings file which
+// have been applied to the world by this and earlier transactions.
+func (j *journal) commit(f *os.File, line int) error {
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("cannot sync region file: %v", err)
+	}
+	return j.append(&journalEntry{Op: "commit", Line: line})
+}
+
+// applied returns the number of rows of the strings file which were applied to
+// the world by committed transactions.
+func (j *journal) applied() int {
+	line := 0
+	for _, e := range j.entries {
+		if e.Op == "commit" {
+			line = e.Line
+		}
+	}
+	return line
+}
+
+// done removes the journal once the run has completed successfully.
+func (j *journal) done() error {
+	if j.f != nil {
+		j.f.Close()
+	}
+	if err := os.Remove(j.path); err != nil {
+		return fmt.Errorf("cannot remove journal: %v", err)
+	}
+	return nil
+}
+
+// undo rolls back all of the changes recorded in the journal, and then removes
+// the journal.
+func (j *journal) undo() error {
+	if err := j.rollback(0); err != nil {
+		return err
+	}
+	return j.done()
+}
+
+// resume rolls back the transaction which was in progress when the run was
+// interrupted (if any), so that the journal may be used to finish the run.
+func (j *journal) resume() error {
+	last := 0
+	for i, e := range j.entries {
+		if e.Op == "commit" {
+			last = i
+		}
+	}
+	if err := j.rollback(last + 1); err != nil {
+		return err
+	}
+	// Rewrite the journal without the entries for the incomplete transaction.
+	// The entries are written to a new file which then replaces the journal, so
+	// that the journal is never left incomplete if this is interrupted.
+	entries := j.entries[:last+1]
+	err := replaceFile(j.path, func(f *os.File) error {
+		w := bufio.NewWriter(f)
+		for _, e := range entries {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return fmt.Errorf("cannot encode journal entry: %v", err)
+			}
+			w.Write(append(data, '\n'))
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("cannot rewrite journal: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("cannot open journal: %v", err)
+	}
+	j.f, j.entries = f, entries
+	return nil
+}
+
+// rollback restores the original contents of the region files modified since
+// the journal entry with the specified index.
+func (j *journal) rollback(from int) error {
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	open := func(region string) (*os.File, error) {
+		if f, ok := files[region]; ok {
+			return f, nil
+		}
+		f, err := os.OpenFile(filepath.Join(j.world, region), os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open region file for rollback: %v", err)
+		}
+		files[region] = f
+		return f, nil
+	}
+	// Undo the writes in reverse order, and find the original size of each
+	// region file.
+	sizes := make(map[string]int64)
+	for i := len(j.entries) - 1; i >= from && i > 0; i-- {
+		e := j.entries[i]
+		switch e.Op {
+		case "begin":
+			sizes[e.Region] = e.Size
+		case "undo":
+			f, err := open(e.Region)
+			if err != nil {
+				return err
+			}
+			if _, err := f.WriteAt(e.Data, e.Offset); err != nil {
+				return fmt.Errorf("cannot restore %q: %v", e.Region, err)
+			}
+		}
+	}
+	// Remove any data appended to the region files.
+	for region, size := range sizes {
+		f, err := open(region)
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(size); err != nil {
+			return fmt.Errorf("cannot restore size of %q: %v", region, err)
+		}
+	}
+	for region, f := range files {
+		log.Debugf("Rolled back changes to %q.", region)
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("cannot sync %q: %v", region, err)
+		}
+	}
+	return nil
+}
+
+// journaledFile is a region file whose original contents are recorded in the
+// journal before they are overwritten.
+type journaledFile struct {
+	*os.File
+	j *journal
+}
+
+// WriteAt implements io.WriterAt.
+func (f *journaledFile) WriteAt(b []byte, off int64) (int, error) {
+	// Data written past the original end of the file does not need to be
+	// recorded, since rolling back will truncate the file to its original size.
+	if off < f.j.size {
+		n := int64(len(b))
+		if off+n > f.j.size {
+			n = f.j.size - off
+		}
+		orig := make([]byte, n)
+		if _, err := f.File.ReadAt(orig, off); err != nil {
+			return 0, fmt.Errorf("cannot read original data: %v", err)
+		}
+		if err := f.j.append(&journalEntry{Op: "undo", Region: f.j.region, Offset: off, Data: orig}); err != nil {
+			return 0, err
+		}
+	}
+	return f.File.WriteAt(b, off)
+}
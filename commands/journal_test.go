@@ -0,0 +1,216 @@
+package commands
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// journalTest is a world containing a single region file, used to test the
+// journal.
+type journalTest struct {
+	t      *testing.T
+	world  string
+	region string
+}
+
+func newJournalTest(t *testing.T, data []byte) *journalTest {
+	world := t.TempDir()
+	jt := &journalTest{t: t, world: world, region: filepath.Join(world, "r.0.0.mca")}
+	if err := ioutil.WriteFile(jt.region, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return jt
+}
+
+// open opens the region file for writing.
+func (jt *journalTest) open() *os.File {
+	f, err := os.OpenFile(jt.region, os.O_RDWR, 0)
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+	jt.t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// write writes data to the region file in a transaction, which is committed if
+// line is positive.
+func (jt *journalTest) write(j *journal, off int64, data string, line int) {
+	f := jt.open()
+	rf, err := j.begin(f)
+	if err != nil {
+		jt.t.Fatalf("begin failed: %v", err)
+	}
+	if _, err := rf.WriteAt([]byte(data), off); err != nil {
+		jt.t.Fatalf("WriteAt failed: %v", err)
+	}
+	if line > 0 {
+		if err := j.commit(f, line); err != nil {
+			jt.t.Fatalf("commit failed: %v", err)
+		}
+	}
+}
+
+// check checks the contents of the region file.
+func (jt *journalTest) check(want string) {
+	got, err := ioutil.ReadFile(jt.region)
+	if err != nil {
+		jt.t.Fatal(err)
+	}
+	if string(got) != want {
+		jt.t.Errorf("region file = %q, want %q", got, want)
+	}
+}
+
+func TestJournalUndo(t *testing.T) {
+	jt := newJournalTest(t, []byte("0123456789"))
+	j, err := createJournal(jt.world, &journalEntry{Op: "start", Strings: "strings.csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createJournal(jt.world, &journalEntry{Op: "start"}); err == nil {
+		t.Errorf("createJournal succeeded with an existing journal, want an error")
+	}
+	jt.write(j, 2, "ab", 1)
+	jt.write(j, 8, "cdef", 2) // Extends the file.
+	jt.check("01ab4567cdef")
+	if got := j.applied(); got != 2 {
+		t.Errorf("applied = %d, want 2", got)
+	}
+
+	loaded, err := loadJournal(jt.world)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, e := range loaded.entries {
+		ops = append(ops, e.Op)
+	}
+	if got, want := strings.Join(ops, ","), "start,begin,undo,commit,begin,undo,commit"; got != want {
+		t.Errorf("journal entries = %s, want %s", got, want)
+	}
+	if loaded.start().Strings != "strings.csv" {
+		t.Errorf("start entry = %+v, want strings.csv", loaded.start())
+	}
+	if err := loaded.undo(); err != nil {
+		t.Fatalf("undo failed: %v", err)
+	}
+	jt.check("0123456789")
+	if _, err := os.Stat(filepath.Join(jt.world, journalName)); !os.IsNotExist(err) {
+		t.Errorf("journal still exists after undo (%v)", err)
+	}
+	if j, err := loadJournal(jt.world); j != nil || err != nil {
+		t.Errorf("loadJournal = %v, %v; want nil, nil", j, err)
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	jt := newJournalTest(t, []byte("0123456789"))
+	j, err := createJournal(jt.world, &journalEntry{Op: "start"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jt.write(j, 0, "ab", 3)
+	jt.write(j, 6, "cdefgh", 0) // Torn: never committed.
+	jt.check("ab2345cdefgh")
+
+	// Simulate an entry which was only partially written.
+	f, err := os.OpenFile(filepath.Join(jt.world, journalName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"undo","region":"r.0.0.mca","off`)
+	f.Close()
+
+	loaded, err := loadJournal(jt.world)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.resume(); err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	jt.check("ab23456789")
+	if got := loaded.applied(); got != 3 {
+		t.Errorf("applied = %d, want 3", got)
+	}
+
+	// The journal is rewritten without the torn transaction, and may be used to
+	// finish the run.
+	jt.write(loaded, 4, "xy", 5)
+	jt.check("ab23xy6789")
+	reloaded, err := loadJournal(jt.world)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(reloaded.entries), 7; got != want {
+		t.Errorf("journal has %d entries after resuming, want %d", got, want)
+	}
+	if err := reloaded.undo(); err != nil {
+		t.Fatalf("undo failed: %v", err)
+	}
+	jt.check("0123456789")
+}
+
+func TestJournalRollback(t *testing.T) {
+	jt := newJournalTest(t, bytes.Repeat([]byte("."), 8))
+	j, err := createJournal(jt.world, &journalEntry{Op: "start"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := jt.open()
+	rf, err := j.begin(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overlapping writes must be undone in reverse order.
+	rf.WriteAt([]byte("aaaa"), 0)
+	rf.WriteAt([]byte("bbbb"), 2)
+	rf.WriteAt([]byte("cccc"), 6)
+	jt.check("aabbbbcccc")
+	if err := j.rollback(0); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	jt.check("........")
+}
+
+func TestJournalCheckInputs(t *testing.T) {
+	dir := t.TempDir()
+	stringsFile := filepath.Join(dir, "strings.csv")
+	wordlist := filepath.Join(dir, "words.txt")
+	if err := ioutil.WriteFile(stringsFile, []byte("path,value\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(wordlist, []byte("darn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &Patch{world: dir, strings: stringsFile, maskWordlists: wordlist}
+	if err := p.createJournal(); err != nil {
+		t.Fatal(err)
+	}
+	j, err := loadJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.checkInputs(); err != nil {
+		t.Errorf("checkInputs failed for unchanged files: %v", err)
+	}
+	for _, path := range []string{wordlist, stringsFile} {
+		orig, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("changed\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.checkInputs(); err == nil {
+			t.Errorf("checkInputs succeeded after %q changed, want an error", path)
+		}
+		if err := ioutil.WriteFile(path, orig, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.journal.done()
+}
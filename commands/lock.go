@@ -0,0 +1,72 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bwkimmel/mcstrings/log"
+)
+
+// sessionLockName is the name of the file, relative to the world directory,
+// which Minecraft locks while the world is open. See
+// https://minecraft.wiki/w/Java_Edition_level_format.
+const sessionLockName = "session.lock"
+
+// errLockUnsupported indicates that files cannot be locked on this platform
+// (see tryLock).
+var errLockUnsupported = errors.New("file locking is not supported on this platform")
+
+// worldLock is a lock on a world, held while it is being modified.
+type worldLock struct {
+	f *os.File
+}
+
+// lockWorld locks the world located in the directory path, in the same way
+// as Minecraft and Minecraft servers do while the world is open: by locking
+// its session.lock file. This prevents the world from being opened while it is
+// being modified, which would otherwise cause our changes to be overwritten or
+// corrupted.
+//
+// If the world is already locked, and so is open in Minecraft or a server, an
+// error is returned, unless force is set, in which case a warning is logged and
+// the world is modified anyway. The lock is released by unlock, or when the
+// process exits.
+func lockWorld(path string, force bool) (*worldLock, error) {
+	// Check that path is a world before creating session.lock, so that a stray
+	// session.lock is not left in the wrong directory.
+	if _, err := os.Stat(filepath.Join(path, "level.dat")); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%q is not a Minecraft world: cannot find level.dat", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot find level.dat: %v", err)
+	}
+	lockPath := filepath.Join(path, sessionLockName)
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q: %v", lockPath, err)
+	}
+	ok, err := tryLock(f)
+	switch {
+	case err == errLockUnsupported:
+		log.Warnf("Cannot check whether the world is in use: %v. Make sure it is not open in Minecraft or a server.", err)
+	case err != nil:
+		f.Close()
+		return nil, fmt.Errorf("cannot lock %q: %v", lockPath, err)
+	case ok:
+		log.Debugf("Locked %q.", lockPath)
+	case force:
+		log.Warnf("The world is in use by Minecraft or a server (%q is locked). Modifying it anyway, as -force was specified.", lockPath)
+	default:
+		f.Close()
+		return nil, fmt.Errorf("the world is in use by Minecraft or a server (%q is locked); close the world or stop the server first, or use -force to modify it anyway", lockPath)
+	}
+	return &worldLock{f}, nil
+}
+
+// unlock releases the lock on the world, if l is not nil.
+func (l *worldLock) unlock() {
+	if l != nil {
+		l.f.Close()
+	}
+}
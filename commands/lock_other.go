@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package commands
+
+import "os"
+
+// tryLock is not supported on this platform, so whether the world is in use
+// cannot be checked (see lockWorld).
+func tryLock(f *os.File) (bool, error) {
+	return false, errLockUnsupported
+}
@@ -0,0 +1,25 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package commands
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// tryLock attempts to take an exclusive lock on the whole of f, without
+// waiting, and reports whether it succeeded. Java (and so Minecraft) uses fcntl
+// locks on these platforms, so this is the lock it takes on session.lock.
+func tryLock(f *os.File) (bool, error) {
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	switch err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk); err {
+	case nil:
+		return true, nil
+	case syscall.EAGAIN, syscall.EACCES:
+		return false, nil
+	default:
+		return false, err
+	}
+}
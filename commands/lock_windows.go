@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package commands
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// tryLock attempts to take an exclusive lock on the whole of f, without
+// waiting, and reports whether it succeeded. Java (and so Minecraft) uses
+// LockFileEx on Windows, so this is the lock it takes on session.lock. Unlike
+// the locks on other platforms, the lock is mandatory: while it is held, other
+// processes cannot read or write the file.
+func tryLock(f *os.File) (bool, error) {
+	const flags = windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY
+	switch err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, ^uint32(0), ^uint32(0), &windows.Overlapped{}); err {
+	case nil:
+		return true, nil
+	case windows.ERROR_LOCK_VIOLATION:
+		return false, nil
+	default:
+		return false, err
+	}
+}
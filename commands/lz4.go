@@ -0,0 +1,381 @@
+package commands
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Chunks with compression type 4 are compressed using the block stream format
+// of lz4-java's LZ4BlockOutputStream, which Minecraft uses. The stream consists
+// of blocks, each of which has a header with the following fields (integers
+// are little-endian):
+//
+//	magic            - The string "LZ4Block".
+//	token            - The compression method (raw or LZ4) in the high four
+//	                   bits, and log2(block size)-10 in the low four bits.
+//	compressed size  - Int32.
+//	original size    - Int32.
+//	checksum         - Int32, the XXH32 hash of the original data (masked to
+//	                   28 bits).
+//
+// followed by the block data in the LZ4 block format. The stream ends with an
+// empty block. See https://github.com/lz4/lz4-java and
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md.
+const (
+	lz4Magic        = "LZ4Block"
+	lz4HeaderSize   = len(lz4Magic) + 1 + 4 + 4 + 4
+	lz4MethodRaw    = 0x10
+	lz4MethodLZ4    = 0x20
+	lz4LevelBase    = 10
+	lz4BlockSize    = 1 << 16 // Default block size used by lz4-java.
+	lz4Seed         = 0x9747b28c
+	lz4ChecksumMask = 0xfffffff
+
+	lz4MinMatch     = 4
+	lz4MFLimit      = 12 // Matches must start at least this far from the end.
+	lz4LastLiterals = 5  // The last bytes of a block are always literals.
+	lz4HashLog      = 16
+)
+
+// lz4Reader decompresses an lz4-java block stream.
+type lz4Reader struct {
+	r   io.Reader
+	buf []byte // Decompressed data not yet read.
+	eof bool   // Whether the empty block ending the stream has been read.
+}
+
+// newLZ4Reader returns a reader which decompresses the lz4-java block stream
+// read from r.
+func newLZ4Reader(r io.Reader) *lz4Reader {
+	return &lz4Reader{r: r}
+}
+
+// Read implements io.Reader.
+func (l *lz4Reader) Read(p []byte) (int, error) {
+	for len(l.buf) == 0 {
+		if l.eof {
+			return 0, io.EOF
+		}
+		if err := l.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
+
+// Close implements io.Closer.
+func (*lz4Reader) Close() error {
+	return nil
+}
+
+// readBlock reads and decompresses the next block of the stream.
+func (l *lz4Reader) readBlock() error {
+	header := make([]byte, lz4HeaderSize)
+	if _, err := io.ReadFull(l.r, header); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("cannot read LZ4 block header: %v", err)
+	}
+	if string(header[:len(lz4Magic)]) != lz4Magic {
+		return fmt.Errorf("invalid LZ4 block magic: %q", header[:len(lz4Magic)])
+	}
+	token := header[len(lz4Magic)]
+	method := token & 0xf0
+	blockSize := 1 << (lz4LevelBase + int(token&0x0f))
+	compressed := int32(binary.LittleEndian.Uint32(header[9:]))
+	original := int32(binary.LittleEndian.Uint32(header[13:]))
+	check := binary.LittleEndian.Uint32(header[17:])
+	switch {
+	case method != lz4MethodRaw && method != lz4MethodLZ4:
+		return fmt.Errorf("invalid LZ4 compression method: %#x", method)
+	case original < 0 || compressed < 0 || int(original) > blockSize,
+		(original == 0) != (compressed == 0),
+		method == lz4MethodRaw && original != compressed:
+		return fmt.Errorf("invalid LZ4 block sizes: %d compressed, %d original", compressed, original)
+	}
+	if original == 0 {
+		if check != 0 {
+			return fmt.Errorf("invalid checksum for empty LZ4 block: %#x", check)
+		}
+		l.eof = true
+		return nil
+	}
+	data := make([]byte, compressed)
+	if _, err := io.ReadFull(l.r, data); err != nil {
+		return fmt.Errorf("cannot read LZ4 block: %v", err)
+	}
+	if method == lz4MethodLZ4 {
+		out := make([]byte, original)
+		if err := lz4DecompressBlock(data, out); err != nil {
+			return err
+		}
+		data = out
+	}
+	if sum := xxhash32(data, lz4Seed) & lz4ChecksumMask; sum != check {
+		return fmt.Errorf("LZ4 block checksum mismatch: got %#x, want %#x", sum, check)
+	}
+	l.buf = data
+	return nil
+}
+
+// lz4Writer compresses data as an lz4-java block stream.
+type lz4Writer struct {
+	w   io.Writer
+	buf []byte // Data not yet compressed, up to lz4BlockSize bytes.
+}
+
+// newLZ4Writer returns a writer which compresses the data written to it as an
+// lz4-java block stream, written to w. The stream is only complete once the
+// writer has been closed.
+func newLZ4Writer(w io.Writer) *lz4Writer {
+	return &lz4Writer{w: w, buf: make([]byte, 0, lz4BlockSize)}
+}
+
+// Write implements io.Writer.
+func (l *lz4Writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(l.buf) == lz4BlockSize {
+			if err := l.writeBlock(); err != nil {
+				return n, err
+			}
+		}
+		c := copy(l.buf[len(l.buf):lz4BlockSize], p)
+		l.buf = l.buf[:len(l.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close writes any buffered data, and the empty block which ends the stream.
+// It does not close the underlying writer.
+func (l *lz4Writer) Close() error {
+	if len(l.buf) > 0 {
+		if err := l.writeBlock(); err != nil {
+			return err
+		}
+	}
+	return l.writeHeader(lz4MethodRaw, 0, 0, 0)
+}
+
+// writeBlock compresses and writes the buffered data as a block. The data is
+// stored uncompressed if compression does not make it smaller.
+func (l *lz4Writer) writeBlock() error {
+	check := xxhash32(l.buf, lz4Seed) & lz4ChecksumMask
+	method, data := byte(lz4MethodLZ4), lz4CompressBlock(l.buf)
+	if len(data) >= len(l.buf) {
+		method, data = lz4MethodRaw, l.buf
+	}
+	if err := l.writeHeader(method, len(data), len(l.buf), check); err != nil {
+		return err
+	}
+	if _, err := l.w.Write(data); err != nil {
+		return err
+	}
+	l.buf = l.buf[:0]
+	return nil
+}
+
+// writeHeader writes a block header.
+func (l *lz4Writer) writeHeader(method byte, compressed, original int, check uint32) error {
+	header := make([]byte, lz4HeaderSize)
+	copy(header, lz4Magic)
+	header[len(lz4Magic)] = method | byte(bits.Len(lz4BlockSize-1)-lz4LevelBase)
+	binary.LittleEndian.PutUint32(header[9:], uint32(compressed))
+	binary.LittleEndian.PutUint32(header[13:], uint32(original))
+	binary.LittleEndian.PutUint32(header[17:], check)
+	_, err := l.w.Write(header)
+	return err
+}
+
+// lz4CompressBlock compresses src in the LZ4 block format, using a single pass
+// which takes the first match found for each position.
+func lz4CompressBlock(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2)
+	anchor := 0 // Start of the literals not yet written.
+	if len(src) > lz4MFLimit {
+		// table maps the hash of 4 bytes to the position after them, so that 0
+		// means there is none.
+		table := make([]int, 1<<lz4HashLog)
+		limit := len(src) - lz4MFLimit
+		for i := 0; i < limit; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := (seq * 2654435761) >> (32 - lz4HashLog)
+			ref := table[h] - 1
+			table[h] = i + 1
+			if ref < 0 || i-ref > 0xffff || binary.LittleEndian.Uint32(src[ref:]) != seq {
+				i++
+				continue
+			}
+			for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+				i--
+				ref--
+			}
+			n := lz4MinMatch
+			for i+n < len(src)-lz4LastLiterals && src[i+n] == src[ref+n] {
+				n++
+			}
+			dst = lz4AppendSequence(dst, src[anchor:i], i-ref, n)
+			i += n
+			anchor = i
+		}
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends a sequence to an LZ4 block: the literals, followed
+// by a match of length n at the specified offset back from the end of them. If
+// n is 0, this is the last sequence of the block, which has no match.
+func lz4AppendSequence(dst, literals []byte, offset, n int) []byte {
+	token := byte(0)
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	if n > 0 {
+		if n-lz4MinMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(n - lz4MinMatch)
+		}
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if n > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		if n-lz4MinMatch >= 15 {
+			dst = lz4AppendLength(dst, n-lz4MinMatch-15)
+		}
+	}
+	return dst
+}
+
+// lz4AppendLength appends the remainder of a literal or match length which did
+// not fit in the token: a run of 255s followed by a byte less than 255.
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4DecompressBlock decompresses src, in the LZ4 block format, into dst, which
+// must be exactly the size of the decompressed data.
+func lz4DecompressBlock(src, dst []byte) error {
+	corrupt := fmt.Errorf("corrupt LZ4 block")
+	si, di := 0, 0
+	length := func(n int) (int, bool) {
+		for {
+			if si >= len(src) {
+				return 0, false
+			}
+			b := src[si]
+			si++
+			n += int(b)
+			if b != 255 {
+				return n, true
+			}
+		}
+	}
+	for {
+		if si >= len(src) {
+			return corrupt
+		}
+		token := src[si]
+		si++
+		n := int(token >> 4)
+		if n == 15 {
+			var ok bool
+			if n, ok = length(n); !ok {
+				return corrupt
+			}
+		}
+		if n > len(src)-si || n > len(dst)-di {
+			return corrupt
+		}
+		di += copy(dst[di:], src[si:si+n])
+		si += n
+		if si == len(src) {
+			break // The last sequence has no match.
+		}
+		if si+2 > len(src) {
+			return corrupt
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > di {
+			return corrupt
+		}
+		n = int(token & 0x0f)
+		if n == 15 {
+			var ok bool
+			if n, ok = length(n); !ok {
+				return corrupt
+			}
+		}
+		n += lz4MinMatch
+		if n > len(dst)-di {
+			return corrupt
+		}
+		// The match may overlap the bytes it produces, so copy one at a time.
+		for end := di + n; di < end; di++ {
+			dst[di] = dst[di-offset]
+		}
+	}
+	if di != len(dst) {
+		return corrupt
+	}
+	return nil
+}
+
+// xxhash32 returns the XXH32 hash of b with the specified seed. See
+// https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md.
+func xxhash32(b []byte, seed uint32) uint32 {
+	const (
+		prime1 uint32 = 2654435761
+		prime2 uint32 = 2246822519
+		prime3 uint32 = 3266489917
+		prime4 uint32 = 668265263
+		prime5 uint32 = 374761393
+	)
+	round := func(acc, v uint32) uint32 {
+		return bits.RotateLeft32(acc+v*prime2, 13) * prime1
+	}
+	n := len(b)
+	var h uint32
+	if n >= 16 {
+		v1, v2, v3, v4 := seed+prime1+prime2, seed+prime2, seed, seed-prime1
+		for ; len(b) >= 16; b = b[16:] {
+			v1 = round(v1, binary.LittleEndian.Uint32(b[0:]))
+			v2 = round(v2, binary.LittleEndian.Uint32(b[4:]))
+			v3 = round(v3, binary.LittleEndian.Uint32(b[8:]))
+			v4 = round(v4, binary.LittleEndian.Uint32(b[12:]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = seed + prime5
+	}
+	h += uint32(n)
+	for ; len(b) >= 4; b = b[4:] {
+		h = bits.RotateLeft32(h+binary.LittleEndian.Uint32(b)*prime3, 17) * prime4
+	}
+	for _, c := range b {
+		h = bits.RotateLeft32(h+uint32(c)*prime5, 11) * prime1
+	}
+	h ^= h >> 15
+	h *= prime2
+	h ^= h >> 13
+	h *= prime3
+	h ^= h >> 16
+	return h
+}
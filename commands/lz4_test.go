@@ -0,0 +1,227 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// lz4GoldenText is the data compressed in lz4GoldenFrame.
+const lz4GoldenText = "Hello, Minecraft! Hello, Minecraft! Hello, Minecraft! The quick brown fox jumps over the lazy dog. " +
+	"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa end.\n"
+
+// lz4GoldenFrame is lz4GoldenText as written by lz4-java's
+// LZ4BlockOutputStream with its default settings: a single LZ4 block (token
+// 0x26: LZ4, 64kB blocks), followed by the empty block ending the stream. The
+// compressed block is the output of the reference LZ4 compressor (lz4 v1.9.4),
+// which lz4-java wraps.
+const lz4GoldenFrame = "4c5a34426c6f636b2651000000d9000000a4d9f80dff0348656c6c6f2c204d69" +
+	"6e6563726166742120120011ff1f54686520717569636b2062726f776e20666f" +
+	"78206a756d7073206f76657220746865206c617a7920646f672e206101005c60" +
+	"20656e642e0a4c5a34426c6f636b16000000000000000000000000"
+
+func lz4Golden(t *testing.T) []byte {
+	frame, err := hex.DecodeString(lz4GoldenFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestXXHash32(t *testing.T) {
+	// The hashes with seed 0 are those computed by the reference xxHash
+	// implementation (e.g., the content checksums written by the lz4 command).
+	for _, tc := range []struct {
+		s    string
+		seed uint32
+		want uint32
+	}{
+		{"", 0, 0x02cc5d05},
+		{"a", 0, 0x550d7456},
+		{"abc", 0, 0x32d153ff},
+		{"abcd", 0, 0xa3643705},
+		{"0123456789abcdef", 0, 0xc2c45b69},
+		{"Nobody inspects the spammish repetition", 0, 0xe2293b2f},
+		{lz4GoldenText, 0, 0xe9d70c9c},
+		{"a", lz4Seed, 0x12b7e114},
+		{"abcd", lz4Seed, 0x9475e7f2},
+		{"0123456789abcdef", lz4Seed, 0x59ac4ea7},
+		{"Nobody inspects the spammish repetition", lz4Seed, 0x70b91719},
+		{lz4GoldenText, lz4Seed, 0xddf8d9a4},
+	} {
+		if got := xxhash32([]byte(tc.s), tc.seed); got != tc.want {
+			t.Errorf("xxhash32(%q, %#x) = %#x, want %#x", tc.s, tc.seed, got, tc.want)
+		}
+	}
+}
+
+func TestLZ4Golden(t *testing.T) {
+	got, err := ioutil.ReadAll(newLZ4Reader(bytes.NewReader(lz4Golden(t))))
+	if err != nil {
+		t.Fatalf("reading golden frame failed: %v", err)
+	}
+	if string(got) != lz4GoldenText {
+		t.Errorf("golden frame = %q, want %q", got, lz4GoldenText)
+	}
+
+	// The header and end of the stream written by lz4Writer must match those
+	// written by lz4-java, though the compressed data may differ.
+	var buf bytes.Buffer
+	w := newLZ4Writer(&buf)
+	w.Write([]byte(lz4GoldenText))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	frame := lz4Golden(t)
+	if got, want := buf.Bytes()[:9], frame[:9]; !bytes.Equal(got, want) {
+		t.Errorf("block header = %x, want %x", got, want)
+	}
+	if got, want := buf.Bytes()[13:21], frame[13:21]; !bytes.Equal(got, want) {
+		t.Errorf("block sizes and checksum = %x, want %x", got, want)
+	}
+	end := frame[len(frame)-lz4HeaderSize:]
+	if got := buf.Bytes()[buf.Len()-lz4HeaderSize:]; !bytes.Equal(got, end) {
+		t.Errorf("end of stream = %x, want %x", got, end)
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	// text returns n bytes of compressible data, with matches of various
+	// lengths and offsets.
+	text := func(n int) []byte {
+		words := strings.Fields("the quick brown fox jumps over lazy dog minecraft chunk region sign book")
+		var b []byte
+		for len(b) < n {
+			if r.Intn(20) == 0 {
+				b = append(b, bytes.Repeat([]byte{'z'}, r.Intn(600))...)
+			}
+			b = append(b, words[r.Intn(len(words))]...)
+			b = append(b, ' ')
+		}
+		return b[:n]
+	}
+	for _, tc := range []struct {
+		name         string
+		data         []byte
+		compressible bool
+	}{
+		{"empty", nil, false},
+		{"one byte", []byte("x"), false},
+		{"short", []byte("hello, hello"), false},
+		{"text", text(5000), true},
+		{"text, one block", text(lz4BlockSize), true},
+		{"text, one block and one byte", text(lz4BlockSize + 1), true},
+		{"text, several blocks", text(3*lz4BlockSize + 1234), true},
+		{"zeros, several blocks", make([]byte, 2*lz4BlockSize+7), true},
+		{"random, several blocks", random(2*lz4BlockSize + 99), false},
+		{"random then text", append(random(lz4BlockSize/2), text(lz4BlockSize)...), true},
+	} {
+		var buf bytes.Buffer
+		w := newLZ4Writer(&buf)
+		// Write in uneven pieces, so that writes span block boundaries.
+		for data := tc.data; len(data) > 0; {
+			n := 1 + r.Intn(9000)
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := w.Write(data[:n]); err != nil {
+				t.Fatalf("%s: Write failed: %v", tc.name, err)
+			}
+			data = data[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: Close failed: %v", tc.name, err)
+		}
+		blocks := (len(tc.data) + lz4BlockSize - 1) / lz4BlockSize
+		overhead := (blocks + 1) * lz4HeaderSize
+		if tc.compressible && buf.Len() >= len(tc.data) {
+			t.Errorf("%s: compressed %d bytes to %d bytes", tc.name, len(tc.data), buf.Len())
+		}
+		if !tc.compressible && buf.Len() != len(tc.data)+overhead {
+			t.Errorf("%s: stored %d bytes in %d bytes, want %d (uncompressed)", tc.name, len(tc.data), buf.Len(), len(tc.data)+overhead)
+		}
+		got, err := ioutil.ReadAll(newLZ4Reader(&buf))
+		if err != nil {
+			t.Errorf("%s: reading failed: %v", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.data) {
+			t.Errorf("%s: round trip returned %d bytes, which differ from the %d bytes written", tc.name, len(got), len(tc.data))
+		}
+	}
+}
+
+func TestLZ4DecompressBlockCorrupt(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  string // Hex.
+		n    int    // Size of the decompressed data.
+	}{
+		{"empty", "", 1},
+		{"missing literal length", "f0", 20},
+		{"truncated literal length", "f0ff", 300},
+		{"literals past end of block", "3061", 3},
+		{"literals past end of output", "2061626364", 1},
+		{"truncated offset", "106101", 10},
+		{"zero offset", "1061000000", 10},
+		{"offset before start of output", "1061020000", 10},
+		{"missing match length", "1f610100", 30},
+		{"match past end of output", "106101000000", 3},
+		{"output too short", "1061", 2},
+		{"output too long", "3061626364", 2},
+	} {
+		src, err := hex.DecodeString(tc.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := lz4DecompressBlock(src, make([]byte, tc.n)); err == nil {
+			t.Errorf("%s: lz4DecompressBlock(%s) succeeded, want an error", tc.name, tc.src)
+		}
+	}
+
+	// A match which overlaps the bytes it produces.
+	src, _ := hex.DecodeString("1f61010001" + "50" + "6262626262")
+	dst := make([]byte, 1+20+5)
+	if err := lz4DecompressBlock(src, dst); err != nil {
+		t.Fatalf("lz4DecompressBlock failed: %v", err)
+	}
+	if got, want := string(dst), strings.Repeat("a", 21)+"bbbbb"; got != want {
+		t.Errorf("lz4DecompressBlock = %q, want %q", got, want)
+	}
+}
+
+func TestLZ4ReaderErrors(t *testing.T) {
+	frame := lz4Golden(t)
+	for _, tc := range []struct {
+		name   string
+		modify func(b []byte) []byte
+		want   string
+	}{
+		{"bad magic", func(b []byte) []byte { b[0] = 'X'; return b }, "invalid LZ4 block magic"},
+		{"bad method", func(b []byte) []byte { b[8] = 0x36; return b }, "invalid LZ4 compression method"},
+		{"block too large", func(b []byte) []byte { b[8], b[13], b[14] = 0x20, 0xd0, 0x07; return b }, "invalid LZ4 block sizes"},
+		{"negative size", func(b []byte) []byte { b[12] = 0x80; return b }, "invalid LZ4 block sizes"},
+		{"raw sizes differ", func(b []byte) []byte { b[8] = 0x16; return b }, "invalid LZ4 block sizes"},
+		{"bad checksum", func(b []byte) []byte { b[17] ^= 1; return b }, "checksum mismatch"},
+		{"corrupt data", func(b []byte) []byte { b[lz4HeaderSize] = 0xf0; return b }, "corrupt LZ4 block"},
+		{"truncated header", func(b []byte) []byte { return b[:10] }, "cannot read LZ4 block header"},
+		{"truncated block", func(b []byte) []byte { return b[:lz4HeaderSize+10] }, "cannot read LZ4 block"},
+		{"missing end of stream", func(b []byte) []byte { return b[:len(b)-lz4HeaderSize] }, "unexpected EOF"},
+		{"checksum in end of stream", func(b []byte) []byte { b[len(b)-1] = 1; return b }, "invalid checksum for empty LZ4 block"},
+	} {
+		b := tc.modify(append([]byte(nil), frame...))
+		_, err := ioutil.ReadAll(newLZ4Reader(bytes.NewReader(b)))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
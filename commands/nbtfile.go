@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+)
+
+// readNBTFile reads a gzip-compressed NBT file, such as level.dat or a player
+// data file, and returns its NBT tree. See
+// https://minecraft.gamepedia.com/NBT_format.
+func readNBTFile(path string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %q: %v", path, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %v", path, err)
+	}
+	var m map[string]interface{}
+	if err := nbt.UnmarshalEncoding(data, &m, nbt.BigEndian); err != nil {
+		return nil, fmt.Errorf("cannot decode NBT data in %q: %v", path, err)
+	}
+	return m, nil
+}
+
+// writeNBTFile writes an NBT tree to a gzip-compressed NBT file. The data is
+// written to a temporary file which then replaces the original, so that the
+// original is left intact if an error occurs.
+func writeNBTFile(path string, tree map[string]interface{}) error {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := nbt.NewEncoderWithEncoding(w, nbt.BigEndian).Encode(tree); err != nil {
+		return fmt.Errorf("cannot encode NBT data for %q: %v", path, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot compress NBT data for %q: %v", path, err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file for %q: %v", path, err)
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed.
+	if fi, err := os.Stat(path); err == nil {
+		if err := tmp.Chmod(fi.Mode()); err != nil {
+			tmp.Close()
+			return fmt.Errorf("cannot set permissions of %q: %v", tmp.Name(), err)
+		}
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write %q: %v", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot sync %q: %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot close %q: %v", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("cannot replace %q: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,538 @@
+package commands
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// pathElem is a single element of an NBT path (see parsePath).
+type pathElem struct {
+	// key is the name of a tag within a TAG_Compound. It is only used if list
+	// is false.
+	key string
+
+	// list indicates that the element selects an element of a TAG_List, either
+	// by index or, if anchor is not empty, by the values of identifying tags
+	// within the element.
+	list   bool
+	index  int
+	anchor []anchorTag
+}
+
+// anchorTag is a tag which identifies an element of a TAG_List of compounds
+// (e.g., the Slot of an item). Value is the value of the tag formatted as SNBT
+// (see snbt).
+type anchorTag struct {
+	key, value string
+}
+
+// anchorKeys lists the sets of tags which may be used to identify an element of
+// a TAG_List, in order of preference: the slot of an item, the position of a
+// block entity, and the UUID of an entity (since 1.16, and before).
+var anchorKeys = [][]string{
+	{"Slot"},
+	{"x", "y", "z"},
+	{"UUID"},
+	{"UUIDMost", "UUIDLeast"},
+}
+
+// parsePath parses an NBT path. A path consists of the names of tags within
+// nested compounds separated by slashes (e.g., "Level/Sections"), where each
+// name may be followed by one or more list elements in square brackets. A list
+// element is either an index (e.g., "Items[3]") or, as in the NBT paths used by
+// Minecraft's /data command, a compound listing the values of tags which
+// identify the element (e.g., "Items[{Slot:3b}]",
+// "block_entities[{x:1,y:64,z:-3}]" or "Entities[{UUID:[I;1,2,3,4]}]").
+//
+// As in Minecraft's NBT paths, a name may be enclosed in double (or single)
+// quotes, within which a backslash escapes the next character. This allows any
+// name to be used, including the empty string and names containing slashes or
+// square brackets (see formatKey).
+func parsePath(s string) ([]pathElem, error) {
+	p := &pathParser{s: s}
+	var elems []pathElem
+	for {
+		var key string
+		if c := p.peek(); c == '"' || c == '\'' {
+			var err error
+			if key, err = p.unquote(); err != nil {
+				return nil, err
+			}
+		} else {
+			key = p.token(func(c byte) bool { return c != '/' && c != '[' })
+			if key == "" {
+				return nil, p.errorf("missing tag name")
+			}
+		}
+		elems = append(elems, pathElem{key: key})
+		for p.peek() == '[' {
+			e, err := p.listElem()
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, e)
+		}
+		if p.pos == len(s) {
+			return elems, nil
+		}
+		if err := p.expect('/'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// formatKey formats the name of a tag within an NBT path, quoting it if
+// necessary (see parsePath).
+func formatKey(k string) string {
+	if k == "" || strings.ContainsAny(k, "/[]") || k[0] == '"' || k[0] == '\'' {
+		return quoteSNBT(k)
+	}
+	return k
+}
+
+// formatAnchorKey formats the name of a tag within an anchor, quoting it if
+// necessary.
+func formatAnchorKey(k string) string {
+	for i := 0; i < len(k); i++ {
+		if !isUnquotedRune(k[i]) {
+			return quoteSNBT(k)
+		}
+	}
+	if k == "" {
+		return quoteSNBT(k)
+	}
+	return k
+}
+
+// formatPath formats a parsed NBT path (see parsePath).
+func formatPath(elems []pathElem) string {
+	var b strings.Builder
+	for i, e := range elems {
+		if !e.list {
+			if i > 0 {
+				b.WriteByte('/')
+			}
+			b.WriteString(formatKey(e.key))
+			continue
+		}
+		b.WriteByte('[')
+		if len(e.anchor) == 0 {
+			b.WriteString(strconv.Itoa(e.index))
+		} else {
+			b.WriteByte('{')
+			for j, t := range e.anchor {
+				if j > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(formatAnchorKey(t.key))
+				b.WriteByte(':')
+				b.WriteString(t.value)
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(']')
+	}
+	return b.String()
+}
+
+// pathParser holds the state of parsePath.
+type pathParser struct {
+	s   string
+	pos int
+}
+
+func (p *pathParser) errorf(msg string, args ...interface{}) error {
+	return fmt.Errorf("invalid NBT path at offset %d: %s", p.pos, fmt.Sprintf(msg, args...))
+}
+
+// peek returns the next byte of the path, or 0 at the end of the path.
+func (p *pathParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// expect consumes the byte c.
+func (p *pathParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+// token consumes and returns a run of bytes allowed by ok.
+func (p *pathParser) token(ok func(c byte) bool) string {
+	start := p.pos
+	for p.pos < len(p.s) && ok(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// listElem parses a list element in square brackets.
+func (p *pathParser) listElem() (pathElem, error) {
+	e := pathElem{list: true}
+	if err := p.expect('['); err != nil {
+		return e, err
+	}
+	if p.peek() == '{' {
+		anchor, err := p.anchor()
+		if err != nil {
+			return e, err
+		}
+		e.anchor = anchor
+	} else {
+		index, err := strconv.Atoi(p.token(isDigit))
+		if err != nil {
+			return e, p.errorf("invalid index")
+		}
+		e.index = index
+	}
+	return e, p.expect(']')
+}
+
+// anchor parses the compound identifying a list element, e.g. "{Slot:3b}".
+func (p *pathParser) anchor() ([]anchorTag, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	var tags []anchorTag
+	for {
+		var key string
+		if c := p.peek(); c == '"' || c == '\'' {
+			var err error
+			if key, err = p.unquote(); err != nil {
+				return nil, err
+			}
+		} else if key = p.token(isUnquotedRune); key == "" {
+			return nil, p.errorf("missing tag name")
+		}
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, anchorTag{key, value})
+		if p.peek() == '}' {
+			p.pos++
+			return tags, nil
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// value parses an SNBT value within an anchor, and returns it in the canonical
+// form produced by snbt. Integers, integer arrays and strings are supported.
+func (p *pathParser) value() (string, error) {
+	switch p.peek() {
+	case '"', '\'':
+		return p.quoted()
+	case '[':
+		p.pos++
+		var kind byte
+		switch p.peek() {
+		case 'B', 'I', 'L':
+			kind = p.s[p.pos]
+			p.pos++
+		default:
+			return "", p.errorf("unsupported list value; expected [B;...], [I;...] or [L;...]")
+		}
+		if err := p.expect(';'); err != nil {
+			return "", err
+		}
+		suffix := map[byte]byte{'B': 'b', 'I': 0, 'L': 'l'}[kind]
+		var elems []string
+		for p.peek() != ']' {
+			if len(elems) > 0 {
+				if err := p.expect(','); err != nil {
+					return "", err
+				}
+			}
+			n, s, err := p.number()
+			if err != nil {
+				return "", err
+			}
+			if s != 0 && s != suffix {
+				return "", p.errorf("invalid element in [%c;...]", kind)
+			}
+			elems = append(elems, formatInt(n, suffix))
+		}
+		p.pos++
+		return fmt.Sprintf("[%c;%s]", kind, strings.Join(elems, ",")), nil
+	default:
+		n, suffix, err := p.number()
+		if err != nil {
+			return "", err
+		}
+		return formatInt(n, suffix), nil
+	}
+}
+
+// number parses an integer with an optional type suffix (b, s or l), and
+// returns the integer and the suffix in lower case (or 0 if there is none).
+func (p *pathParser) number() (int64, byte, error) {
+	tok := p.token(func(c byte) bool { return c == '-' || c == '+' || isDigit(c) })
+	bits := 32
+	var suffix byte
+	switch c := p.peek() | 0x20; c { // Lower case.
+	case 'b', 's', 'l':
+		suffix = c
+		bits = map[byte]int{'b': 8, 's': 16, 'l': 64}[c]
+		p.pos++
+	}
+	n, err := strconv.ParseInt(tok, 10, bits)
+	if err != nil {
+		return 0, 0, p.errorf("invalid integer %q", tok)
+	}
+	return n, suffix, nil
+}
+
+// quoted parses a quoted string (see unquote), and returns it in the canonical
+// form produced by snbt.
+func (p *pathParser) quoted() (string, error) {
+	s, err := p.unquote()
+	if err != nil {
+		return "", err
+	}
+	return quoteSNBT(s), nil
+}
+
+// unquote parses a string enclosed in double or single quotes, in which a
+// backslash escapes the next character, and returns its contents.
+func (p *pathParser) unquote() (string, error) {
+	q := p.peek()
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.s) {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case q:
+			return b.String(), nil
+		case '\\':
+			if p.pos >= len(p.s) {
+				return "", p.errorf("unterminated string")
+			}
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isUnquotedRune determines if c may appear in an unquoted SNBT tag name.
+func isUnquotedRune(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '-' || c == '.' || c == '+'
+}
+
+// formatInt formats an integer as SNBT with the specified type suffix.
+func formatInt(n int64, suffix byte) string {
+	s := strconv.FormatInt(n, 10)
+	switch suffix {
+	case 'b', 's':
+		return s + string(suffix)
+	case 'l':
+		return s + "L"
+	}
+	return s
+}
+
+// quoteSNBT formats a string as SNBT.
+func quoteSNBT(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// snbt formats an integer, integer array or string tag as SNBT, in the
+// canonical form used in anchors. Ok is false for other types of tags.
+func snbt(x interface{}) (s string, ok bool) {
+	switch v := x.(type) {
+	case byte:
+		return formatInt(int64(int8(v)), 'b'), true
+	case int16:
+		return formatInt(int64(v), 's'), true
+	case int32:
+		return formatInt(int64(v), 0), true
+	case int64:
+		return formatInt(v, 'l'), true
+	case string:
+		return quoteSNBT(v), true
+	}
+	// Arrays are decoded as Go arrays of various lengths (e.g., [4]int32).
+	rv := reflect.ValueOf(x)
+	if rv.Kind() != reflect.Array {
+		return "", false
+	}
+	var kind, suffix byte
+	switch rv.Type().Elem().Kind() {
+	case reflect.Uint8:
+		kind, suffix = 'B', 'b'
+	case reflect.Int32:
+		kind = 'I'
+	case reflect.Int64:
+		kind, suffix = 'L', 'l'
+	default:
+		return "", false
+	}
+	elems := make([]string, rv.Len())
+	for i := range elems {
+		var n int64
+		if kind == 'B' {
+			n = int64(int8(rv.Index(i).Uint()))
+		} else {
+			n = rv.Index(i).Int()
+		}
+		elems[i] = formatInt(n, suffix)
+	}
+	return fmt.Sprintf("[%c;%s]", kind, strings.Join(elems, ",")), true
+}
+
+// matchesAnchor determines if an element of a TAG_List is identified by the
+// specified anchor.
+func matchesAnchor(x interface{}, anchor []anchorTag) bool {
+	m, ok := x.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, t := range anchor {
+		if s, ok := snbt(m[t.key]); !ok || s != t.value {
+			return false
+		}
+	}
+	return true
+}
+
+// findAnchor returns an anchor which uniquely identifies the ith element of a
+// TAG_List (see anchorKeys), or nil if there is none.
+func findAnchor(list []interface{}, i int) []anchorTag {
+	m, ok := list[i].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for _, keys := range anchorKeys {
+		var anchor []anchorTag
+		for _, k := range keys {
+			s, ok := snbt(m[k])
+			if !ok {
+				anchor = nil
+				break
+			}
+			anchor = append(anchor, anchorTag{k, s})
+		}
+		if anchor == nil {
+			continue
+		}
+		n := 0
+		for _, x := range list {
+			if matchesAnchor(x, anchor) {
+				n++
+			}
+		}
+		if n == 1 {
+			return anchor
+		}
+	}
+	return nil
+}
+
+// anchorPath rewrites an NBT path within tree, replacing list indices with
+// anchors where the list element can be uniquely identified (see findAnchor),
+// so that the path remains valid when other elements are added to or removed
+// from the list.
+func anchorPath(tree interface{}, path string) (string, error) {
+	elems, err := parsePath(path)
+	if err != nil {
+		return "", err
+	}
+	for i := range elems {
+		e := &elems[i]
+		if e.list && len(e.anchor) == 0 {
+			if list, ok := tree.([]interface{}); ok && e.index >= 0 && e.index < len(list) {
+				e.anchor = findAnchor(list, e.index)
+			}
+		}
+		if tree, _, err = resolveElem(tree, elems, i); err != nil {
+			return "", err
+		}
+	}
+	return formatPath(elems), nil
+}
+
+// resolvePath finds the tag at an NBT path within tree. It returns the tag, and
+// a function which replaces the tag with a new value.
+func resolvePath(tree interface{}, elems []pathElem) (node interface{}, set func(interface{}), err error) {
+	node, set = tree, func(interface{}) {}
+	for i := range elems {
+		if node, set, err = resolveElem(node, elems, i); err != nil {
+			return nil, nil, err
+		}
+	}
+	return node, set, nil
+}
+
+// resolveElem finds the tag selected by the ith element of an NBT path within
+// node. See resolvePath.
+func resolveElem(node interface{}, elems []pathElem, i int) (interface{}, func(interface{}), error) {
+	e := elems[i]
+	if !e.list {
+		compound, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is not a TAG_Compound", formatPath(elems[:i]))
+		}
+		child, ok := compound[e.key]
+		if !ok {
+			return nil, nil, fmt.Errorf("cannot find %s", formatPath(elems[:i+1]))
+		}
+		return child, func(v interface{}) { compound[e.key] = v }, nil
+	}
+	list, ok := node.([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not a TAG_List", formatPath(elems[:i]))
+	}
+	index, err := listIndex(list, elems, i)
+	if err != nil {
+		return nil, nil, err
+	}
+	return list[index], func(v interface{}) { list[index] = v }, nil
+}
+
+// listIndex returns the index of the element of list selected by the ith
+// element of an NBT path, which must be a list element.
+func listIndex(list []interface{}, elems []pathElem, i int) (int, error) {
+	e := elems[i]
+	if len(e.anchor) == 0 {
+		if e.index < 0 || e.index >= len(list) {
+			return 0, fmt.Errorf("index %d out of bounds; %s has length %d", e.index, formatPath(elems[:i]), len(list))
+		}
+		return e.index, nil
+	}
+	index := -1
+	for j, x := range list {
+		if !matchesAnchor(x, e.anchor) {
+			continue
+		}
+		if index >= 0 {
+			return 0, fmt.Errorf("%s matches more than one element", formatPath(elems[:i+1]))
+		}
+		index = j
+	}
+	if index < 0 {
+		return 0, fmt.Errorf("cannot find %s", formatPath(elems[:i+1]))
+	}
+	return index, nil
+}
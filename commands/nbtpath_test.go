@@ -0,0 +1,141 @@
+package commands
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// pathTestKeys are the names used for tags in the trees built by
+// randomPathTree, including names which must be quoted in NBT paths.
+var pathTestKeys = []string{
+	"", "a", "Items", "tag", "display", "Name", "minecraft:custom_name",
+	"/", "a/b", "[", "]", "x[0]", `"`, `"quoted"`, `a"b`, "'", `\`, `\"`,
+	" ", "with space", "{Slot:1b}", "é",
+}
+
+// pathTree builds random NBT trees for TestPathRoundTrip.
+type pathTree struct {
+	r *rand.Rand
+	n int // The number of strings so far, used to make each string unique.
+}
+
+// maxPathTreeDepth limits the depth of the trees built by pathTree.
+const maxPathTreeDepth = 5
+
+// value returns a random tag. Strings are more likely at greater depths, so
+// that the trees are not too large.
+func (t *pathTree) value(depth int) interface{} {
+	k := t.r.Intn(2*depth + 4)
+	if depth >= maxPathTreeDepth {
+		k = 4
+	}
+	switch {
+	case k == 0:
+		return t.compound(depth + 1)
+	case k == 1:
+		return t.anchoredList(depth + 1)
+	case k == 2:
+		var list []interface{}
+		for i := t.r.Intn(3); i >= 0; i-- {
+			list = append(list, t.value(depth+1))
+		}
+		return list
+	case k == 3:
+		return int32(t.r.Intn(100))
+	default:
+		t.n++
+		return fmt.Sprintf("value %d", t.n)
+	}
+}
+
+// compound returns a random TAG_Compound.
+func (t *pathTree) compound(depth int) map[string]interface{} {
+	m := make(map[string]interface{})
+	for i := t.r.Intn(4); i >= 0; i-- {
+		m[pathTestKeys[t.r.Intn(len(pathTestKeys))]] = t.value(depth)
+	}
+	return m
+}
+
+// anchoredList returns a TAG_List of compounds, which have tags that may be
+// used to identify them (see anchorKeys). The tags are chosen from a small
+// range of values, so that some elements cannot be identified by them.
+func (t *pathTree) anchoredList(depth int) []interface{} {
+	var list []interface{}
+	for i := t.r.Intn(4); i >= 0; i-- {
+		m := t.compound(depth)
+		switch t.r.Intn(5) {
+		case 0:
+			m["Slot"] = byte(t.r.Intn(3))
+		case 1:
+			m["x"] = int32(t.r.Intn(3) - 1)
+			m["y"] = int32(t.r.Intn(2) - 64)
+			m["z"] = int32(t.r.Intn(2))
+		case 2:
+			m["UUID"] = [4]int32{int32(t.r.Intn(2)), -1, 2, int32(t.r.Intn(2) - 1)}
+		case 3:
+			m["UUIDMost"] = int64(t.r.Intn(2)) - 1<<40
+			m["UUIDLeast"] = int64(t.r.Intn(2))
+		}
+		list = append(list, m)
+	}
+	return list
+}
+
+// randomPathTree returns a random chunk-like tree. The same seed always gives
+// the same tree.
+func randomPathTree(seed int64) map[string]interface{} {
+	t := &pathTree{r: rand.New(rand.NewSource(seed))}
+	return t.compound(0)
+}
+
+// TestPathRoundTrip checks that every path produced by extract, with or without
+// anchors, can be parsed and leads back to the same string, and that the string
+// can be patched using the path.
+func TestPathRoundTrip(t *testing.T) {
+	for seed := int64(0); seed < 200; seed++ {
+		tree := randomPathTree(seed)
+		type str struct{ path, value string }
+		var strs []str
+		findStrings(tree, func(path, value string) {
+			strs = append(strs, str{path, value})
+		})
+		for _, s := range strs {
+			anchored, err := anchorPath(tree, s.path)
+			if err != nil {
+				t.Errorf("seed %d: anchorPath(%q) failed: %v", seed, s.path, err)
+				continue
+			}
+			for _, path := range []string{s.path, anchored} {
+				elems, err := parsePath(path)
+				if err != nil {
+					t.Errorf("seed %d: parsePath(%q) failed: %v", seed, path, err)
+					continue
+				}
+				if got := formatPath(elems); got != path {
+					t.Errorf("seed %d: formatPath(parsePath(%q)) = %q", seed, path, got)
+				}
+				node, _, err := resolvePath(tree, elems)
+				if err != nil {
+					t.Errorf("seed %d: resolvePath(%q) failed: %v", seed, path, err)
+					continue
+				}
+				if node != s.value {
+					t.Errorf("seed %d: resolvePath(%q) = %#v, want %q", seed, path, node, s.value)
+				}
+
+				// Patch a fresh copy of the tree, so that the anchors are unchanged.
+				p := &regionPatch{Patch: &Patch{}, chunk: &chunk{nbt: randomPathTree(seed)}}
+				old, changed, err := p.patchTag("set", path, "string", "patched", func(old string) bool { return old == s.value })
+				if err != nil || !changed || old != s.value {
+					t.Errorf("seed %d: patchTag(%q) = %q, %v, %v; want %q, true, nil", seed, path, old, changed, err, s.value)
+					continue
+				}
+				if node, _, err := resolvePath(p.chunk.nbt, elems); err != nil || node != "patched" {
+					t.Errorf("seed %d: %q is %#v (%v) after patching, want %q", seed, path, node, err, "patched")
+				}
+			}
+		}
+	}
+}
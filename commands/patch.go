@@ -1,29 +1,31 @@
 package commands
 
 import (
-	"bytes"
 	"compress/gzip"
 	"compress/zlib"
 	"context"
 	"encoding/binary"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/bwkimmel/mcstrings/log"
 	"github.com/google/subcommands"
-	"github.com/sandertv/gophertunnel/minecraft/nbt"
 )
 
 var (
-	dirRE = regexp.MustCompile(`^([^/\[]+)(?:\[(\d+)\])?$`)
-	zeros = make([]byte, 4096)
+	// errConflict indicates that the string in the world does not match the
+	// original value recorded in the strings file.
+	errConflict = errors.New("current value does not match the original value")
+
+	// defaultColumns are the columns of a strings file without a header row.
+	defaultColumns = []string{"dimension", "chunk_x", "chunk_z", "nbt_path", "value"}
 )
 
 // Patch implements the patch command.
@@ -31,18 +33,128 @@ type Patch struct {
 	strings     string
 	world       string
 	csv         *csv.Reader
-	chunk       *chunk
 	skipConfirm bool
+	force       bool
+
+	// columns maps the name of each column in the strings file to its index.
+	columns map[string]int
+	// resumeAfter is the number of rows of the strings file which were applied
+	// by an interrupted run and should be skipped (see Recover). Rows are
+	// counted in the order they are applied, which is sorted by region and
+	// chunk (see rowSorter).
+	resumeAfter int
+
+	// conflicts is the number of rows skipped because the string in the world
+	// has changed since it was extracted.
+	conflicts int
+
+	// dryRun indicates that changes should be checked and reported, but not
+	// written to the world.
+	dryRun bool
+	report *csv.Writer
+	counts map[string]int // Number of rows of each status in the report.
+
+	// maskWordlists is a comma-separated list of wordlist files. If set, terms
+	// from these wordlists are masked with asterisks in the patched strings.
+	maskWordlists string
+	mask          *wordlist
+
+	// journal records the original contents of the modified region files, so
+	// that the changes can be rolled back if patching fails. It is nil for a dry
+	// run.
+	journal *journal
+
+	// backupDir is the directory to save a copy of each region file to before
+	// it is modified (see the restore command).
+	backupDir string
+	backup    *backup
 
 	// shouldCompact indicates whether any chunks required resizing or relocating.
 	// If so, notify the user that they should compact the world.
 	shouldCompact bool
+
+	// jobs is the number of region files to patch concurrently.
+	jobs int
+
+	// keepTimestamps indicates that the chunk timestamp table should not be
+	// updated when chunks are written (see writeChunk).
+	keepTimestamps bool
+}
+
+// regionPatch applies the rows of the strings file for a single region file.
+// Region files are patched concurrently (see Patch.jobs), so the Patch must not
+// be modified: the changes are only written to the world afterwards, one region
+// file at a time and in order, by Patch.saveRegion.
+type regionPatch struct {
+	*Patch
+	dim, rx, rz int
+	path        string
+	f           *os.File // Opened for reading only.
+	openErr     error    // Error opening f, reported for each row.
+
+	// readRows reads the rows for the region from the sorted strings file, and
+	// sends them to rows one chunk at a time (see Patch.nextRegion). Rows is
+	// closed once all of the rows for the region have been read, or if reading
+	// fails, in which case readErr is set.
+	readRows func()
+	rows     chan []*patchRow
+	readErr  error
+
+	// first is the number of the first row in rows, counting all the rows in
+	// the order they are applied (see Patch.resumeAfter), and applied is the
+	// number of rows which have been applied to the region or to the loaded
+	// chunk.
+	first   int
+	applied int
+
+	chunk  *chunk
+	chunks []*chunk // The changed chunks, in the order they were loaded.
+
+	// results records the outcome of each row, for the dry run report.
+	results   []*patchResult
+	conflicts int
 }
 
 type chunk struct {
-	dim, x, z int
-	nbt       map[string]interface{}
-	updates   int
+	dim, x, z   int
+	nbt         map[string]interface{}
+	compression int8
+	updates     int
+
+	// data is the encoded chunk (see encodeChunk), once all of its rows have
+	// been applied, and applied is the number of rows which will have been
+	// applied to the world once it is saved (see journal.commit).
+	data    []byte
+	applied int
+
+	// results records the outcome of each row applied to this chunk, for the
+	// dry run report.
+	results []*patchResult
+}
+
+// patchResult records the outcome of applying a single row of the strings file,
+// for the dry run report.
+type patchResult struct {
+	line               int
+	dim, x, z          string
+	path               string
+	oldValue, newValue string
+	changed            bool
+	err                error
+}
+
+// status describes the outcome of applying a row of the strings file.
+func (r *patchResult) status() string {
+	switch {
+	case r.err == errConflict:
+		return "conflict"
+	case r.err != nil:
+		return "failed"
+	case !r.changed:
+		return "unchanged"
+	default:
+		return "changed"
+	}
 }
 
 func (*Patch) Name() string {
@@ -54,7 +166,7 @@ func (*Patch) Synopsis() string {
 }
 
 func (*Patch) Usage() string {
-	return `patch -strings <csv_file> <world>
+	return fmt.Sprintf(`patch -strings <csv_file> <world>
 Patch strings into a Minecraft world.
 
 WARNING: This command will modify your world in-place. You should make a backup
@@ -62,14 +174,80 @@ of your world before proceeding.
 
 Patch strings from a CSV file into a Minecraft world located in the directory
 <world>. This should be the directory containing level.dat. The CSV file should
-have the same columns as generated by the "extract" command.
+have the same columns as generated by the "extract" command. If the CSV file has
+a header row, the columns may appear in any order.
+
+By default, each row replaces an existing string. With a header row, the CSV
+file may also have op and type columns to make other changes:
+
+  op   - The operation to apply (set by default):
+           set    - Replace the value of an existing tag, which must have the
+                    type given by the type column.
+           delete - Delete the tag (e.g., "tag/display") or list element
+                    (e.g., "tag/pages[2]") at nbt_path. The value is ignored.
+           add    - Add a new tag at nbt_path, which must not already exist. If
+                    nbt_path ends with a list index, the new tag is inserted
+                    into the list at that index.
+  type - The type of the value (string by default). Numbers are written in
+         decimal, and the elements of arrays are separated by commas. One of:
+         %s.
+
+If the CSV file has an original_value or original_sha256 column (see the
+-original flag of the extract command), a string is only patched if its current
+value in the world still matches the original. Otherwise, the string has changed
+since it was extracted (e.g., because the world has been played in the meantime,
+shifting items within a list), so it is skipped and reported as a conflict.
+Lists and compounds have no value to compare, so they are deleted regardless.
+
+The rows need not be in any particular order. They are sorted by region file and
+chunk before they are applied, so that each region file is opened once and each
+chunk is read and written once. Rows for the same chunk are applied in the
+order they appear in the CSV file. Large CSV files are sorted using temporary
+files, so they need not fit in memory.
+
+If -jobs is greater than 1, that many region files are read and patched in
+memory at a time. The changes are still written to the world one region file at
+a time, in the same order, so the outcome is the same.
+
+If -dry_run is specified, the changes are applied in memory only, and a report is
+written to stdout in CSV format listing the outcome of each row of the CSV file
+(changed, unchanged, conflict, or failed), along with the old and new values.
+The rows are listed in the order they are applied, which is sorted by region
+file and chunk rather than the order of the CSV file, so the line column gives
+the line number of each row in the CSV file. Nothing is written to the world.
 
-`
+Otherwise, the original contents of each part of the world that is overwritten
+are first recorded in a journal (mcstrings.journal in the world directory). If
+an error occurs, the changes are rolled back and the world is left as it was.
+If patching is interrupted (e.g., by a crash or power loss), the journal is left
+behind, and the "recover" command must be used to undo or finish the run before
+the world is patched again.
+
+If -mask_wordlist is specified, any terms from the listed wordlist files that
+appear in the strings are replaced with asterisks before they are patched into
+the world (see the "wordlist" filter of the extract command).
+
+If -backup is specified, each region file is copied to the given directory
+before it is first modified, so that it can be put back using the restore
+command. Only the region files which are changed are copied.
+
+The timestamp of each chunk which is changed is updated in the region file's
+timestamp table, as Minecraft does when it saves a chunk, so that tools and
+backup systems which rely on the timestamps notice the change. If
+-keep_timestamps is specified, the original timestamps are kept instead.
+
+`, validTagTypes())
 }
 
 func (p *Patch) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.strings, "strings", "", "The CSV file to read strings from (required).")
 	f.BoolVar(&p.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&p.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+	f.BoolVar(&p.dryRun, "dry_run", false, "Report the changes that would be made, without modifying the world.")
+	f.StringVar(&p.backupDir, "backup", "", "Directory to save a copy of each region file to before it is modified (see the restore command).")
+	f.IntVar(&p.jobs, "jobs", 1, "Number of region files to patch concurrently.")
+	f.StringVar(&p.maskWordlists, "mask_wordlist", "", "Comma-separated list of wordlist files. Terms from these wordlists are replaced with asterisks in the patched strings.")
+	f.BoolVar(&p.keepTimestamps, "keep_timestamps", false, "Do not update the timestamps of the chunks which are changed.")
 }
 
 func (p *Patch) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -86,27 +264,140 @@ func (p *Patch) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) su
 		log.Error("--strings is required.")
 		return subcommands.ExitUsageError
 	}
-	file, err := os.Open(p.strings)
-	if err != nil {
+	if p.jobs < 1 {
+		log.Errorf("Invalid value for -jobs (%d), must be at least 1.", p.jobs)
+		return subcommands.ExitUsageError
+	}
+	if _, err := os.Stat(p.strings); err != nil {
 		log.Errorf("Cannot open strings file: %v", err)
 		return subcommands.ExitFailure
 	}
-	defer file.Close()
-	if !p.skipConfirm {
-		confirm()
+	if p.dryRun {
+		p.report = csv.NewWriter(os.Stdout)
+		p.report.Write([]string{"line", "status", "dimension", "chunk_x", "chunk_z", "nbt_path", "old_value", "new_value", "error"})
+		p.counts = make(map[string]int)
+	} else {
+		if !p.skipConfirm {
+			confirm()
+		}
+		lock, err := lockWorld(p.world, p.force)
+		if err != nil {
+			log.Errorf("Patch: %v", err)
+			return subcommands.ExitFailure
+		}
+		defer lock.unlock()
+		if p.backupDir != "" {
+			b, err := newBackup(p.backupDir, p.world, "patch")
+			if err != nil {
+				log.Errorf("Patch: %v", err)
+				return subcommands.ExitFailure
+			}
+			p.backup = b
+		}
+		if err := p.createJournal(); err != nil {
+			log.Errorf("Patch: %v", err)
+			return subcommands.ExitFailure
+		}
 	}
-	p.csv = csv.NewReader(file)
-	p.csv.FieldsPerRecord = -1 // Don't check the number of fields.
-	if err := p.run(); err != nil {
+	if err := p.apply(); err != nil {
 		log.Errorf("Patch: %v", err)
 		return subcommands.ExitFailure
 	}
+	if p.dryRun {
+		p.report.Flush()
+		if err := p.report.Error(); err != nil {
+			log.Errorf("Cannot write report: %v", err)
+			return subcommands.ExitFailure
+		}
+		log.Infof("Dry run: %d changed, %d unchanged, %d conflicts, %d failed.", p.counts["changed"], p.counts["unchanged"], p.counts["conflict"], p.counts["failed"])
+		if p.counts["failed"] > 0 {
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
 	if p.shouldCompact {
 		log.Info("Some chunks were resized or relocated. It is recommended to compact the world.")
 	}
 	return subcommands.ExitSuccess
 }
 
+// createJournal creates the journal used to roll back changes to the world if
+// patching fails or is interrupted. The journal records the options needed to
+// finish the run using the recover command.
+func (p *Patch) createJournal() error {
+	path, err := filepath.Abs(p.strings)
+	if err != nil {
+		return err
+	}
+	start := &journalEntry{Op: "start", Strings: path, KeepTimestamps: p.keepTimestamps}
+	if p.maskWordlists != "" {
+		var paths []string
+		for _, path := range strings.Split(p.maskWordlists, ",") {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, abs)
+		}
+		start.MaskWordlist = strings.Join(paths, ",")
+	}
+	if start.StringsSHA256, err = hashInputs(start.Strings); err != nil {
+		return err
+	}
+	if start.MaskWordlistSHA256, err = hashInputs(start.MaskWordlist); err != nil {
+		return err
+	}
+	if p.backupDir != "" {
+		if start.BackupDir, err = filepath.Abs(p.backupDir); err != nil {
+			return err
+		}
+	}
+	p.journal, err = createJournal(p.world, start)
+	return err
+}
+
+// apply patches the world. If there is a journal, the changes are rolled back
+// if an error occurs.
+func (p *Patch) apply() error {
+	if p.maskWordlists != "" {
+		w, err := loadWordlists(p.maskWordlists)
+		if err != nil {
+			return p.abort(fmt.Errorf("cannot load wordlists: %v", err))
+		}
+		p.mask = w
+	}
+	file, err := os.Open(p.strings)
+	if err != nil {
+		return p.abort(fmt.Errorf("cannot open strings file: %v", err))
+	}
+	defer file.Close()
+	p.csv = csv.NewReader(file)
+	p.csv.FieldsPerRecord = -1 // Don't check the number of fields.
+	if err := p.run(); err != nil {
+		return p.abort(err)
+	}
+	if p.conflicts > 0 {
+		log.Warnf("Skipped %d strings which have changed since they were extracted.", p.conflicts)
+	}
+	if p.journal != nil {
+		return p.journal.done()
+	}
+	return nil
+}
+
+// abort rolls back the changes made to the world (if there is a journal), and
+// returns the error which caused patching to fail.
+func (p *Patch) abort(err error) error {
+	if p.journal == nil {
+		return err
+	}
+	if rerr := p.journal.undo(); rerr != nil {
+		return fmt.Errorf("%v; additionally, rolling back the changes failed: %v (use the recover command to try again)", err, rerr)
+	}
+	log.Info("Rolled back all changes.")
+	return err
+}
+
 // field returns the nth string in an array, or "" if index is beyond the bounds
 // of the array.
 func field(rec []string, index int) string {
@@ -116,57 +407,140 @@ func field(rec []string, index int) string {
 	return rec[index]
 }
 
-// patchString replaces the string at the specified NBT path in the currently
-// loaded chunk with a new value.
-func (p *Patch) patchString(path, value string) error {
-	var node interface{} = p.chunk.nbt
-	set := func() {}
-	parts := strings.Split(path, "/")
-	for i, part := range parts {
-		component := dirRE.FindStringSubmatch(part)
-		if component == nil {
-			return fmt.Errorf("cannot parse nbt_path")
+// patchOps lists the operations which may appear in the op column of a strings
+// file.
+var patchOps = map[string]bool{"set": true, "delete": true, "add": true}
+
+// patchTag applies an operation to the tag at the specified NBT path in the
+// currently loaded chunk, and returns the old value of the tag (formatted as
+// for the value column) and whether the chunk was changed:
+//
+//	set    - Replaces the value of an existing tag, which must have the
+//	         specified type (see tagTypes).
+//	delete - Deletes a tag from a compound, or an element from a list.
+//	add    - Adds a new tag of the specified type to a compound, or inserts it
+//	         into a list at the specified index.
+//
+// If matches is not nil, a tag is only set or deleted if matches reports that
+// its old value is the expected original value; otherwise errConflict is
+// returned. Lists and compounds have no value to compare, so they are deleted
+// regardless of matches.
+func (p *regionPatch) patchTag(op, path, typ, value string, matches func(old string) bool) (oldValue string, changed bool, err error) {
+	elems, err := parsePath(path)
+	if err != nil {
+		return "", false, err
+	}
+	var tag interface{}
+	if op != "delete" {
+		if tag, err = parseTag(typ, value); err != nil {
+			return "", false, err
 		}
-		compound, ok := node.(map[string]interface{})
-		if !ok {
-			return fmt.Errorf("%s is not a TAG_Compound", strings.Join(parts[:i], "/"))
+		value, _ = formatTag(tag) // Compare values in canonical form.
+	}
+	last := len(elems) - 1
+	parent, setParent, err := resolvePath(p.chunk.nbt, elems[:last])
+	if err != nil {
+		return "", false, err
+	}
+	if op == "add" {
+		return p.addTag(parent, setParent, elems, tag)
+	}
+	node, set, err := resolveElem(parent, elems, last)
+	if err != nil {
+		return "", false, err
+	}
+	oldValue, ok := formatTag(node)
+	if !ok {
+		// Lists and compounds may be deleted, but have no value to compare.
+		if op != "delete" {
+			return "", false, fmt.Errorf("%s is a %s", path, tagName(node))
 		}
-		elem, ok := compound[component[1]]
-		if !ok {
-			return fmt.Errorf("cannot find %s", strings.Join(append(parts[:i], component[1]), "/"))
+		matches = nil
+	}
+	if op == "set" {
+		if tagName(node) != tagName(tag) {
+			return oldValue, false, fmt.Errorf("%s is a %s, not a %s", path, tagName(node), tagName(tag))
 		}
-		set = func() { compound[component[1]] = value }
-		node = elem
-		if len(component) < 3 || component[2] == "" { // No array index.
-			continue
+		// A tag which already has the new value (e.g., when finishing an
+		// interrupted run) is not a conflict.
+		if oldValue == value {
+			return oldValue, false, nil
 		}
-		index, err := strconv.Atoi(component[2])
+		if matches != nil && !matches(oldValue) {
+			return oldValue, false, errConflict
+		}
+		p.chunk.updates++
+		set(tag)
+		return oldValue, true, nil
+	}
+	if matches != nil && !matches(oldValue) {
+		return oldValue, false, errConflict
+	}
+	if elems[last].list {
+		list := parent.([]interface{})
+		index, err := listIndex(list, elems, last)
 		if err != nil {
-			return fmt.Errorf("invalid index in nbt_path: %v", err)
+			return oldValue, false, err
 		}
-		array, ok := node.([]interface{})
+		setParent(append(list[:index:index], list[index+1:]...))
+	} else {
+		delete(parent.(map[string]interface{}), elems[last].key)
+	}
+	p.chunk.updates++
+	return oldValue, true, nil
+}
+
+// addTag adds a new tag to parent, the compound or list containing the tag at
+// the path elems. See patchTag.
+func (p *regionPatch) addTag(parent interface{}, setParent func(interface{}), elems []pathElem, tag interface{}) (string, bool, error) {
+	e := elems[len(elems)-1]
+	path := formatPath(elems)
+	if !e.list {
+		compound, ok := parent.(map[string]interface{})
 		if !ok {
-			return fmt.Errorf("%s is not a TAG_List", strings.Join(append(parts[:i], component[1]), "/"))
+			return "", false, fmt.Errorf("%s is not a TAG_Compound", formatPath(elems[:len(elems)-1]))
 		}
-		if index < 0 || index >= len(array) {
-			return fmt.Errorf("index %d out of bounds; %s has length %d", index, strings.Join(append(parts[:i], component[1]), "/"), len(array))
+		if old, ok := compound[e.key]; ok {
+			// A tag which was already added (e.g., when finishing an interrupted
+			// run) is not an error.
+			oldValue, _ := formatTag(old)
+			newValue, _ := formatTag(tag)
+			if tagName(old) == tagName(tag) && oldValue == newValue {
+				return oldValue, false, nil
+			}
+			return "", false, fmt.Errorf("%s already exists", path)
 		}
-		set = func() { array[index] = value }
-		node = array[index]
+		compound[e.key] = tag
+		p.chunk.updates++
+		return "", true, nil
 	}
-	oldValue, ok := node.(string)
+	list, ok := parent.([]interface{})
 	if !ok {
-		return fmt.Errorf("%s is not a TAG_String", path)
+		return "", false, fmt.Errorf("%s is not a TAG_List", formatPath(elems[:len(elems)-1]))
 	}
-	if oldValue != value {
-		p.chunk.updates++
-		set()
+	if len(e.anchor) > 0 {
+		return "", false, fmt.Errorf("%s: cannot add a list element at an anchor; use an index", path)
 	}
-	return nil
+	if e.index < 0 || e.index > len(list) {
+		return "", false, fmt.Errorf("index %d out of bounds; %s has length %d", e.index, formatPath(elems[:len(elems)-1]), len(list))
+	}
+	if len(list) > 0 && tagName(list[0]) != tagName(tag) {
+		return "", false, fmt.Errorf("cannot add a %s to %s, which is a list of %s", tagName(tag), formatPath(elems[:len(elems)-1]), tagName(list[0]))
+	}
+	list = append(list, nil)
+	copy(list[e.index+1:], list[e.index:])
+	list[e.index] = tag
+	setParent(list)
+	p.chunk.updates++
+	return "", true, nil
 }
 
-// run patches the Minecraft world.
+// run patches the Minecraft world. The rows of the strings file are sorted by
+// region and chunk, so that each region file is opened once and each chunk is
+// read and written once, however the rows are ordered in the file.
 func (p *Patch) run() error {
+	sorter := newRowSorter()
+	defer sorter.close()
 	line := 0
 	for {
 		line++
@@ -177,42 +551,372 @@ func (p *Patch) run() error {
 		if err != nil {
 			return err
 		}
-		if line == 1 && field(rec, 0) == "dimension" {
-			continue // Skip header row if present.
+		if line == 1 {
+			if isHeader(rec) {
+				if err := p.readHeader(rec); err != nil {
+					return err
+				}
+				continue
+			}
+			p.columns = make(map[string]int)
+			for i, name := range defaultColumns {
+				p.columns[name] = i
+			}
 		}
-		ok := true
-		warn := func(msg string, args ...interface{}) {
-			args = append([]interface{}{line}, args...)
-			log.Warnf("Line %d: "+msg, args...)
-			ok = false
+		row := &patchRow{line: line, rec: rec}
+		var problems []string
+		for _, c := range []struct {
+			name string
+			n    *int
+		}{{"dimension", &row.dim}, {"chunk_x", &row.x}, {"chunk_z", &row.z}} {
+			if *c.n, err = strconv.Atoi(p.field(rec, c.name)); err != nil {
+				log.Warnf("Line %d: invalid %s: %v", line, c.name, err)
+				problems = append(problems, fmt.Sprintf("invalid %s: %v", c.name, err))
+			}
 		}
-		dim, err := strconv.Atoi(field(rec, 0))
-		if err != nil {
-			warn("invalid dimension: %v", err)
+		if len(problems) > 0 {
+			if p.dryRun {
+				p.writeResult(&patchResult{
+					line:     line,
+					dim:      p.field(rec, "dimension"),
+					x:        p.field(rec, "chunk_x"),
+					z:        p.field(rec, "chunk_z"),
+					path:     p.field(rec, "nbt_path"),
+					newValue: p.field(rec, "value"),
+					err:      errors.New(strings.Join(problems, "; ")),
+				})
+			}
+			continue
+		}
+		if err := sorter.add(row); err != nil {
+			return err
+		}
+	}
+	next, err := sorter.sorted()
+	if err != nil {
+		return err
+	}
+	return pipeline(p.jobs, p.nextRegion(next), p.patchRegion, p.saveRegion)
+}
+
+// regionRowBuffer is the number of chunks' rows which may be read ahead of the
+// chunk being patched in a region file (see Patch.nextRegion).
+const regionRowBuffer = 64
+
+// nextRegion returns a function which groups the sorted rows of the strings
+// file (see rowSorter) by region, returning a regionPatch for each region file
+// in turn, and then io.EOF. See pipeline.
+//
+// The rows are not collected in memory. Instead, once patchRegion starts work
+// on a region file, they are read by a goroutine and passed to patchRegion one
+// chunk at a time, so that only a bounded number of rows are held for each
+// region file being patched. Since the rows for each region follow those for
+// the region before, the next region is not returned until all of the rows for
+// the previous one have been read.
+func (p *Patch) nextRegion(next func() (*patchRow, error)) func() (interface{}, error) {
+	n := 0
+	var row *patchRow // The next row, if it has been read.
+	var readErr error
+	read := func() error {
+		for row == nil && readErr == nil {
+			if row, readErr = next(); readErr != nil {
+				row = nil
+				break
+			}
+			n++
+			if n <= p.resumeAfter {
+				row = nil // Already applied by an interrupted run (see Recover).
+			}
+		}
+		return readErr
+	}
+	var done chan struct{} // Closed once the rows for the last region are read.
+	return func() (interface{}, error) {
+		if done != nil {
+			<-done
+		}
+		if err := read(); err != nil {
+			return nil, err
+		}
+		rx, rz, _, _ := chunkPos(row.x, row.z)
+		r := &regionPatch{Patch: p, dim: row.dim, rx: rx, rz: rz, first: n, rows: make(chan []*patchRow, regionRowBuffer)}
+		d := make(chan struct{})
+		done = d
+		r.readRows = func() {
+			defer close(d)
+			defer close(r.rows)
+			for {
+				rows := []*patchRow{row}
+				row = nil
+				for {
+					if err := read(); err == io.EOF {
+						break
+					} else if err != nil {
+						r.readErr = err
+						return
+					}
+					if row.dim != rows[0].dim || row.x != rows[0].x || row.z != rows[0].z {
+						break
+					}
+					rows = append(rows, row)
+					row = nil
+				}
+				r.rows <- rows
+				if row == nil {
+					return
+				}
+				if rx, rz, _, _ := chunkPos(row.x, row.z); row.dim != r.dim || rx != r.rx || rz != r.rz {
+					return
+				}
+			}
+		}
+		return r, nil
+	}
+}
+
+// patchRegion applies the rows for a single region file (a *regionPatch) in
+// memory. See pipeline.
+func (p *Patch) patchRegion(job interface{}) (interface{}, error) {
+	r := job.(*regionPatch)
+	go r.readRows()
+	defer func() {
+		// Read any remaining rows if patching fails, so that the rows for the
+		// next region can be read.
+		for range r.rows {
+		}
+	}()
+	var err error
+	if r.path, err = p.regionPath(r.dim, r.rx, r.rz); err != nil {
+		r.openErr = err
+	} else if r.f, err = os.Open(r.path); err != nil {
+		r.openErr = fmt.Errorf("cannot open region file %q: %v", r.path, err)
+	} else {
+		log.Debugf("Opened region file %q.", r.path)
+		defer r.f.Close()
+	}
+	r.applied = r.first - 1
+	for rows := range r.rows {
+		for _, row := range rows {
+			// All rows before this one have been applied to the region, or to the
+			// loaded chunk.
+			if err := r.applyRow(row); err != nil {
+				return nil, err
+			}
+			r.applied++
+		}
+	}
+	if r.readErr != nil {
+		return nil, r.readErr
+	}
+	if err := r.saveChunk(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// saveRegion writes the changed chunks of a region file (a *regionPatch) to the
+// world, or writes the outcome of each row to the dry run report. See pipeline.
+func (p *Patch) saveRegion(result interface{}) (err error) {
+	r := result.(*regionPatch)
+	p.conflicts += r.conflicts
+	if p.dryRun {
+		for _, res := range r.results {
+			p.writeResult(res)
 		}
-		x, err := strconv.Atoi(field(rec, 1))
+		return nil
+	}
+	var f *os.File
+	var m *sectorMap
+	defer func() {
+		if f != nil {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}()
+	for _, c := range r.chunks {
+		log.Debugf("Saving dimension %d, chunk (%d, %d) to %q with %d updates.", c.dim, c.x, c.z, r.path, c.updates)
+		if f == nil {
+			if err := p.backup.save(r.path); err != nil {
+				return err
+			}
+			if f, err = os.OpenFile(r.path, os.O_RDWR, 0); err != nil {
+				return fmt.Errorf("cannot open region file %q for writing: %v", r.path, err)
+			}
+			locs, err := readLocations(f)
+			if err != nil {
+				return fmt.Errorf("region file %q: %v", r.path, err)
+			}
+			m = newSectorMap(locs)
+		}
+		_, _, dx, dz := chunkPos(c.x, c.z)
+		w, err := p.journal.begin(f)
 		if err != nil {
-			warn("invalid chunk_x: %v", err)
+			return err
 		}
-		z, err := strconv.Atoi(field(rec, 2))
+		resized, err := writeChunk(w, m, dx, dz, c.data, saveTime(p.keepTimestamps))
 		if err != nil {
-			warn("invalid chunk_z: %v", err)
+			return fmt.Errorf("saving chunk (%d, %d) to %q: %v", c.x, c.z, r.path, err)
 		}
-		path := field(rec, 3)
-		if path == "" {
-			warn("missing nbt_path")
+		if resized {
+			p.shouldCompact = true // Advise user to run compaction when we're done.
 		}
-		if !ok {
-			continue
+		if err := p.journal.commit(f, c.applied); err != nil {
+			return err
 		}
-		if err := p.loadChunk(dim, x, z); err != nil {
+	}
+	return nil
+}
+
+// applyRow applies a single row of the strings file to the loaded chunk.
+func (p *regionPatch) applyRow(row *patchRow) error {
+	line, dim, x, z, rec := row.line, row.dim, row.x, row.z, row.rec
+	ok := true
+	var problem error
+	warn := func(msg string, args ...interface{}) {
+		problem = fmt.Errorf(msg, args...)
+		args = append([]interface{}{line}, args...)
+		log.Warnf("Line %d: "+msg, args...)
+		ok = false
+	}
+	path := p.field(rec, "nbt_path")
+	if path == "" {
+		warn("missing nbt_path")
+	}
+	op := p.field(rec, "op")
+	if op == "" {
+		op = "set"
+	}
+	if !patchOps[op] {
+		warn("invalid op %q, must be one of set, delete, add", op)
+	}
+	typ := p.field(rec, "type")
+	if typ == "" {
+		typ = "string"
+	}
+	value := p.field(rec, "value")
+	if p.mask != nil && typ == "string" {
+		value = p.mask.mask(value)
+	}
+	if op == "delete" {
+		value = ""
+	}
+	var matches func(string) bool
+	if op != "add" {
+		matches = p.originalMatcher(rec)
+	}
+	result := &patchResult{
+		line:     line,
+		dim:      p.field(rec, "dimension"),
+		x:        p.field(rec, "chunk_x"),
+		z:        p.field(rec, "chunk_z"),
+		path:     path,
+		newValue: value,
+	}
+	if !ok {
+		if p.dryRun {
+			result.err = problem
+			p.results = append(p.results, result)
+		}
+		return nil
+	}
+	if err := p.loadChunk(dim, x, z); err != nil {
+		if !p.dryRun {
 			return err
 		}
-		if err := p.patchString(path, field(rec, 4)); err != nil {
-			return fmt.Errorf("line %d, dimension %d, chunk (%d, %d): %v", line, dim, x, z, err)
+		result.err = err
+		p.results = append(p.results, result)
+		return nil
+	}
+	var err error
+	result.oldValue, result.changed, err = p.patchTag(op, path, typ, value, matches)
+	if err == errConflict && !p.dryRun {
+		log.Warnf("Line %d: skipping %s in dimension %d, chunk (%d, %d): it has changed since it was extracted.", line, path, dim, x, z)
+		p.conflicts++
+		return nil
+	}
+	if err != nil && !p.dryRun {
+		return fmt.Errorf("line %d, dimension %d, chunk (%d, %d): %v", line, dim, x, z, err)
+	}
+	result.err = err
+	p.chunk.results = append(p.chunk.results, result)
+	p.results = append(p.results, result)
+	return nil
+}
+
+// isHeader determines whether a row of the strings file is a header row.
+func isHeader(rec []string) bool {
+	for _, name := range rec {
+		if name == "nbt_path" {
+			return true
+		}
+	}
+	return false
+}
+
+// readHeader reads the header row of the strings file, which determines the
+// order of the columns.
+func (p *Patch) readHeader(rec []string) error {
+	p.columns = make(map[string]int)
+	for i, name := range rec {
+		if _, ok := p.columns[name]; !ok {
+			p.columns[name] = i
+		}
+	}
+	for _, name := range defaultColumns {
+		if _, ok := p.columns[name]; !ok {
+			return fmt.Errorf("strings file is missing the %s column", name)
 		}
 	}
-	return p.saveChunk()
+	return nil
+}
+
+// field returns the value of the named column in a row of the strings file, or
+// "" if there is no such column.
+func (p *Patch) field(rec []string, name string) string {
+	i, ok := p.columns[name]
+	if !ok {
+		return ""
+	}
+	return field(rec, i)
+}
+
+// originalMatcher returns a function which determines whether the current value
+// of a string matches the original value recorded in a row of the strings file
+// (see the -original flag of the extract command), or nil if no original value
+// is recorded.
+func (p *Patch) originalMatcher(rec []string) func(string) bool {
+	if i, ok := p.columns["original_value"]; ok {
+		original := field(rec, i)
+		return func(v string) bool { return v == original }
+	}
+	if i, ok := p.columns["original_sha256"]; ok && field(rec, i) != "" {
+		original := strings.ToLower(field(rec, i))
+		return func(v string) bool { return hashString(v) == original }
+	}
+	return nil
+}
+
+// writeResult writes the outcome of applying a row of the strings file to the
+// dry run report.
+func (p *Patch) writeResult(r *patchResult) {
+	status := r.status()
+	p.counts[status]++
+	var msg string
+	if r.err != nil {
+		msg = r.err.Error()
+	}
+	p.report.Write([]string{
+		strconv.Itoa(r.line),
+		status,
+		r.dim,
+		r.x,
+		r.z,
+		r.path,
+		r.oldValue,
+		r.newValue,
+		msg,
+	})
 }
 
 // dimensionPath returns the directory containing the region files for the
@@ -258,8 +962,8 @@ func chunkPos(x, z int) (rx, rz, dx, dz int) {
 
 // loadChunk loads the specified chunk. If the specified chunk is already
 // loaded, no action is taken. If it is not, the currently-loaded chunk (if
-// there is one) is saved to disk and the new chunk is loaded.
-func (p *Patch) loadChunk(dim, x, z int) error {
+// there is one) is saved (see saveChunk) and the new chunk is loaded.
+func (p *regionPatch) loadChunk(dim, x, z int) error {
 	// If we already had a different chunk loaded, save it before loading the new
 	// chunk.
 	if p.chunk != nil && p.chunk.dim == dim && p.chunk.x == x && p.chunk.z == z {
@@ -268,36 +972,26 @@ func (p *Patch) loadChunk(dim, x, z int) error {
 	if err := p.saveChunk(); err != nil {
 		return err
 	}
-	rx, rz, dx, dz := chunkPos(x, z)
-	regPath, err := p.regionPath(dim, rx, rz)
-	if err != nil {
-		return err
-	}
-	log.Debugf("Loading dimension %d, chunk (%d, %d) from %q.", dim, x, z, regPath)
-	f, err := os.Open(regPath)
-	if err != nil {
-		return fmt.Errorf("cannot open region file %q for reading: %v", regPath, err)
+	p.chunk = nil
+	if p.openErr != nil {
+		return p.openErr
 	}
-	defer f.Close()
+	_, _, dx, dz := chunkPos(x, z)
+	log.Debugf("Loading dimension %d, chunk (%d, %d) from %q.", dim, x, z, p.path)
 	// Find where the chunk data is located within the file. See
 	// https://minecraft.gamepedia.com/wiki/Region_file_format#Chunk_location.
-	if _, err := f.Seek(int64(4*(dz*32+dx)), 0); err != nil {
-		return fmt.Errorf("cannot find location of chunk (%d, %d) in %q: %v", x, z, regPath, err)
-	}
 	var loc uint32
-	if err := binary.Read(f, binary.BigEndian, &loc); err != nil {
-		return fmt.Errorf("cannot read location of chunk (%d, %d) in %q: %v", x, z, regPath, err)
+	if err := binary.Read(io.NewSectionReader(p.f, int64(4*(dz*32+dx)), 4), binary.BigEndian, &loc); err != nil {
+		return fmt.Errorf("cannot read location of chunk (%d, %d) in %q: %v", x, z, p.path, err)
 	}
-	offset := int64(4096 * (loc & 0xffffff00) >> 8)
-	size := int64(4096 * (loc & 0xff))
-	if _, err := f.Seek(offset, 0); err != nil {
-		return fmt.Errorf("cannot seek to chunk (%d, %d) in %q: %v", x, z, regPath, err)
+	if loc == 0 {
+		return fmt.Errorf("chunk (%d, %d) does not exist in %q", x, z, p.path)
 	}
-	nbt, err := readChunk(&io.LimitedReader{f, size})
+	nbt, compression, err := readChunkAt(p.f, loc)
 	if err != nil {
-		return fmt.Errorf("cannot read chunk (%d, %d) in %q: %v", x, z, regPath, err)
+		return fmt.Errorf("cannot read chunk (%d, %d) in %q: %v", x, z, p.path, err)
 	}
-	p.chunk = &chunk{dim: dim, x: x, z: z, nbt: nbt}
+	p.chunk = &chunk{dim: dim, x: x, z: z, nbt: nbt, compression: compression}
 	return nil
 }
 
@@ -311,153 +1005,60 @@ func (*nopWriteCloser) Close() error {
 	return nil
 }
 
-// wrapWriter wraps a writer to apply the specified compression algorithm. See
+// wrapWriter wraps a writer to apply the specified compression algorithm, at
+// the specified level (for gzip and zlib; see compress/flate). See
 // https://minecraft.gamepedia.com/Region_file_format#Chunk_data for valid
 // compression algorithms.
-func wrapWriter(w io.Writer, compression int8) (io.WriteCloser, error) {
+func wrapWriter(w io.Writer, compression int8, level int) (io.WriteCloser, error) {
 	switch compression {
 	case 1:
-		return gzip.NewWriter(w), nil
+		return gzip.NewWriterLevel(w, level)
 	case 2:
-		return zlib.NewWriter(w), nil
+		return zlib.NewWriterLevel(w, level)
 	case 3:
 		return &nopWriteCloser{w}, nil
+	case 4:
+		return newLZ4Writer(w), nil
 	default:
 		return nil, fmt.Errorf("invalid compression type: %d", compression)
 	}
 }
 
-// saveChunk saves the currently-loaded chunk to disk if there is a chunk that
-// is loaded and if it is dirty.
-func (p *Patch) saveChunk() (err error) {
+// saveChunk encodes the currently-loaded chunk, if there is a chunk that is
+// loaded and if it is dirty, so that it can be written to the world by
+// Patch.saveRegion.
+func (p *regionPatch) saveChunk() error {
+	if p.chunk != nil && p.dryRun {
+		p.checkChunk()
+		return nil
+	}
 	// There is nothing to do if there is no loaded chunk or if the loaded chunk
 	// has no updates.
 	if p.chunk == nil || p.chunk.updates == 0 {
 		return nil
 	}
-	dim, x, z := p.chunk.dim, p.chunk.x, p.chunk.z
-	rx, rz, dx, dz := chunkPos(x, z)
-	regPath, err := p.regionPath(dim, rx, rz)
+	data, err := encodeChunk(p.chunk.nbt, p.chunk.compression, defaultLevel)
 	if err != nil {
-		return err
+		return fmt.Errorf("saving chunk (%d, %d) to %q: %v", p.chunk.x, p.chunk.z, p.path, err)
 	}
-	log.Debugf("Saving dimension %d, chunk (%d, %d) to %q with %d updates.", dim, x, z, regPath, p.chunk.updates)
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("saving chunk (%d, %d) to %q: %v", x, z, regPath, err)
-		}
-	}()
-	f, err := os.OpenFile(regPath, os.O_RDWR, 0)
-	if err != nil {
-		return fmt.Errorf("cannot open region file %q for writing: %v", err)
-	}
-	defer f.Close()
-	// Find the location in the region file of the currently-loaded chunk. See
-	// https://minecraft.gamepedia.com/wiki/Region_file_format#Chunk_location.
-	if _, err := f.Seek(int64(4*(dz*32+dx)), 0); err != nil {
-		return fmt.Errorf("cannot find chunk location: %v", err)
-	}
-	var loc uint32
-	if err := binary.Read(f, binary.BigEndian, &loc); err != nil {
-		return fmt.Errorf("cannot read chunk location: %v", err)
-	}
-	offset := int64(4096 * (loc & 0xffffff00) >> 8)
-	sectors := int32(loc & 0xff)
-	if _, err := f.Seek(offset, 0); err != nil {
-		return fmt.Errorf("cannot seek to chunk: %v", err)
-	}
-	// Read the chunk header, which includes a 4-byte length and a 1-byte
-	// compression type. See
-	// https://minecraft.gamepedia.com/wiki/Region_file_format#Chunk_data.
-	var (
-		length      int32
-		compression int8
-	)
-	if err := binary.Read(f, binary.BigEndian, &length); err != nil {
-		return fmt.Errorf("cannot read length of chunk: %v", err)
-	}
-	if err := binary.Read(f, binary.BigEndian, &compression); err != nil {
-		return fmt.Errorf("cannot read compression type: %v", err)
-	}
-	var buf bytes.Buffer
-	w, err := wrapWriter(&buf, compression)
-	if err != nil {
-		return err
-	}
-	enc := nbt.NewEncoderWithEncoding(w, nbt.BigEndian)
-	if err := enc.Encode(p.chunk.nbt); err != nil {
-		return fmt.Errorf("cannot encode NBT data: %v", err)
-	}
-	w.Close()
-	// The length field in the chunk data includes the 1-byte compression type.
-	// See https://minecraft.gamepedia.com/wiki/Region_file_format#Chunk_data.
-	length = int32(buf.Len() + 1)
-	// Sector count includes the 4-byte length, the 1-byte compression type, and
-	// the compressed data.
-	newSectors := (length + 4) / 4096
-	if (length+4)%4096 != 0 { // Round up to next whole sector.
-		newSectors++
-	}
-	// Check of the new sector count will fit in one byte.
-	if newSectors > 255 {
-		return fmt.Errorf("new chunk data is too large (%d sectors)", newSectors)
-	}
-	// If we require more 4kB sectors than the original chunk data occupied, don't
-	// assume we can expand into the next sector in the file. Instead, relocate
-	// the chunk to the end of the file (exception: don't relocate if the sector
-	// is already located at the end of the file).
-	if newSectors > sectors {
-		end, err := f.Seek(0, 2)
-		if err != nil {
-			return fmt.Errorf("could not seek to end of region file: %v", err)
-		}
-		if end%4096 != 0 {
-			return fmt.Errorf("region file is invalid: not a multiple of 4kB")
-		}
-		// If this is not already the last chunk in the file, relocate the chunk to
-		// the end of the file.
-		if offset+int64(sectors)*4096 < end {
-			log.Debugf("Relocating dimension %d, chunk (%d, %d) from %d to end of file at %d.", dim, x, z, offset, end)
-			offset = end
-		}
-	}
-	// If the sector count has changed, we need to go back to the chunk location
-	// table to write the new sector count (and possibly new offset if we've
-	// relocated the sector).
-	if newSectors != sectors {
-		log.Debugf("Resizing dimension %d, chunk (%d, %d) to from %d sectors to %d sectors.", dim, x, z, sectors, newSectors)
-		p.shouldCompact = true // Advise user to run compaction when we're done.
-		if _, err := f.Seek(int64(4*(dz*32+dx)), 0); err != nil {
-			return fmt.Errorf("cannot find chunk location: %v", err)
-		}
-		loc = uint32((offset/4096)<<8) | uint32(newSectors)
-		if err := binary.Write(f, binary.BigEndian, loc); err != nil {
-			return fmt.Errorf("cannot write new location for chunk (%d, %d) in %q: %v", x, z, regPath, err)
-		}
-	}
-	// Seek back to the chunk data.
-	if _, err := f.Seek(offset, 0); err != nil {
-		return fmt.Errorf("cannot seek to chunk: %v", err)
-	}
-	if err := binary.Write(f, binary.BigEndian, length); err != nil {
-		return fmt.Errorf("cannot write length: %v", err)
-	}
-	if _, err := f.Seek(1, 1); err != nil { // Skip over compression type.
-		return err
-	}
-	if _, err := io.Copy(f, &buf); err != nil {
-		return fmt.Errorf("could not write NBT data: %v", err)
-	}
-	// Pad with zeros to the end of this 4kB sector.
-	// See https://minecraft.gamepedia.com/wiki/Region_file_format#Chunk_data.
-	pos, err := f.Seek(0, 1) // Get current position.
-	if err != nil {
-		return err
-	}
-	if partial := pos % 4096; partial != 0 {
-		if _, err := io.CopyN(f, bytes.NewReader(zeros), 4096-partial); err != nil {
-			return fmt.Errorf("could not write padding: %v", err)
+	p.chunk.data, p.chunk.applied = data, p.applied
+	p.chunk.nbt = nil // No longer needed.
+	p.chunks = append(p.chunks, p.chunk)
+	return nil
+}
+
+// checkChunk checks that the currently-loaded chunk could be saved, without
+// saving it, and updates the outcome of the rows applied to it for the dry run
+// report.
+func (p *regionPatch) checkChunk() {
+	if p.chunk.updates > 0 {
+		if _, err := encodeChunk(p.chunk.nbt, p.chunk.compression, defaultLevel); err != nil {
+			for _, r := range p.chunk.results {
+				if r.status() == "changed" {
+					r.err = fmt.Errorf("cannot save chunk: %v", err)
+				}
+			}
 		}
 	}
-	return nil
+	p.chunk.results = nil
 }
@@ -0,0 +1,70 @@
+package commands
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testPatchTree returns a chunk containing a chest with a renamed item.
+func testPatchTree() map[string]interface{} {
+	return map[string]interface{}{
+		"block_entities": []interface{}{
+			map[string]interface{}{
+				"id": "minecraft:chest",
+				"Items": []interface{}{
+					map[string]interface{}{
+						"id": "minecraft:stick",
+						"tag": map[string]interface{}{
+							"display": map[string]interface{}{"Name": `{"text":"hello"}`},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestPatchTagDelete(t *testing.T) {
+	matchOriginal := func(original string) func(string) bool {
+		return func(v string) bool { return v == original }
+	}
+	for _, tc := range []struct {
+		name    string
+		path    string
+		matches func(string) bool
+		wantErr error
+		changed bool
+	}{
+		{"string", "block_entities[0]/Items[0]/tag/display/Name", nil, nil, true},
+		{"string matching original", "block_entities[0]/Items[0]/tag/display/Name", matchOriginal(`{"text":"hello"}`), nil, true},
+		{"string with conflict", "block_entities[0]/Items[0]/tag/display/Name", matchOriginal("other"), errConflict, false},
+		{"compound", "block_entities[0]/Items[0]/tag/display", nil, nil, true},
+		{"compound with original", "block_entities[0]/Items[0]/tag/display", matchOriginal(""), nil, true},
+		{"list element with original", "block_entities[0]/Items[0]", matchOriginal(""), nil, true},
+	} {
+		p := &regionPatch{Patch: &Patch{}, chunk: &chunk{nbt: testPatchTree()}}
+		_, changed, err := p.patchTag("delete", tc.path, "", "", tc.matches)
+		if err != tc.wantErr || changed != tc.changed {
+			t.Errorf("%s: patchTag(delete, %q) = %v, %v; want %v, %v", tc.name, tc.path, changed, err, tc.changed, tc.wantErr)
+			continue
+		}
+		elems, err := parsePath(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = resolvePath(p.chunk.nbt, elems)
+		if deleted := err != nil; deleted != tc.changed {
+			t.Errorf("%s: %q deleted = %v, want %v", tc.name, tc.path, deleted, tc.changed)
+		}
+	}
+}
+
+func TestPatchTagSetCompound(t *testing.T) {
+	p := &regionPatch{Patch: &Patch{}, chunk: &chunk{nbt: testPatchTree()}}
+	if _, _, err := p.patchTag("set", "block_entities[0]/Items[0]/tag", "string", "x", nil); err == nil {
+		t.Errorf("patchTag(set) of a compound succeeded, want an error")
+	}
+	if !reflect.DeepEqual(p.chunk.nbt, testPatchTree()) {
+		t.Errorf("patchTag(set) of a compound changed the chunk: %v", p.chunk.nbt)
+	}
+}
@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	emailRE   = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+	urlRE     = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.\-]*://|www\.)[^\s"'<>\\]+`)
+	phoneRE   = regexp.MustCompile(`(?:^|[^\w\-+])((?:\+\d{1,3}[\s.\-]?)?(?:\(\d{2,4}\)[\s.\-]?|\d{2,4}[\s.\-])\d{3,4}[\s.\-]\d{3,4})\b`)
+	ipv4RE    = regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`)
+	ipv6RE    = regexp.MustCompile(`(?i)[0-9a-f]*:[0-9a-f:]*:[0-9a-f:.]*`)
+	discordRE = regexp.MustCompile(`(?i)(?:\bdiscord(?:app)?\.(?:gg|com)/\S+|[^\s@#:"]{2,32}#\d{4}\b)`)
+
+	// coordsRE matches coordinates labelled with x, (y) and z (e.g.,
+	// "x: 100 z: -20"), or three numbers in brackets (e.g., "(100, 64, -20)" or
+	// "[100 64 -20]"). Unlabelled numbers outside brackets are not matched, as
+	// they are more likely to be prices, dates, and so on.
+	coordsRE = regexp.MustCompile(`(?i)(?:\bx\s*[:=]?\s*-?\d+[\s,;/]+(?:y\s*[:=]?\s*-?\d+[\s,;/]+)?z\s*[:=]?\s*-?\d+|[(\[]\s*-?\d{1,8}(?:\s*,\s*|\s+)-?\d{1,3}(?:\s*,\s*|\s+)-?\d{1,8}\s*[)\]])`)
+)
+
+// piiDetector detects personal information in strings.
+type piiDetector struct {
+	// names matches any of the real names supplied by the user.
+	names *regexp.Regexp
+}
+
+// piiKinds lists the kinds of personal information that are detected, in the
+// order in which they are reported.
+var piiKinds = []struct {
+	kind  string
+	match func(d *piiDetector, v string) bool
+}{
+	{"email", func(_ *piiDetector, v string) bool { return emailRE.MatchString(v) }},
+	{"url", func(_ *piiDetector, v string) bool { return urlRE.MatchString(v) }},
+	{"phone", func(_ *piiDetector, v string) bool { return phoneRE.MatchString(v) }},
+	{"ip", containsIP},
+	{"discord", func(_ *piiDetector, v string) bool { return discordRE.MatchString(v) }},
+	{"coordinates", func(_ *piiDetector, v string) bool { return coordsRE.MatchString(v) }},
+	{"name", func(d *piiDetector, v string) bool { return d.names != nil && d.names.MatchString(v) }},
+}
+
+// newPIIFilter constructs a filter that matches strings containing personal
+// information: email addresses, URLs, phone numbers, IP addresses, Discord
+// handles, coordinates, and the real names listed in the file specified by the
+// -pii_names flag. The note for each match lists the kinds of personal
+// information found.
+func newPIIFilter(ff *filterFlags) (filter, error) {
+	d := &piiDetector{}
+	if ff.piiNames != "" {
+		names, err := readList(ff.piiNames)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read names: %v", err)
+		}
+		if len(names) > 0 {
+			d.names = wordsRE(names)
+		}
+	}
+	return func(_ int32, _, v string) (string, bool) {
+		kinds := d.detect(v)
+		if len(kinds) == 0 {
+			return "", false
+		}
+		return strings.Join(kinds, ";"), true
+	}, nil
+}
+
+// wordsRE returns a regular expression matching any of the specified words,
+// ignoring case, where they are not part of a longer word. Unlike \b, which
+// only recognizes ASCII letters and digits, the boundaries recognize letters
+// and digits in any script, so that names such as "José" are matched. The
+// characters either side of the word are part of the match, so the word itself
+// is captured by the first group (see replaceWords). The words must not be
+// empty.
+func wordsRE(words []string) *regexp.Regexp {
+	var alts []string
+	for _, w := range words {
+		alts = append(alts, regexp.QuoteMeta(w))
+	}
+	// Match longer words first, in case one word is a prefix of another.
+	sort.Slice(alts, func(i, j int) bool { return len(alts[i]) > len(alts[j]) })
+	return regexp.MustCompile(`(?i)(?:^|[^\pL\pN_])(` + strings.Join(alts, "|") + `)(?:$|[^\pL\pN_])`)
+}
+
+// replaceWords replaces each word in s matched by re (see wordsRE) with the
+// result of calling fn with the word. The character following each word is
+// matched again as the start of the next one, so that words separated by a
+// single character are all replaced.
+func replaceWords(re *regexp.Regexp, s string, fn func(word string) string) string {
+	var b strings.Builder
+	copied := 0 // Bytes of s copied to b so far.
+	for pos := 0; pos < len(s); {
+		m := re.FindStringSubmatchIndex(s[pos:])
+		if m == nil {
+			break
+		}
+		start, end := pos+m[2], pos+m[3]
+		b.WriteString(s[copied:start])
+		b.WriteString(fn(s[start:end]))
+		copied, pos = end, end
+	}
+	if copied == 0 {
+		return s
+	}
+	b.WriteString(s[copied:])
+	return b.String()
+}
+
+// detect returns the kinds of personal information contained in a string.
+func (d *piiDetector) detect(v string) []string {
+	var kinds []string
+	for _, k := range piiKinds {
+		if k.match(d, v) {
+			kinds = append(kinds, k.kind)
+		}
+	}
+	return kinds
+}
+
+// containsIP determines if a string contains an IPv4 or IPv6 address.
+func containsIP(_ *piiDetector, v string) bool {
+	if ipv4RE.MatchString(v) {
+		return true
+	}
+	// Candidates for IPv6 addresses are runs of hex digits and colons (and dots,
+	// for IPv4-mapped addresses) containing at least two colons. This also
+	// matches things like times of day ("12:30:00"), so each candidate must also
+	// parse as an IP address.
+	for _, candidate := range ipv6RE.FindAllString(v, -1) {
+		candidate = strings.TrimRight(candidate, ".")
+		if len(candidate) < 3 || strings.Trim(candidate, ":") == "" {
+			continue
+		}
+		if ip := net.ParseIP(candidate); ip != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPIIDetect(t *testing.T) {
+	d := &piiDetector{names: wordsRE([]string{"Steve Smith", "José", "Zoë"})}
+	for _, tc := range []struct {
+		v    string
+		want []string
+	}{
+		{"Hello world", nil},
+		{"", nil},
+
+		{"mail me at steve@example.com", []string{"email"}},
+		{"steve@localhost", nil},
+
+		{"see https://example.com/page", []string{"url"}},
+		{"www.example.org", []string{"url"}},
+
+		{"call 555-123-4567", []string{"phone"}},
+		{"call +44 20 7946 0958", []string{"phone"}},
+		{"(020) 7946 0958", []string{"phone"}},
+
+		{"server at 192.168.0.1", []string{"ip"}},
+		{"connect to 2001:db8::1", []string{"ip"}},
+		{"meet at 12:30:00", nil},
+		{"version 1.20.4", nil},
+
+		{"discord.gg/abcdef", []string{"discord"}},
+		{"add me steve#1234", []string{"discord"}},
+
+		{"base at x: 100 y: 64 z: -200", []string{"coordinates"}},
+		{"X=100, Z=-200", []string{"coordinates"}},
+		{"x 100 z 200", []string{"coordinates"}},
+		{"home (100, 64, -200)", []string{"coordinates"}},
+		{"home [100 64 -200]", []string{"coordinates"}},
+		{"1, 2, 3", nil},
+		{"costs 10, 20, 30 emeralds", nil},
+		{"born 12,05,1990", nil},
+		{"100 64 -200", nil},
+		{"max 5 zombies", nil},
+
+		{"signed, Steve Smith", []string{"name"}},
+		{"STEVE SMITH was here", []string{"name"}},
+		{"steve smithson", nil},
+		{"love, José", []string{"name"}},
+		{"Zoë's house", []string{"name"}},
+		{"Josés", nil},
+		{"éZoë", nil},
+	} {
+		if got := d.detect(tc.v); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("detect(%q) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestReplaceWords(t *testing.T) {
+	re := wordsRE([]string{"Steve", "Steve Smith", "Zoë"})
+	for _, tc := range []struct {
+		v, want string
+	}{
+		{"Steve", "<Steve>"},
+		{"hi Steve Smith!", "hi <Steve Smith>!"},
+		{"steve,zoë", "<steve>,<zoë>"},
+		{"Steven", "Steven"},
+		{"Zoë's", "<Zoë>'s"},
+		{"Zoës", "Zoës"},
+		{"nobody", "nobody"},
+	} {
+		got := replaceWords(re, tc.v, func(w string) string { return "<" + w + ">" })
+		if got != tc.want {
+			t.Errorf("replaceWords(%q) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestPIIFilterNote(t *testing.T) {
+	keep, err := newPIIFilter(&filterFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, ok := keep(0, "Text1", "steve@example.com, x: 1 z: 2")
+	if !ok || note != "email;coordinates" {
+		t.Errorf("pii filter = %q, %v; want %q, true", note, ok, "email;coordinates")
+	}
+	if note, ok := keep(0, "Text1", "nothing here"); ok {
+		t.Errorf("pii filter = %q, true; want false", note)
+	}
+}
@@ -0,0 +1,452 @@
+package commands
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/google/subcommands"
+)
+
+// Prune implements the prune command.
+type Prune struct {
+	skipConfirm bool
+	force       bool
+	backupDir   string
+	backup      *backup
+	jobs        int
+
+	// The criteria for removing chunks. A chunk is removed if it matches all of
+	// the criteria given.
+	minInhabited int64     // Remove chunks with a lower InhabitedTime (if > 0).
+	keep         keepAreas // Remove chunks outside these areas (if any).
+	olderThan    string    // Remove chunks last saved before this date.
+	before       time.Time // The parsed value of olderThan.
+
+	// dryRun indicates that the chunks which would be removed should be listed,
+	// without modifying the world.
+	dryRun bool
+	list   *csv.Writer
+
+	chunks  int // Number of chunks removed.
+	regions int // Number of region files changed.
+}
+
+// keepArea is a rectangular area of a dimension, in block coordinates.
+type keepArea struct {
+	dim            int
+	anyDim         bool // Whether the area applies to all dimensions.
+	x1, z1, x2, z2 int  // Inclusive bounds, with x1 <= x2 and z1 <= z2.
+}
+
+// keepAreas implements flag.Value for the -keep flag of the prune command.
+type keepAreas []keepArea
+
+// String implements flag.Value.
+func (k *keepAreas) String() string {
+	var s []string
+	for _, a := range *k {
+		area := fmt.Sprintf("%d,%d,%d,%d", a.x1, a.z1, a.x2, a.z2)
+		if !a.anyDim {
+			area = fmt.Sprintf("%d:%s", a.dim, area)
+		}
+		s = append(s, area)
+	}
+	return strings.Join(s, " ")
+}
+
+// Set implements flag.Value. The value is of the form [<dim>:]x1,z1,x2,z2.
+func (k *keepAreas) Set(s string) error {
+	a := keepArea{anyDim: true}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		dim, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return fmt.Errorf("invalid dimension %q", s[:i])
+		}
+		a.dim, a.anyDim, s = dim, false, s[i+1:]
+	}
+	var c [4]int
+	parts := strings.Split(s, ",")
+	if len(parts) != len(c) {
+		return fmt.Errorf("expected x1,z1,x2,z2, got %q", s)
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return fmt.Errorf("invalid coordinate %q", p)
+		}
+		c[i] = n
+	}
+	a.x1, a.x2 = minMax(c[0], c[2])
+	a.z1, a.z2 = minMax(c[1], c[3])
+	*k = append(*k, a)
+	return nil
+}
+
+// minMax returns a and b in increasing order.
+func minMax(a, b int) (int, int) {
+	if a > b {
+		return b, a
+	}
+	return a, b
+}
+
+// outside returns whether chunk (x, z) in the specified dimension lies wholly
+// outside the areas which apply to that dimension. It is false if no areas
+// apply to the dimension.
+func (k keepAreas) outside(dim, x, z int) bool {
+	applies := false
+	for _, a := range k {
+		if !a.anyDim && a.dim != dim {
+			continue
+		}
+		applies = true
+		if x*16 <= a.x2 && x*16+15 >= a.x1 && z*16 <= a.z2 && z*16+15 >= a.z1 {
+			return false
+		}
+	}
+	return applies
+}
+
+func (*Prune) Name() string {
+	return "prune"
+}
+
+func (*Prune) Synopsis() string {
+	return "Remove unused chunks from a Minecraft world."
+}
+
+func (*Prune) Usage() string {
+	return `prune [<flags>...] <world>
+Remove unused chunks from a Minecraft world.
+
+WARNING: This command will modify your world in-place. You should make a backup
+of your world before proceeding.
+
+Prune removes chunks which players have barely visited, so that Minecraft
+generates them again if they are ever visited again. The chunks to remove are
+selected using the following criteria. A chunk is removed if it matches all of
+the criteria given, and at least one must be given:
+
+  -min_inhabited_time <ticks>
+      The chunk's InhabitedTime (the total time players have spent in it, in
+      ticks; there are 20 ticks per second) is less than the given value.
+  -keep [<dim>:]x1,z1,x2,z2
+      The chunk lies wholly outside the rectangle with corners (x1, z1) and
+      (x2, z2), in block coordinates. This may be given more than once to keep
+      several areas. If a dimension (0=overworld, -1=nether, 1=the end) is
+      given, the area only applies to that dimension; otherwise it applies to
+      all of them. Chunks in dimensions to which no area applies never match
+      this criterion, so they are not removed.
+  -older_than <date>
+      The chunk was last saved (according to the timestamp table of the region
+      file) before the given date, in the form 2006-01-02 (local time) or
+      2006-01-02T15:04:05Z07:00. Chunks with no timestamp count as older.
+
+The location and timestamp entries of each chunk removed are cleared in the
+region file, and in the entities and poi region files for the same region. Any
+.mcc file holding the chunk's data is deleted. Each region file changed is then
+compacted (see the compact command), so that the chunk data does not remain in
+the file.
+
+If -dry_run is specified, the world is not modified. Instead, the chunks which
+would be removed are written to stdout in CSV format, with the columns
+dimension, chunk_x, chunk_z, inhabited_time (if -min_inhabited_time is given)
+and last_saved (the timestamp, or empty if there is none).
+
+If -backup is specified, each file is copied to the given directory before it is
+modified or deleted, so that it can be put back using the restore command.
+
+If -jobs is greater than 1, that many region files are pruned at a time.
+
+`
+}
+
+func (p *Prune) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&p.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+	f.StringVar(&p.backupDir, "backup", "", "Directory to save a copy of each file to before it is modified (see the restore command).")
+	f.IntVar(&p.jobs, "jobs", 1, "Number of region files to prune concurrently.")
+	f.Int64Var(&p.minInhabited, "min_inhabited_time", 0, "Remove chunks whose InhabitedTime is less than this many ticks.")
+	f.Var(&p.keep, "keep", "Remove chunks outside the area [<dim>:]x1,z1,x2,z2 (in block coordinates). May be repeated.")
+	f.StringVar(&p.olderThan, "older_than", "", "Remove chunks last saved before this date (2006-01-02 or RFC 3339).")
+	f.BoolVar(&p.dryRun, "dry_run", false, "List the chunks which would be removed, without modifying the world.")
+}
+
+func (p *Prune) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		log.Errorf("<world> is required.")
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 1 {
+		log.Error("Extra positional arguments found.")
+		return subcommands.ExitUsageError
+	}
+	if p.jobs < 1 {
+		log.Errorf("Invalid value for -jobs (%d), must be at least 1.", p.jobs)
+		return subcommands.ExitUsageError
+	}
+	if p.minInhabited < 0 {
+		log.Errorf("Invalid value for -min_inhabited_time (%d), must not be negative.", p.minInhabited)
+		return subcommands.ExitUsageError
+	}
+	if p.olderThan != "" {
+		var err error
+		if p.before, err = time.ParseInLocation("2006-01-02", p.olderThan, time.Local); err != nil {
+			if p.before, err = time.Parse(time.RFC3339, p.olderThan); err != nil {
+				log.Errorf("Invalid value for -older_than (%q), must be of the form 2006-01-02 or 2006-01-02T15:04:05Z07:00.", p.olderThan)
+				return subcommands.ExitUsageError
+			}
+		}
+	}
+	if p.minInhabited == 0 && len(p.keep) == 0 && p.olderThan == "" {
+		log.Error("At least one of -min_inhabited_time, -keep or -older_than is required.")
+		return subcommands.ExitUsageError
+	}
+	if !p.skipConfirm && !p.dryRun {
+		confirm()
+	}
+	if !p.dryRun {
+		lock, err := lockWorld(f.Arg(0), p.force)
+		if err != nil {
+			log.Errorf("Prune: %v", err)
+			return subcommands.ExitFailure
+		}
+		defer lock.unlock()
+	}
+	if p.backupDir != "" && !p.dryRun {
+		var err error
+		if p.backup, err = newBackup(p.backupDir, f.Arg(0), "prune"); err != nil {
+			log.Errorf("Prune: %v", err)
+			return subcommands.ExitFailure
+		}
+	}
+	if p.dryRun {
+		p.list = csv.NewWriter(os.Stdout)
+		p.list.Write([]string{"dimension", "chunk_x", "chunk_z", "inhabited_time", "last_saved"})
+	}
+	err := p.pruneWorld(f.Arg(0))
+	if p.list != nil {
+		p.list.Flush()
+		if werr := p.list.Error(); werr != nil && err == nil {
+			err = fmt.Errorf("cannot write list of chunks: %v", werr)
+		}
+	}
+	if err != nil {
+		log.Errorf("Prune: %v", err)
+		return subcommands.ExitFailure
+	}
+	if p.dryRun {
+		log.Infof("Would remove %d chunks from %d region files.", p.chunks, p.regions)
+	} else {
+		log.Infof("Removed %d chunks from %d region files.", p.chunks, p.regions)
+	}
+	return subcommands.ExitSuccess
+}
+
+// prunedChunk describes a chunk selected for removal.
+type prunedChunk struct {
+	slot      int
+	inhabited int64  // InhabitedTime, or -1 if it was not read.
+	timestamp uint32 // Seconds since the epoch when last saved, or 0.
+}
+
+// pruneResult holds the chunks removed from a region file.
+type pruneResult struct {
+	*regionRef
+	chunks []*prunedChunk
+}
+
+// pruneWorld prunes all region files in a world, up to p.jobs at a time.
+func (p *Prune) pruneWorld(path string) error {
+	regions, err := listRegions(path, "region")
+	if err != nil {
+		return err
+	}
+	return pipeline(p.jobs, nextRegion(regions), func(job interface{}) (interface{}, error) {
+		r := job.(*regionRef)
+		chunks, err := p.pruneRegion(r)
+		if err != nil {
+			return nil, fmt.Errorf("region file %q: %v", r.path, err)
+		}
+		return &pruneResult{r, chunks}, nil
+	}, func(result interface{}) error {
+		res := result.(*pruneResult)
+		if len(res.chunks) == 0 {
+			return nil
+		}
+		p.regions++
+		p.chunks += len(res.chunks)
+		if p.list == nil {
+			return nil
+		}
+		for _, c := range res.chunks {
+			inhabited, saved := "", ""
+			if c.inhabited >= 0 {
+				inhabited = strconv.FormatInt(c.inhabited, 10)
+			}
+			if c.timestamp != 0 {
+				saved = time.Unix(int64(c.timestamp), 0).UTC().Format(time.RFC3339)
+			}
+			p.list.Write([]string{
+				strconv.Itoa(res.dim),
+				strconv.Itoa(res.rx*32 + c.slot%32),
+				strconv.Itoa(res.rz*32 + c.slot/32),
+				inhabited,
+				saved,
+			})
+		}
+		return nil
+	})
+}
+
+// pruneRegion selects the chunks to remove from a region file, and (unless this
+// is a dry run) removes them from it, and from the entities and poi region
+// files for the same region.
+func (p *Prune) pruneRegion(r *regionRef) ([]*prunedChunk, error) {
+	chunks, err := p.selectChunks(r)
+	if err != nil || len(chunks) == 0 || p.dryRun {
+		return chunks, err
+	}
+	log.Infof("Removing %d chunks from region file %q.", len(chunks), r.path)
+	dimDir := filepath.Dir(filepath.Dir(r.path))
+	for _, kind := range regionKinds {
+		path := filepath.Join(dimDir, kind, filepath.Base(r.path))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := p.removeChunks(path, r.rx, r.rz, chunks); err != nil {
+			return nil, fmt.Errorf("region file %q: %v", path, err)
+		}
+	}
+	return chunks, nil
+}
+
+// selectChunks returns the chunks in a region file which match all of the
+// criteria for removal.
+func (p *Prune) selectChunks(r *regionRef) ([]*prunedChunk, error) {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %v", err)
+	}
+	defer f.Close()
+	locs, err := readLocations(f)
+	if err != nil {
+		return nil, err
+	}
+	timestamps, err := readTimestamps(f)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []*prunedChunk
+	for i, loc := range locs {
+		if loc == 0 {
+			continue
+		}
+		x, z := r.rx*32+i%32, r.rz*32+i/32
+		c := &prunedChunk{slot: i, inhabited: -1, timestamp: timestamps[i]}
+		if len(p.keep) > 0 && !p.keep.outside(r.dim, x, z) {
+			continue
+		}
+		if p.olderThan != "" && int64(c.timestamp) >= p.before.Unix() {
+			continue
+		}
+		// Only read the chunk if it matches all the other criteria, as this is
+		// the slowest one to check.
+		if p.minInhabited > 0 {
+			tree, _, err := readChunkAt(f, loc)
+			if err != nil {
+				log.Warnf("Not removing chunk (%d, %d) in region file %q: %v", x, z, r.path, err)
+				continue
+			}
+			c.inhabited = inhabitedTime(tree)
+			if c.inhabited >= p.minInhabited {
+				continue
+			}
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, nil
+}
+
+// inhabitedTime returns the value of the InhabitedTime tag of a chunk (within
+// the Level tag before 1.18), or 0 if there is none.
+func inhabitedTime(tree map[string]interface{}) int64 {
+	if t, ok := tree["InhabitedTime"].(int64); ok {
+		return t
+	}
+	if level, ok := tree["Level"].(map[string]interface{}); ok {
+		if t, ok := level["InhabitedTime"].(int64); ok {
+			return t
+		}
+	}
+	return 0
+}
+
+// removeChunks clears the location and timestamp entries of the specified
+// chunks in the region file for region (rx, rz) at path, deletes any .mcc files
+// holding their data, and compacts the file.
+func (p *Prune) removeChunks(path string, rx, rz int, chunks []*prunedChunk) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %v", err)
+	}
+	defer f.Close()
+	locs, err := readLocations(f)
+	if err != nil {
+		return err
+	}
+	timestamps, err := readTimestamps(f)
+	if err != nil {
+		return err
+	}
+	var external []string
+	changed := false
+	for _, c := range chunks {
+		loc := locs[c.slot]
+		if loc == 0 {
+			continue
+		}
+		r := io.NewSectionReader(f, locOffset(loc), int64(locSectors(loc))*sectorSize)
+		if _, compression, err := readChunkHeader(r); err == nil && compression < 0 {
+			external = append(external, externalChunkPath(filepath.Dir(path), rx*32+c.slot%32, rz*32+c.slot/32))
+		}
+		locs[c.slot] = 0
+		timestamps[c.slot] = 0
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if err := p.backup.save(path); err != nil {
+		return err
+	}
+	if err := writeLocations(f, locs); err != nil {
+		return err
+	}
+	if err := writeTimestamps(f, timestamps); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot close file: %v", err)
+	}
+	for _, ext := range external {
+		if err := p.backup.save(ext); err != nil {
+			return err
+		}
+		if err := os.Remove(ext); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove external chunk data: %v", err)
+		}
+	}
+	c := &Compact{backup: p.backup}
+	_, err = c.compactRegion(path)
+	return err
+}
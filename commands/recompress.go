@@ -0,0 +1,283 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/google/subcommands"
+)
+
+// compressionTypes maps the names accepted by the -compression flag of the
+// recompress command to compression types. See
+// https://minecraft.gamepedia.com/Region_file_format#Chunk_data.
+var compressionTypes = map[string]int8{
+	"gzip": 1,
+	"zlib": 2,
+	"none": 3,
+	"lz4":  4,
+}
+
+// Recompress implements the recompress command.
+type Recompress struct {
+	skipConfirm bool
+	force       bool
+	backupDir   string
+	backup      *backup
+	jobs        int
+	compression string
+	level       int
+
+	chunks       int   // Number of chunks recompressed.
+	regions      int   // Number of region files recompressed.
+	before, size int64 // Total size of the region files before and after.
+}
+
+func (*Recompress) Name() string {
+	return "recompress"
+}
+
+func (*Recompress) Synopsis() string {
+	return "Change the compression of the chunks in a Minecraft world."
+}
+
+func (*Recompress) Usage() string {
+	return `recompress -compression <type> [-level <n>] [-backup <dir>] <world>
+Change the compression of the chunks in a Minecraft world.
+
+WARNING: This command will modify your world in-place. You should make a backup
+of your world before proceeding.
+
+Recompress rewrites every chunk in the world (including the entities and poi
+region files) using the compression type given by -compression, which is one
+of:
+
+  gzip - GZip (compression type 1).
+  zlib - Zlib (compression type 2), which Minecraft uses by default.
+  none - Uncompressed (compression type 3).
+  lz4  - LZ4 (compression type 4), supported by Minecraft 1.20.5 and later.
+
+For gzip and zlib, -level sets the compression level, from 0 (none) to 9 (best
+compression). By default, Go's default level is used. Uncompressed and LZ4
+chunks are faster for the server to read and write, at the cost of space. Only
+the compression changes: the chunk data is decompressed and compressed again
+without being decoded, so it is left exactly as it was.
+
+Each region file is compacted as it is rewritten, so that it contains no unused
+sectors and its chunks are in slot order (see the compact command). Chunks
+stored in separate .mcc files because they are too large for the region file
+are left unchanged, as are chunks which would no longer fit in the region file
+using the new compression type. The total size of the region files before and
+after is reported.
+
+If -backup is specified, each region file is copied to the given directory
+before it is modified, so that it can be put back using the restore command.
+
+If -jobs is greater than 1, that many region files are recompressed at a time.
+
+`
+}
+
+func (r *Recompress) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&r.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&r.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+	f.StringVar(&r.backupDir, "backup", "", "Directory to save a copy of each region file to before it is modified (see the restore command).")
+	f.IntVar(&r.jobs, "jobs", 1, "Number of region files to recompress concurrently.")
+	f.StringVar(&r.compression, "compression", "", "Compression type to use: gzip, zlib, none or lz4.")
+	f.IntVar(&r.level, "level", defaultLevel, "Compression level for gzip and zlib, from 0 (none) to 9 (best compression), or -1 for the default.")
+}
+
+func (r *Recompress) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		log.Errorf("<world> is required.")
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 1 {
+		log.Error("Extra positional arguments found.")
+		return subcommands.ExitUsageError
+	}
+	compression, ok := compressionTypes[r.compression]
+	if !ok {
+		log.Errorf("Invalid value for -compression (%q), must be one of gzip, zlib, none or lz4.", r.compression)
+		return subcommands.ExitUsageError
+	}
+	switch {
+	case r.level < defaultLevel || r.level > 9:
+		log.Errorf("Invalid value for -level (%d), must be from 0 to 9, or -1 for the default.", r.level)
+		return subcommands.ExitUsageError
+	case r.level != defaultLevel && compression != compressionTypes["gzip"] && compression != compressionTypes["zlib"]:
+		log.Errorf("-level cannot be used with -compression %s.", r.compression)
+		return subcommands.ExitUsageError
+	}
+	if r.jobs < 1 {
+		log.Errorf("Invalid value for -jobs (%d), must be at least 1.", r.jobs)
+		return subcommands.ExitUsageError
+	}
+	if !r.skipConfirm {
+		confirm()
+	}
+	lock, err := lockWorld(f.Arg(0), r.force)
+	if err != nil {
+		log.Errorf("Recompress: %v", err)
+		return subcommands.ExitFailure
+	}
+	defer lock.unlock()
+	if r.backupDir != "" {
+		var err error
+		if r.backup, err = newBackup(r.backupDir, f.Arg(0), "recompress"); err != nil {
+			log.Errorf("Recompress: %v", err)
+			return subcommands.ExitFailure
+		}
+	}
+	if err := r.recompressWorld(f.Arg(0), compression); err != nil {
+		log.Errorf("Recompress: %v", err)
+		return subcommands.ExitFailure
+	}
+	change := 0.0
+	if r.before > 0 {
+		change = float64(r.size-r.before) / float64(r.before) * 100
+	}
+	log.Infof("Recompressed %d chunks in %d region files: %d bytes before, %d bytes after (%+.1f%%).", r.chunks, r.regions, r.before, r.size, change)
+	return subcommands.ExitSuccess
+}
+
+// recompressResult holds the outcome of recompressing a region file.
+type recompressResult struct {
+	chunks       int
+	before, size int64 // Size of the region file before and after.
+}
+
+// recompressWorld recompresses all region files in a world, up to r.jobs at a
+// time, using the specified compression type.
+func (r *Recompress) recompressWorld(path string, compression int8) error {
+	jobs, err := listCheckJobs(path)
+	if err != nil {
+		return err
+	}
+	return pipeline(r.jobs, nextCheckJob(jobs), func(job interface{}) (interface{}, error) {
+		j := job.(*checkJob)
+		res, err := r.recompressRegion(j.path, compression)
+		if err != nil {
+			return nil, fmt.Errorf("region file %q: %v", j.path, err)
+		}
+		log.Debugf("Region file %q: %d bytes before, %d bytes after.", j.path, res.before, res.size)
+		return res, nil
+	}, func(result interface{}) error {
+		res := result.(*recompressResult)
+		r.chunks += res.chunks
+		r.regions++
+		r.before += res.before
+		r.size += res.size
+		return nil
+	})
+}
+
+// recompressRegion rewrites every chunk in the region file located at path
+// using the specified compression type, and compacts the file. The whole file
+// is read and encoded before the new file is written, in the same way as a
+// compacted file (see Compact.compactRegion).
+func (r *Recompress) recompressRegion(path string, compression int8) (*recompressResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat file: %v", err)
+	}
+	locs, err := readLocations(f)
+	if err != nil {
+		return nil, err
+	}
+	timestamps, err := readTimestamps(f)
+	if err != nil {
+		return nil, err
+	}
+	res := &recompressResult{before: fi.Size()}
+	chunks := make([][]byte, len(locs))
+	for i, loc := range locs {
+		if loc == 0 {
+			continue
+		}
+		if chunks[i], err = r.recompressChunk(f, loc, compression); err != nil {
+			return nil, fmt.Errorf("chunk %d: %v", i, err)
+		}
+		res.chunks++
+	}
+	// Close the original file, so that it can be replaced.
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("cannot close file: %v", err)
+	}
+
+	if err := r.backup.save(path); err != nil {
+		return nil, err
+	}
+	next := 2 // Next free sector, after the location and timestamp tables.
+	err = replaceFile(path, func(tmp *os.File) error {
+		for i, data := range chunks {
+			if data == nil {
+				continue
+			}
+			if _, err := tmp.WriteAt(data, int64(next)*sectorSize); err != nil {
+				return fmt.Errorf("cannot write chunk %d: %v", i, err)
+			}
+			n := len(data) / sectorSize
+			locs[i] = uint32(next<<8 | n)
+			next += n
+		}
+		if err := writeLocations(tmp, locs); err != nil {
+			return err
+		}
+		return writeTimestamps(tmp, timestamps)
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.size = int64(next) * sectorSize
+	return res, nil
+}
+
+// recompressChunk reads the chunk data referenced by a chunk location entry,
+// and returns it compressed using the specified compression type and r.level,
+// padded to a whole number of sectors. If the chunk is stored in a separate
+// file, or would not fit in the region file once recompressed, its data is
+// returned unchanged.
+func (r *Recompress) recompressChunk(f io.ReaderAt, loc uint32, compression int8) ([]byte, error) {
+	rd := io.NewSectionReader(f, locOffset(loc), int64(locSectors(loc))*sectorSize)
+	length, old, err := readChunkHeader(rd)
+	if err != nil {
+		return nil, err
+	}
+	if length < 1 || chunkSectors(length) > locSectors(loc) {
+		return nil, fmt.Errorf("invalid length (%d bytes)", length)
+	}
+	unchanged := func() ([]byte, error) {
+		data := make([]byte, chunkSectors(length)*sectorSize)
+		if _, err := f.ReadAt(data[:4+length], locOffset(loc)); err != nil {
+			return nil, fmt.Errorf("cannot read chunk data: %v", err)
+		}
+		return data, nil
+	}
+	if old < 0 {
+		return unchanged()
+	}
+	// The NBT data is only decompressed and compressed again, not decoded, so
+	// that it is left exactly as it was.
+	nbtData, err := decompressChunkData(rd, length, old, "")
+	if err != nil {
+		return nil, err
+	}
+	data, err := compressChunk(nbtData, compression, r.level)
+	if err != nil {
+		return nil, err
+	}
+	if sectors := len(data) / sectorSize; sectors > 255 {
+		log.Warnf("Leaving chunk compression unchanged: new chunk data is too large (%d sectors)", sectors)
+		return unchanged()
+	}
+	return data, nil
+}
@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/google/subcommands"
+)
+
+// Recover implements the recover command.
+type Recover struct {
+	mode        string
+	skipConfirm bool
+	force       bool
+}
+
+func (*Recover) Name() string {
+	return "recover"
+}
+
+func (*Recover) Synopsis() string {
+	return "Recover a Minecraft world after an interrupted patch."
+}
+
+func (*Recover) Usage() string {
+	return `recover -mode <undo|finish> <world>
+Recover a Minecraft world after an interrupted patch.
+
+WARNING: This command will modify your world in-place. You should make a backup
+of your world before proceeding.
+
+If the patch command is interrupted (e.g., by a crash or power loss), it leaves a
+journal (mcstrings.journal) in the directory <world>, recording the changes made
+so far. The recover command uses the journal to bring the world back to a
+consistent state, and then removes the journal. The -mode flag determines how:
+
+  undo   - Roll back all changes made by the interrupted run, restoring the
+           world to its state before patching began.
+  finish - Roll back any partially-written chunk, and then apply the rows of
+           the strings file which the interrupted run had not yet written,
+           using the same -mask_wordlist files, -keep_timestamps setting and
+           -backup directory. These files must not have been modified; the
+           recover command refuses to finish the run if the strings file or
+           wordlists have changed.
+
+`
+}
+
+func (r *Recover) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&r.mode, "mode", "", "How to recover the world (undo or finish, required).")
+	f.BoolVar(&r.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&r.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+}
+
+func (r *Recover) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		log.Error("<world> is required.")
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 1 {
+		log.Error("Extra positional arguments found.")
+		return subcommands.ExitUsageError
+	}
+	if r.mode != "undo" && r.mode != "finish" {
+		log.Errorf("Invalid mode (%q), must be one of undo, finish.", r.mode)
+		return subcommands.ExitUsageError
+	}
+	world := f.Arg(0)
+	j, err := loadJournal(world)
+	if err != nil {
+		log.Errorf("Recover: %v", err)
+		return subcommands.ExitFailure
+	}
+	if j == nil {
+		log.Info("No journal found. There is nothing to recover.")
+		return subcommands.ExitSuccess
+	}
+	if !r.skipConfirm {
+		confirm()
+	}
+	lock, err := lockWorld(world, r.force)
+	if err != nil {
+		log.Errorf("Recover: %v", err)
+		return subcommands.ExitFailure
+	}
+	defer lock.unlock()
+	if err := r.recover(world, j); err != nil {
+		log.Errorf("Recover: %v", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// recover undoes or finishes the interrupted run recorded in the journal j.
+func (r *Recover) recover(world string, j *journal) error {
+	if r.mode == "undo" {
+		if err := j.undo(); err != nil {
+			return err
+		}
+		log.Info("Rolled back all changes.")
+		return nil
+	}
+	// The rows already applied are skipped by counting them, which is only
+	// correct if the files are the same as those used by the interrupted run.
+	if err := j.checkInputs(); err != nil {
+		return err
+	}
+	start := j.start()
+	if err := j.resume(); err != nil {
+		return fmt.Errorf("cannot roll back incomplete changes: %v", err)
+	}
+	p := &Patch{
+		world:          world,
+		strings:        start.Strings,
+		maskWordlists:  start.MaskWordlist,
+		keepTimestamps: start.KeepTimestamps,
+		backupDir:      start.BackupDir,
+		journal:        j,
+		resumeAfter:    j.applied(),
+	}
+	if p.backupDir != "" {
+		// Add the region files which the interrupted run had not yet modified to
+		// its backup.
+		b, err := openBackup(p.backupDir, world)
+		if err != nil {
+			return err
+		}
+		p.backup = b
+	}
+	if err := p.apply(); err != nil {
+		return err
+	}
+	log.Info("Finished patching.")
+	if p.shouldCompact {
+		log.Info("Some chunks were resized or relocated. It is recommended to compact the world.")
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package commands
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/google/subcommands"
+)
+
+var (
+	// redactStrategies defines how the text of each redacted string is
+	// replaced.
+	redactStrategies = map[string]func(r *Redact, text string) string{
+		"blank":       func(*Redact, string) string { return "" },
+		"placeholder": func(r *Redact, _ string) string { return r.placeholder },
+		"mask":        func(_ *Redact, text string) string { return maskText(text) },
+		"pseudonym":   func(r *Redact, text string) string { return "Anon-" + pseudonym(r.salt, text) },
+	}
+
+	writableBookPagesRE = regexp.MustCompile(`.*/components/minecraft:writable_book_content/pages\[\d+\](/(raw|filtered))?$`)
+)
+
+// Redact implements the redact command.
+type Redact struct {
+	filterFlags
+	world       string
+	strategy    string
+	placeholder string
+	salt        string
+	skipConfirm bool
+	force       bool
+	keep        filter
+	redacted    int
+
+	// keepTimestamps indicates that the chunk timestamp table should not be
+	// updated when chunks are written (see writeChunk).
+	keepTimestamps bool
+
+	// shouldCompact indicates whether any chunks required resizing or relocating.
+	// If so, notify the user that they should compact the world.
+	shouldCompact bool
+}
+
+func (*Redact) Name() string {
+	return "redact"
+}
+
+func (*Redact) Synopsis() string {
+	return "Redact strings in a Minecraft world."
+}
+
+func (*Redact) Usage() string {
+	return fmt.Sprintf(`redact [<flags>...] <world>
+Redact strings in a Minecraft world.
+
+WARNING: This command will modify your world in-place. You should make a backup
+of your world before proceeding.
+
+Redact replaces the strings selected by -filter (user_text by default) in the
+Minecraft world located in the directory <world>, in a single pass. This should
+be the directory containing level.dat. The -filter, -invert, -pii_names and
+-wordlist flags select strings in the same way as for the extract command.
+
+The -strategy flag determines what the strings are replaced with (one of: %s):
+
+  blank       - An empty string.
+  placeholder - The text given by -placeholder.
+  mask        - Asterisks, preserving the length of the text and whitespace.
+  pseudonym   - A pseudonym derived from the original text, so that identical
+                text receives identical pseudonyms (however it is formatted,
+                for text components). Use -salt to prevent the original text
+                from being guessed from the pseudonym.
+
+Strings holding JSON text components (e.g., sign text and custom names) are
+replaced with valid text components, so that blanking sign text does not damage
+the sign.
+
+The timestamp of each chunk which is changed is updated in the region file's
+timestamp table, unless -keep_timestamps is specified.
+
+`, validRedactStrategies())
+}
+
+func (r *Redact) SetFlags(f *flag.FlagSet) {
+	r.filterFlags.SetFlags(f, "user_text")
+	f.StringVar(&r.strategy, "strategy", "blank", fmt.Sprintf("How to replace redacted strings (one of: %s)", validRedactStrategies()))
+	f.StringVar(&r.placeholder, "placeholder", "[REDACTED]", "Replacement text for the placeholder strategy")
+	f.StringVar(&r.salt, "salt", "", "Secret used to derive pseudonyms for the pseudonym strategy")
+	f.BoolVar(&r.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&r.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+	f.BoolVar(&r.keepTimestamps, "keep_timestamps", false, "Do not update the timestamps of the chunks which are changed.")
+}
+
+func (r *Redact) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		log.Error("<world> is required.")
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 1 {
+		log.Error("Extra positional arguments found.")
+		return subcommands.ExitUsageError
+	}
+	r.world = f.Arg(0)
+	if _, ok := redactStrategies[r.strategy]; !ok {
+		log.Errorf("Invalid strategy (%q), must be one of %s.", r.strategy, validRedactStrategies())
+		return subcommands.ExitUsageError
+	}
+	keep, _, err := r.filterFlags.build()
+	if err != nil {
+		log.Errorf("Invalid filter: %v", err)
+		return subcommands.ExitUsageError
+	}
+	r.keep = keep
+	if !r.skipConfirm {
+		confirm()
+	}
+	lock, err := lockWorld(r.world, r.force)
+	if err != nil {
+		log.Errorf("Redact: %v", err)
+		return subcommands.ExitFailure
+	}
+	defer lock.unlock()
+	if err := walkWorld(r.world, "region", r.redactRegion); err != nil {
+		log.Errorf("Redact: %v", err)
+		return subcommands.ExitFailure
+	}
+	log.Infof("Redacted %d strings.", r.redacted)
+	if r.shouldCompact {
+		log.Info("Some chunks were resized or relocated. It is recommended to compact the world.")
+	}
+	return subcommands.ExitSuccess
+}
+
+// validRedactStrategies returns a comma-separated list of valid redaction
+// strategies for usage documentation.
+func validRedactStrategies() string {
+	var names []string
+	for k := range redactStrategies {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// redactRegion redacts the strings in a single region file. See
+// Extract.readRegion.
+func (r *Redact) redactRegion(dim, rx, rz int, path string) error {
+	updates, resized, err := rewriteRegion(path, r.keepTimestamps, nil, func(i int, tree map[string]interface{}) int {
+		dv := dataVersion(tree)
+		n := replaceStrings(tree, func(k, v string) string {
+			if _, ok := r.keep(dv, k, v); !ok {
+				return v
+			}
+			return r.redact(dv, k, v)
+		})
+		if n > 0 {
+			log.Debugf("Redacting %d strings in dimension %d, chunk (%d, %d).", n, dim, rx*32+i%32, rz*32+i/32)
+		}
+		return n
+	})
+	r.redacted += updates
+	if resized {
+		r.shouldCompact = true
+	}
+	return err
+}
+
+// redact returns the replacement for the string v at NBT path k, in a chunk
+// with the specified DataVersion.
+func (r *Redact) redact(dataVersion int32, k, v string) string {
+	if isEmptyText(v) {
+		return v // Nothing to redact.
+	}
+	replace := redactStrategies[r.strategy]
+	if !isTextComponent(dataVersion, k, v) {
+		return replace(r, v)
+	}
+	switch r.strategy {
+	case "blank":
+		return emptyTextComponent(dataVersion)
+	case "mask":
+		// Mask the text within the component, preserving its structure.
+		return maskText(v)
+	default:
+		// Pseudonyms are derived from the text alone, so that the same text
+		// receives the same pseudonym however it is formatted.
+		text, err := json.Marshal(map[string]string{"text": replace(r, componentText(v))})
+		if err != nil {
+			panic(err) // Marshalling a map of strings cannot fail.
+		}
+		return string(text)
+	}
+}
+
+// isTextComponent determines if the string v at NBT path k, in a chunk with the
+// specified DataVersion, holds a JSON text component. See
+// https://minecraft.wiki/w/Text_component_format.
+func isTextComponent(dataVersion int32, k, v string) bool {
+	k = clean(k)
+	if writableBookPagesRE.MatchString(k) {
+		return false // Book & quill pages contain plain text.
+	}
+	// Sign text has been stored as JSON since before DataVersions were
+	// introduced.
+	if dataVersion > 0 && (signRE.MatchString(k) || signMessagesRE.MatchString(k)) {
+		return true
+	}
+	t := strings.TrimSpace(v)
+	return t != "" && strings.ContainsAny(t[:1], `{["`) && json.Valid([]byte(t))
+}
+
+// emptyTextComponent returns the JSON text component with no text that
+// Minecraft uses for the specified DataVersion (e.g., for blank sign lines).
+func emptyTextComponent(dataVersion int32) string {
+	if dataVersion >= dataVersion1_20 {
+		return `""`
+	}
+	return `{"text":""}`
+}
+
+// maskText replaces each character of the text in a string with an asterisk,
+// preserving whitespace. If the string is a JSON text component, only the text
+// within it is masked (see textSpans).
+func maskText(v string) string {
+	var b strings.Builder
+	prev := 0
+	for _, span := range textSpans(v) {
+		b.WriteString(v[prev:span[0]])
+		for _, c := range v[span[0]:span[1]] {
+			if unicode.IsSpace(c) {
+				b.WriteRune(c)
+			} else {
+				b.WriteByte('*')
+			}
+		}
+		prev = span[1]
+	}
+	b.WriteString(v[prev:])
+	return b.String()
+}
+
+// componentText returns the text within a JSON text component: the contents
+// of its text spans (see textSpans), unescaped and joined together.
+func componentText(v string) string {
+	var b strings.Builder
+	for _, span := range textSpans(v) {
+		var s string
+		if err := json.Unmarshal([]byte(`"`+v[span[0]:span[1]]+`"`), &s); err != nil {
+			s = v[span[0]:span[1]]
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// pseudonym derives a short pseudonym from a string, such that the same string
+// and salt always produce the same pseudonym.
+func pseudonym(salt, s string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))[:8]
+}
@@ -0,0 +1,48 @@
+package commands
+
+import "testing"
+
+func TestRedactComponents(t *testing.T) {
+	r := &Redact{strategy: "pseudonym", salt: "salt"}
+	want := r.redact(dataVersion1_20, "Entities[0]/CustomName", `"Steve"`)
+	for _, v := range []string{
+		`{"text":"Steve"}`,
+		`{"text":"Steve","color":"red"}`,
+		`["St", {"text":"eve", "bold":true}]`,
+	} {
+		if got := r.redact(dataVersion1_20, "Entities[0]/CustomName", v); got != want {
+			t.Errorf("redact(%q) = %q, want %q (as for %q)", v, got, want, `"Steve"`)
+		}
+	}
+	if got := r.redact(dataVersion1_20, "Entities[0]/CustomName", `"Alex"`); got == want {
+		t.Errorf("redact(%q) = %q, the same as for %q", `"Alex"`, got, `"Steve"`)
+	}
+
+	for _, tc := range []struct {
+		strategy, v, want string
+	}{
+		{"blank", `{"text":"Steve"}`, `""`},
+		{"mask", `{"text":"Hi Steve","color":"red"}`, `{"text":"** *****","color":"red"}`},
+		{"placeholder", `{"text":"Steve","color":"red"}`, `{"text":"[REDACTED]"}`},
+		{"placeholder", "Steve", "[REDACTED]"},
+		{"blank", `{"text":""}`, `{"text":""}`},
+	} {
+		r := &Redact{strategy: tc.strategy, placeholder: "[REDACTED]"}
+		if got := r.redact(dataVersion1_20, "Entities[0]/CustomName", tc.v); got != tc.want {
+			t.Errorf("redact(%q) with strategy %s = %q, want %q", tc.v, tc.strategy, got, tc.want)
+		}
+	}
+}
+
+func TestComponentText(t *testing.T) {
+	for v, want := range map[string]string{
+		"plain":                               "plain",
+		`"quoted"`:                            "quoted",
+		`{"text":"a \"b\"","color":"red"}`:    `a "b"`,
+		`{"text":"a","extra":[{"text":"b"}]}`: "ab",
+	} {
+		if got := componentText(v); got != want {
+			t.Errorf("componentText(%q) = %q, want %q", v, got, want)
+		}
+	}
+}
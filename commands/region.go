@@ -0,0 +1,605 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+)
+
+// sectorSize is the size of the sectors in a region file. See
+// https://minecraft.gamepedia.com/Region_file_format#Structure.
+const sectorSize = 4096
+
+// dimensions lists the dimensions of a world, and the directory (relative to
+// the world directory) containing the data for each dimension.
+var dimensions = []struct {
+	dim int
+	dir string
+}{
+	{0, ""},
+	{-1, "DIM-1"},
+	{1, "DIM1"},
+}
+
+// walkWorld calls fn for each non-empty region file in the world located in
+// the specified path. Kind is the name of the directory containing the region
+// files within each dimension (i.e., "region" for chunk data).
+func walkWorld(path, kind string, fn func(dim, rx, rz int, path string) error) error {
+	for _, d := range dimensions {
+		if err := walkDimension(d.dim, filepath.Join(path, d.dir, kind), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkDimension calls fn for each non-empty region file in the directory
+// specified by path. Dim indicates which dimension is being processed, and
+// should be 0 for overworld, -1 for nether, and 1 for the end.
+func walkDimension(dim int, path string, fn func(dim, rx, rz int, path string) error) error {
+	dir, err := os.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot read contents of directory %q: %v", path, err)
+	}
+
+	for _, entry := range dir {
+		if !strings.HasSuffix(entry.Name(), ".mca") {
+			continue
+		}
+		region := filepath.Join(path, entry.Name())
+		if fi, err := os.Stat(region); err != nil {
+			return fmt.Errorf("cannot stat region file %q: %v", region, err)
+		} else if fi.Size() == 0 {
+			log.Infof("Skipping empty region file %q", region)
+			continue
+		}
+		var x, z int
+		if _, err := fmt.Sscanf(entry.Name(), "r.%d.%d.mca", &x, &z); err != nil {
+			return fmt.Errorf("invalid region file name %q", region)
+		}
+		if err := fn(dim, x, z, region); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// regionRef identifies a region file within a world.
+type regionRef struct {
+	dim, rx, rz int
+	path        string
+}
+
+// listRegions returns the non-empty region files in the world located in the
+// specified path, in the order they are visited by walkWorld.
+func listRegions(path, kind string) ([]*regionRef, error) {
+	var regions []*regionRef
+	err := walkWorld(path, kind, func(dim, rx, rz int, path string) error {
+		regions = append(regions, &regionRef{dim, rx, rz, path})
+		return nil
+	})
+	return regions, err
+}
+
+// nextRegion returns a function which returns each of the regions in turn, and
+// then io.EOF. See pipeline.
+func nextRegion(regions []*regionRef) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if len(regions) == 0 {
+			return nil, io.EOF
+		}
+		r := regions[0]
+		regions = regions[1:]
+		return r, nil
+	}
+}
+
+// locOffset returns the byte offset of the chunk data referenced by a chunk
+// location entry. See
+// https://minecraft.gamepedia.com/Region_file_format#Chunk_location.
+func locOffset(loc uint32) int64 {
+	return int64(loc>>8) * sectorSize
+}
+
+// locSectors returns the number of sectors occupied by the chunk data
+// referenced by a chunk location entry.
+func locSectors(loc uint32) int {
+	return int(loc & 0xff)
+}
+
+// readLocations reads the chunk location table from the start of a region
+// file.
+func readLocations(f io.ReaderAt) ([]uint32, error) {
+	locs := make([]uint32, 1024)
+	if err := binary.Read(io.NewSectionReader(f, 0, sectorSize), binary.BigEndian, locs); err != nil {
+		return nil, fmt.Errorf("cannot read chunk locations: %v", err)
+	}
+	return locs, nil
+}
+
+// writeLocations writes the chunk location table to the start of a region
+// file.
+func writeLocations(f io.WriterAt, locs []uint32) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, locs)
+	if _, err := f.WriteAt(buf.Bytes(), 0); err != nil {
+		return fmt.Errorf("cannot write chunk locations: %v", err)
+	}
+	return nil
+}
+
+// readTimestamps reads the chunk timestamp table, which follows the location
+// table, from a region file. Each timestamp is the time the chunk was last
+// saved, in seconds since the epoch.
+func readTimestamps(f io.ReaderAt) ([]uint32, error) {
+	timestamps := make([]uint32, 1024)
+	if err := binary.Read(io.NewSectionReader(f, sectorSize, sectorSize), binary.BigEndian, timestamps); err != nil {
+		return nil, fmt.Errorf("cannot read chunk timestamps: %v", err)
+	}
+	return timestamps, nil
+}
+
+// writeTimestamps writes the chunk timestamp table to a region file.
+func writeTimestamps(f io.WriterAt, timestamps []uint32) error {
+	buf := make([]byte, sectorSize)
+	for i, t := range timestamps {
+		binary.BigEndian.PutUint32(buf[4*i:], t)
+	}
+	if _, err := f.WriteAt(buf, sectorSize); err != nil {
+		return fmt.Errorf("cannot write chunk timestamps: %v", err)
+	}
+	return nil
+}
+
+// writeTimestamp sets the entry for the chunk at index i (dz*32 + dx) in the
+// chunk timestamp table of a region file (see readTimestamps).
+func writeTimestamp(f io.WriterAt, i int, timestamp uint32) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], timestamp)
+	if _, err := f.WriteAt(buf[:], sectorSize+int64(4*i)); err != nil {
+		return fmt.Errorf("cannot write chunk timestamp: %v", err)
+	}
+	return nil
+}
+
+// saveTime returns the timestamp to record for a chunk which is being saved
+// (see writeChunk): the current time, or zero to keep the chunk's existing
+// timestamp if keep is set.
+func saveTime(keep bool) uint32 {
+	if keep {
+		return 0
+	}
+	return uint32(time.Now().Unix())
+}
+
+// replaceFile replaces the file located at path with one written by fn. Fn
+// writes the new contents to a temporary file in the same directory, which is
+// flushed to disk and then renamed over the original, so that the file is
+// replaced in a single step: if this is interrupted (e.g., by a crash or power
+// loss), the original file is left intact, along with the temporary file at
+// worst. The new file has the same permissions as the original. The original
+// file must not be open, as it cannot be replaced on some platforms if it is.
+func replaceFile(path string, fn func(f *os.File) error) (err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("cannot stat file: %v", err)
+	}
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err := fn(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("cannot set permissions of temporary file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("cannot flush temporary file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot write temporary file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("cannot replace file: %v", err)
+	}
+	// Flush the rename to disk too. Directories cannot be synced on all
+	// platforms (e.g., Windows), so this is best effort.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// readChunkAt reads the chunk data referenced by a chunk location entry, and
+// returns the chunk's NBT tree and the compression type used to store it.
+func readChunkAt(f io.ReaderAt, loc uint32) (map[string]interface{}, int8, error) {
+	return readChunk(io.NewSectionReader(f, locOffset(loc), int64(locSectors(loc))*sectorSize))
+}
+
+// readChunkHeader reads the header at the start of the chunk data: the length
+// (in bytes, excluding the length itself but including the compression type)
+// and the compression type. See
+// https://minecraft.gamepedia.com/wiki/Region_file_format#Chunk_data.
+func readChunkHeader(r io.Reader) (length int32, compression int8, err error) {
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, 0, fmt.Errorf("cannot read chunk length: %v", err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &compression); err != nil {
+		return 0, 0, fmt.Errorf("cannot read compression type: %v", err)
+	}
+	return length, compression, nil
+}
+
+// chunkSectors returns the number of sectors needed to hold chunk data with
+// the specified length (see readChunkHeader).
+func chunkSectors(length int32) int {
+	return int((4 + int64(length) + sectorSize - 1) / sectorSize)
+}
+
+// externalChunkPath returns the path of the file holding the data for chunk
+// (x, z) if it is too large to be stored in the region file in directory dir.
+// See https://minecraft.gamepedia.com/wiki/Region_file_format#Payload.
+func externalChunkPath(dir string, x, z int) string {
+	return filepath.Join(dir, fmt.Sprintf("c.%d.%d.mcc", x, z))
+}
+
+// decodeChunkData reads the remaining length-1 bytes of chunk data from r,
+// following the header (see readChunkHeader), and decompresses and decodes
+// them. If the high bit of the compression type is set, the data is instead
+// read from the file ext (see externalChunkPath); if ext is empty, this is an
+// error.
+func decodeChunkData(r io.Reader, length int32, compression int8, ext string) (map[string]interface{}, error) {
+	nbtData, err := decompressChunkData(r, length, compression, ext)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	if err := nbt.UnmarshalEncoding(nbtData, &tree, nbt.BigEndian); err != nil {
+		return nil, fmt.Errorf("cannot decode NBT data: %v", err)
+	}
+	return tree, nil
+}
+
+// decompressChunkData reads and decompresses chunk data as for decodeChunkData,
+// and returns the NBT data without decoding it.
+func decompressChunkData(r io.Reader, length int32, compression int8, ext string) ([]byte, error) {
+	var data []byte
+	if compression < 0 {
+		compression &= 0x7f
+		if ext == "" {
+			return nil, fmt.Errorf("chunk data is stored externally")
+		}
+		var err error
+		if data, err = ioutil.ReadFile(ext); err != nil {
+			return nil, fmt.Errorf("cannot read external chunk data: %v", err)
+		}
+	} else {
+		data = make([]byte, length-1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("cannot read chunk data: %v", err)
+		}
+	}
+	nbtr, err := wrapReader(bytes.NewReader(data), compression)
+	if err != nil {
+		// Either the compression type is unknown, or the header of the
+		// compressed data (e.g., for gzip or zlib) is invalid.
+		return nil, fmt.Errorf("cannot decompress chunk data: %v", err)
+	}
+	defer nbtr.Close()
+	nbtData, err := ioutil.ReadAll(nbtr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress chunk data: %v", err)
+	}
+	return nbtData, nil
+}
+
+// defaultLevel selects the default level of the compression type used (see
+// wrapWriter). This is the same as flate.DefaultCompression.
+const defaultLevel = -1
+
+// encodeChunk encodes the NBT tree for a chunk using the specified compression
+// type and level (see wrapWriter). The result includes the chunk header (length
+// and compression type) and is padded to a whole number of sectors. See
+// https://minecraft.gamepedia.com/wiki/Region_file_format#Chunk_data.
+func encodeChunk(tree map[string]interface{}, compression int8, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	// Reserve room for the header, which we'll fill in once we know the length.
+	buf.Write(make([]byte, 5))
+	w, err := wrapWriter(&buf, compression, level)
+	if err != nil {
+		return nil, err
+	}
+	enc := nbt.NewEncoderWithEncoding(w, nbt.BigEndian)
+	if err := enc.Encode(tree); err != nil {
+		return nil, fmt.Errorf("cannot encode NBT data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("cannot compress NBT data: %v", err)
+	}
+	data := frameChunk(buf.Bytes(), compression)
+	// Check if the sector count will fit in one byte.
+	if sectors := len(data) / sectorSize; sectors > 255 {
+		return nil, fmt.Errorf("new chunk data is too large (%d sectors)", sectors)
+	}
+	return data, nil
+}
+
+// compressChunk compresses the NBT data for a chunk, as returned by
+// decompressChunkData, using the specified compression type and level. The
+// result is framed as for encodeChunk, but may be too large to be stored in a
+// region file.
+func compressChunk(nbtData []byte, compression int8, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 5)) // See encodeChunk.
+	w, err := wrapWriter(&buf, compression, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(nbtData); err != nil {
+		return nil, fmt.Errorf("cannot compress NBT data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("cannot compress NBT data: %v", err)
+	}
+	return frameChunk(buf.Bytes(), compression), nil
+}
+
+// frameChunk fills in the header reserved in the first five bytes of the chunk
+// data, and pads the data with zeros to a whole number of sectors.
+func frameChunk(data []byte, compression int8) []byte {
+	// The length field in the chunk data includes the 1-byte compression type,
+	// but not the 4-byte length itself.
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(data)-4))
+	data[4] = byte(compression)
+	// Pad with zeros to the end of the last sector.
+	if partial := len(data) % sectorSize; partial != 0 {
+		data = append(data, make([]byte, sectorSize-partial)...)
+	}
+	return data
+}
+
+// regionFile is an open region file. This is satisfied by *os.File, but allows
+// writes to the file to be intercepted (e.g., see journaledFile).
+type regionFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+// sectorMap records which sectors of a region file are in use, so that the
+// space freed when chunks shrink or move can be reused. Like Minecraft's own
+// allocator, it places data in the first run of free sectors that is big
+// enough, or else at the end of the file.
+type sectorMap struct {
+	// used counts the chunks occupying each sector. Sectors beyond the end of
+	// the slice are free. A count above one indicates overlapping chunks, which
+	// are only found in damaged files.
+	used []int
+}
+
+// newSectorMap builds the sector map for a region file from its chunk location
+// table (see readLocations). The first two sectors, which hold the chunk
+// location and timestamp tables, are always in use.
+func newSectorMap(locs []uint32) *sectorMap {
+	m := &sectorMap{}
+	m.add(0, 2, 1)
+	for _, loc := range locs {
+		if loc != 0 {
+			m.add(int(loc>>8), locSectors(loc), 1)
+		}
+	}
+	return m
+}
+
+// add adds delta to the use count of n sectors, starting at start.
+func (m *sectorMap) add(start, n, delta int) {
+	for len(m.used) < start+n {
+		m.used = append(m.used, 0)
+	}
+	for i := start; i < start+n; i++ {
+		m.used[i] += delta
+	}
+}
+
+// free reports whether the n sectors starting at start are free.
+func (m *sectorMap) free(start, n int) bool {
+	for i := start; i < start+n && i < len(m.used); i++ {
+		if m.used[i] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// allocate returns the start of the first run of n free sectors. It does not
+// mark them as used.
+func (m *sectorMap) allocate(n int) int {
+	run := 0
+	for i, used := range m.used {
+		if used > 0 {
+			run = 0
+			continue
+		}
+		if run++; run == n {
+			return i - n + 1
+		}
+	}
+	// Use the free sectors at the end of the map (if any) and beyond.
+	return len(m.used) - run
+}
+
+// writeChunk writes encoded chunk data (see encodeChunk) for the chunk at
+// offset (dx, dz) within the region file f, and updates the chunk location
+// table. M is the sector map for f, which is updated to match. If timestamp is
+// non-zero, the chunk's entry in the timestamp table is set to it (see
+// saveTime), so that tools which rely on the timestamps notice the change.
+//
+// A chunk which shrinks, or grows into free sectors which immediately follow
+// it, is written in place. Otherwise, the chunk is moved into the first run of
+// free sectors big enough to hold it (see sectorMap). The data is always
+// written before the location table is updated, and any sectors which the
+// chunk no longer occupies are then zeroed, so that they do not retain stale
+// data. Resized indicates whether the chunk changed size or location, which
+// may leave free sectors in the file that compaction would remove.
+func writeChunk(f regionFile, m *sectorMap, dx, dz int, data []byte, timestamp uint32) (resized bool, err error) {
+	var locBuf [4]byte
+	if _, err := f.ReadAt(locBuf[:], int64(4*(dz*32+dx))); err != nil {
+		return false, fmt.Errorf("cannot read chunk location: %v", err)
+	}
+	loc := binary.BigEndian.Uint32(locBuf[:])
+	start, sectors := int(loc>>8), locSectors(loc)
+	newStart, newSectors := start, len(data)/sectorSize
+	if loc == 0 || newSectors > sectors && !m.free(start+sectors, newSectors-sectors) {
+		newStart = m.allocate(newSectors)
+		log.Debugf("Relocating chunk (%d, %d) in %q from sector %d to sector %d.", dx, dz, f.Name(), start, newStart)
+	}
+	if _, err := f.WriteAt(data, int64(newStart)*sectorSize); err != nil {
+		return false, fmt.Errorf("could not write chunk data: %v", err)
+	}
+	if timestamp != 0 {
+		if err := writeTimestamp(f, dz*32+dx, timestamp); err != nil {
+			return false, err
+		}
+	}
+	if newSectors == sectors && newStart == start {
+		return false, nil
+	}
+	// The sector count has changed, so we need to write the new sector count
+	// (and possibly new offset if we've relocated the chunk) to the chunk
+	// location table.
+	log.Debugf("Resizing chunk (%d, %d) in %q from %d sectors to %d sectors.", dx, dz, f.Name(), sectors, newSectors)
+	binary.BigEndian.PutUint32(locBuf[:], uint32(newStart)<<8|uint32(newSectors))
+	if _, err := f.WriteAt(locBuf[:], int64(4*(dz*32+dx))); err != nil {
+		return false, fmt.Errorf("cannot write new chunk location: %v", err)
+	}
+	// Update the sector map, and free the sectors the chunk no longer occupies.
+	switch {
+	case newStart != start || loc == 0:
+		m.add(newStart, newSectors, 1)
+		if loc != 0 {
+			return true, zeroSectors(f, m, start, start+sectors)
+		}
+	case newSectors > sectors:
+		m.add(start+sectors, newSectors-sectors, 1)
+	default:
+		return true, zeroSectors(f, m, start+newSectors, start+sectors)
+	}
+	return true, nil
+}
+
+// zeroSectors releases the sectors from start up to (but not including) end in
+// the sector map m, and overwrites those which are no longer in use with zeros.
+func zeroSectors(f regionFile, m *sectorMap, start, end int) error {
+	m.add(start, end-start, -1)
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat region file: %v", err)
+	}
+	zeros := make([]byte, sectorSize)
+	for i := start; i < end && int64(i)*sectorSize < fi.Size(); i++ {
+		if m.used[i] > 0 {
+			continue // Still used by an overlapping chunk.
+		}
+		if _, err := f.WriteAt(zeros, int64(i)*sectorSize); err != nil {
+			return fmt.Errorf("cannot zero free sector %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// rewriteRegion rewrites the chunks in the region file located at path. It
+// calls fn with the index (dz*32 + dx) and NBT tree of each chunk in the file.
+// Fn may modify the tree in place, and returns the number of changes made. If
+// any changes were made, the chunk is written back to the file, and its
+// timestamp is updated unless keepTimestamps is set. The file is saved to b (if
+// not nil) before the first chunk is written. Resized indicates whether any
+// chunks changed size or location (see writeChunk).
+func rewriteRegion(path string, keepTimestamps bool, b *backup, fn func(i int, tree map[string]interface{}) int) (updates int, resized bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot open region file %q: %v", path, err)
+	}
+	defer f.Close()
+	locs, err := readLocations(f)
+	if err != nil {
+		return 0, false, fmt.Errorf("region file %q: %v", path, err)
+	}
+	m := newSectorMap(locs)
+	for i, loc := range locs {
+		if loc == 0 {
+			continue
+		}
+		tree, compression, err := readChunkAt(f, loc)
+		if err != nil {
+			return updates, resized, fmt.Errorf("cannot read chunk %d in region file %q: %v", i, path, err)
+		}
+		n := fn(i, tree)
+		if n == 0 {
+			continue
+		}
+		data, err := encodeChunk(tree, compression, defaultLevel)
+		if err != nil {
+			return updates, resized, fmt.Errorf("cannot encode chunk %d in region file %q: %v", i, path, err)
+		}
+		if err := b.save(path); err != nil {
+			return updates, resized, err
+		}
+		r, err := writeChunk(f, m, i%32, i/32, data, saveTime(keepTimestamps))
+		if err != nil {
+			return updates, resized, fmt.Errorf("cannot write chunk %d in region file %q: %v", i, path, err)
+		}
+		resized = resized || r
+		updates += n
+	}
+	return updates, resized, nil
+}
+
+// readRegionChunks reads the chunks in the region file located at path, without
+// modifying it. It calls fn with the index (dz*32 + dx) and NBT tree of each
+// chunk in the file.
+func readRegionChunks(path string, fn func(i int, tree map[string]interface{}) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open region file %q: %v", path, err)
+	}
+	defer f.Close()
+	locs, err := readLocations(f)
+	if err != nil {
+		return fmt.Errorf("region file %q: %v", path, err)
+	}
+	for i, loc := range locs {
+		if loc == 0 {
+			continue
+		}
+		tree, _, err := readChunkAt(f, loc)
+		if err != nil {
+			return fmt.Errorf("cannot read chunk %d in region file %q: %v", i, path, err)
+		}
+		if err := fn(i, tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
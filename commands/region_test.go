@@ -0,0 +1,267 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memFile is an in-memory regionFile.
+type memFile struct {
+	data []byte
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if end := off + int64(len(b)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], b), nil
+}
+
+func (f *memFile) Name() string { return "r.0.0.mca" }
+
+func (f *memFile) Stat() (os.FileInfo, error) { return memFileInfo(len(f.data)), nil }
+
+// memFileInfo is the os.FileInfo for a memFile of the given size.
+type memFileInfo int64
+
+func (fi memFileInfo) Name() string       { return "r.0.0.mca" }
+func (fi memFileInfo) Size() int64        { return int64(fi) }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// layoutRegion builds a region file from a layout string, which describes the
+// sectors following the location and timestamp tables: a letter for each
+// sector of a chunk (A for chunk 0, B for chunk 1, etc.), which is filled with
+// that letter, or "." for a free sector, which is filled with zeros.
+func layoutRegion(layout string) *memFile {
+	f := &memFile{data: make([]byte, 2*sectorSize)}
+	f.data = append(f.data, layoutSectors(layout)...)
+	writeLocations(f, layoutLocations(layout))
+	return f
+}
+
+// layoutSectors returns the contents of the sectors described by layout (see
+// layoutRegion).
+func layoutSectors(layout string) []byte {
+	var data []byte
+	for _, c := range layout {
+		b := byte(c)
+		if c == '.' {
+			b = 0
+		}
+		data = append(data, bytes.Repeat([]byte{b}, sectorSize)...)
+	}
+	return data
+}
+
+// layoutLocations returns the chunk location table for the chunks described by
+// layout (see layoutRegion). Letters are not case-sensitive.
+func layoutLocations(layout string) []uint32 {
+	locs := make([]uint32, 1024)
+	for i, c := range strings.ToUpper(layout) {
+		if c == '.' {
+			continue
+		}
+		chunk := int(c - 'A')
+		if locs[chunk] == 0 {
+			locs[chunk] = uint32(i+2) << 8
+		}
+		locs[chunk]++
+	}
+	return locs
+}
+
+// layoutOf returns the layout string (see layoutRegion) for the sectors of f
+// following the location and timestamp tables.
+func layoutOf(f *memFile) string {
+	var b strings.Builder
+	for off := 2 * sectorSize; off < len(f.data); off += sectorSize {
+		c := f.data[off]
+		if !bytes.Equal(f.data[off:off+sectorSize], bytes.Repeat([]byte{c}, sectorSize)) {
+			b.WriteByte('?')
+		} else if c == 0 {
+			b.WriteByte('.')
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func TestWriteChunk(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		layout  string
+		chunk   int // The chunk to write, which is filled with its lowercase letter.
+		sectors int
+		want    string
+		resized bool
+	}{
+		{"same size", "AB", 0, 1, "aB", false},
+		{"shrinks", "AAAB", 0, 1, "a..B", true},
+		{"grows into free sectors after it", "A..B", 0, 3, "aaaB", true},
+		{"grows at end of file", "BA", 0, 3, "Baaa", true},
+		{"moves into first free gap", "A..BC", 1, 2, "Abb.C", true},
+		{"moves to end of file", "AB.C", 0, 2, ".B.Caa", true},
+		{"uses free sectors at end of file", "AB..", 0, 3, ".Baaa", true},
+		{"new chunk in gap", "A..B", 2, 1, "Ac.B", true},
+		{"new chunk at end", "AB", 2, 2, "ABcc", true},
+	} {
+		f := layoutRegion(tc.layout)
+		m := newSectorMap(layoutLocations(tc.layout))
+		data := bytes.Repeat([]byte{byte('a' + tc.chunk)}, tc.sectors*sectorSize)
+		resized, err := writeChunk(f, m, tc.chunk, 0, data, 12345)
+		if err != nil {
+			t.Errorf("%s: writeChunk failed: %v", tc.name, err)
+			continue
+		}
+		if resized != tc.resized {
+			t.Errorf("%s: resized = %v, want %v", tc.name, resized, tc.resized)
+		}
+		if got := layoutOf(f); got != tc.want {
+			t.Errorf("%s: layout after writeChunk = %q, want %q", tc.name, got, tc.want)
+		}
+		locs, err := readLocations(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := layoutLocations(tc.want); !reflect.DeepEqual(locs, want) {
+			t.Errorf("%s: locations = %x, want %x", tc.name, locs[:4], want[:4])
+		}
+		// The sector map must match the new location table, apart from free
+		// sectors at the end.
+		want := newSectorMap(locs).used
+		got := m.used
+		for len(got) > len(want) && got[len(got)-1] == 0 {
+			got = got[:len(got)-1]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: sector map = %v, want %v", tc.name, m.used, want)
+		}
+		timestamps, err := readTimestamps(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timestamps[tc.chunk] != 12345 {
+			t.Errorf("%s: timestamp = %d, want 12345", tc.name, timestamps[tc.chunk])
+		}
+	}
+}
+
+func TestWriteChunkKeepsOverlappingSectors(t *testing.T) {
+	// Chunk 0 occupies sectors 2-4, and chunk 1 overlaps it at sector 4.
+	f := layoutRegion("AAB")
+	locs := layoutLocations("AAB")
+	locs[0] = 2<<8 | 3
+	writeLocations(f, locs)
+	m := newSectorMap(locs)
+	if _, err := writeChunk(f, m, 0, 0, bytes.Repeat([]byte("a"), sectorSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Sector 3 is freed and zeroed, but sector 4 is still used by chunk 1.
+	if got, want := layoutOf(f), "a.B"; got != want {
+		t.Errorf("layout after writeChunk = %q, want %q", got, want)
+	}
+	if got, want := m.used[2:], []int{1, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sector map = %v, want %v", got, want)
+	}
+	timestamps, err := readTimestamps(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestamps[0] != 0 {
+		t.Errorf("timestamp = %d, want 0 (unchanged)", timestamps[0])
+	}
+}
+
+func TestSectorMapAllocate(t *testing.T) {
+	m := newSectorMap([]uint32{3<<8 | 1, 6<<8 | 2})
+	for _, tc := range []struct{ n, want int }{
+		{1, 2},
+		{2, 4},
+		{3, 8},
+	} {
+		if got := m.allocate(tc.n); got != tc.want {
+			t.Errorf("allocate(%d) = %d, want %d", tc.n, got, tc.want)
+		}
+	}
+	if !m.free(4, 2) || m.free(5, 2) || !m.free(8, 100) {
+		t.Errorf("free reports wrong sectors as used: %v", m.used)
+	}
+}
+
+// testRegion builds a region file for tests.
+type testRegion struct {
+	t *testing.T
+	f *memFile
+}
+
+func newTestRegion(t *testing.T) *testRegion {
+	return &testRegion{t: t, f: &memFile{data: make([]byte, 2*sectorSize)}}
+}
+
+// put writes data at the specified sector, and points the location entry for
+// chunk i to it.
+func (r *testRegion) put(i, start int, data []byte) {
+	r.f.WriteAt(data, int64(start)*sectorSize)
+	r.setLoc(i, uint32(start)<<8|uint32((len(data)+sectorSize-1)/sectorSize))
+}
+
+// setLoc sets the location entry for chunk i.
+func (r *testRegion) setLoc(i int, loc uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], loc)
+	r.f.WriteAt(buf[:], int64(4*i))
+}
+
+// save writes the region file to path, creating its directory.
+func (r *testRegion) save(path string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, r.f.data, 0644); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// testChunk returns the encoded data (see encodeChunk) of a minimal chunk at
+// (x, z).
+func testChunk(t *testing.T, x, z int) []byte {
+	return encodeTestChunk(t, map[string]interface{}{
+		"DataVersion": int32(3465),
+		"xPos":        int32(x),
+		"zPos":        int32(z),
+		"Status":      "minecraft:full",
+	})
+}
+
+// encodeTestChunk returns the encoded data (see encodeChunk) of a chunk with
+// the specified NBT tree.
+func encodeTestChunk(t *testing.T, tree map[string]interface{}) []byte {
+	data, err := encodeChunk(tree, 2, defaultLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
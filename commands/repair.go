@@ -0,0 +1,498 @@
+package commands
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/google/subcommands"
+)
+
+// Repair implements the repair command.
+type Repair struct {
+	skipConfirm bool
+	force       bool
+	backupDir   string
+	backup      *backup
+	jobs        int
+
+	// salvage indicates that orphaned sectors should be scanned for chunks
+	// which can be put back into empty slots.
+	salvage bool
+
+	// dryRun indicates that the changes should be reported, without modifying
+	// the world.
+	dryRun     bool
+	reportFile string
+	report     *csv.Writer
+
+	changes int // Number of changes made.
+	changed int // Number of region files changed.
+}
+
+func (*Repair) Name() string {
+	return "repair"
+}
+
+func (*Repair) Synopsis() string {
+	return "Repair corrupt region files in a Minecraft world."
+}
+
+func (*Repair) Usage() string {
+	return `repair [-backup <dir>] [-salvage] [-dry_run] [-report <file>] <world>
+Repair corrupt region files in a Minecraft world.
+
+WARNING: This command will modify your world in-place. You should make a backup
+of your world before proceeding.
+
+Repair fixes the problems reported by the check command where it can, rather
+than refusing to touch the region file. For each region file in the world
+(including the entities and poi region files):
+
+  - If the file size is not a whole number of 4kB sectors, the file is padded
+    with zeros.
+  - Chunk location entries which point outside the file (or at the location
+    and timestamp tables) are removed, unless the chunk can still be read from
+    within the file.
+  - The sector count of each chunk which can be read is set to the number of
+    sectors its length requires.
+  - Where chunks overlap, each chunk which can be read, and whose position
+    matches its slot, is kept. If its sectors are already taken by another
+    such chunk, its data is copied to new sectors at the end of the file.
+    Overlapping chunks which cannot be read, or which hold the data for another
+    chunk, are removed.
+
+Chunks which cannot be read but do not overlap any other chunk are left alone,
+as there is nothing better to replace them with.
+
+If -salvage is specified, the sectors which are not used by any chunk are also
+scanned for valid chunk data. Where a chunk is found whose slot in the region
+file is empty, it is put back into that slot, with the current time as its
+timestamp. If several chunks are found for the same slot, the one saved most
+recently (according to its LastUpdate tag) is used. The poi region files are not salvaged, as their chunks do not record
+their position.
+
+Every change is logged. If -report is specified, the changes are also written
+to the given CSV file, with the following columns:
+
+  dimension - The dimension containing the region file (0=overworld,
+              -1=nether, 1=the end).
+  chunk_x   - The X coordinate of the chunk changed, if any.
+  chunk_z   - The Z coordinate of the chunk changed, if any.
+  path      - The path to the region file.
+  action    - One of pad, remove, resize, relocate or salvage.
+  detail    - A description of the change.
+
+If -dry_run is specified, the changes are reported, but the world is not
+modified.
+
+Repair may leave orphaned sectors behind, so it is a good idea to run the
+compact command afterwards.
+
+If -backup is specified, each region file is copied to the given directory
+before it is modified, so that it can be put back using the restore command.
+
+If -jobs is greater than 1, that many region files are repaired at a time.
+
+`
+}
+
+func (r *Repair) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&r.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&r.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+	f.StringVar(&r.backupDir, "backup", "", "Directory to save a copy of each region file to before it is modified (see the restore command).")
+	f.IntVar(&r.jobs, "jobs", 1, "Number of region files to repair concurrently.")
+	f.BoolVar(&r.salvage, "salvage", false, "Scan unused sectors for chunks which can be put back into empty slots.")
+	f.BoolVar(&r.dryRun, "dry_run", false, "Report the changes which would be made, without modifying the world.")
+	f.StringVar(&r.reportFile, "report", "", "CSV file to write the changes made to.")
+}
+
+func (r *Repair) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		log.Errorf("<world> is required.")
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 1 {
+		log.Error("Extra positional arguments found.")
+		return subcommands.ExitUsageError
+	}
+	if r.jobs < 1 {
+		log.Errorf("Invalid value for -jobs (%d), must be at least 1.", r.jobs)
+		return subcommands.ExitUsageError
+	}
+	if !r.skipConfirm && !r.dryRun {
+		confirm()
+	}
+	if !r.dryRun {
+		lock, err := lockWorld(f.Arg(0), r.force)
+		if err != nil {
+			log.Errorf("Repair: %v", err)
+			return subcommands.ExitFailure
+		}
+		defer lock.unlock()
+	}
+	if r.backupDir != "" && !r.dryRun {
+		var err error
+		if r.backup, err = newBackup(r.backupDir, f.Arg(0), "repair"); err != nil {
+			log.Errorf("Repair: %v", err)
+			return subcommands.ExitFailure
+		}
+	}
+	if r.reportFile != "" {
+		out, err := os.Create(r.reportFile)
+		if err != nil {
+			log.Errorf("Repair: cannot open file %q for writing: %v", r.reportFile, err)
+			return subcommands.ExitFailure
+		}
+		defer out.Close()
+		r.report = csv.NewWriter(out)
+		r.report.Write([]string{"dimension", "chunk_x", "chunk_z", "path", "action", "detail"})
+	}
+	err := r.repairWorld(f.Arg(0))
+	if r.report != nil {
+		r.report.Flush()
+		if werr := r.report.Error(); werr != nil && err == nil {
+			err = fmt.Errorf("cannot write %q: %v", r.reportFile, werr)
+		}
+	}
+	if err != nil {
+		log.Errorf("Repair: %v", err)
+		return subcommands.ExitFailure
+	}
+	if r.dryRun {
+		log.Infof("Would make %d changes to %d region files.", r.changes, r.changed)
+	} else {
+		log.Infof("Made %d changes to %d region files.", r.changes, r.changed)
+	}
+	if r.changed > 0 && !r.dryRun {
+		log.Info("It is recommended to compact the world.")
+	}
+	return subcommands.ExitSuccess
+}
+
+// repairChange describes a change made to a region file.
+type repairChange struct {
+	slot   int // Slot of the chunk changed, or -1 if the change is to the file.
+	action string
+	detail string
+}
+
+// repairResult holds the changes made to a region file.
+type repairResult struct {
+	*checkJob
+	changes []repairChange
+}
+
+// repairWorld repairs all region files in a world, up to r.jobs at a time, and
+// reports the changes made to each one in turn.
+func (r *Repair) repairWorld(path string) error {
+	jobs, err := listCheckJobs(path)
+	if err != nil {
+		return err
+	}
+	return pipeline(r.jobs, nextCheckJob(jobs), func(job interface{}) (interface{}, error) {
+		j := job.(*checkJob)
+		changes, err := r.repairRegion(j)
+		if err != nil {
+			return nil, fmt.Errorf("region file %q: %v", j.path, err)
+		}
+		return &repairResult{j, changes}, nil
+	}, func(result interface{}) error {
+		res := result.(*repairResult)
+		r.reportChanges(res)
+		return nil
+	})
+}
+
+// reportChanges logs the changes made to a region file, and writes them to the
+// report if requested.
+func (r *Repair) reportChanges(res *repairResult) {
+	if len(res.changes) == 0 {
+		return
+	}
+	r.changed++
+	r.changes += len(res.changes)
+	for _, c := range res.changes {
+		var x, z string
+		if c.slot < 0 {
+			log.Infof("Region file %q: %s.", res.path, c.detail)
+		} else {
+			cx, cz := res.rx*32+c.slot%32, res.rz*32+c.slot/32
+			x, z = strconv.Itoa(cx), strconv.Itoa(cz)
+			log.Infof("Region file %q: chunk (%d, %d): %s.", res.path, cx, cz, c.detail)
+		}
+		if r.report != nil {
+			r.report.Write([]string{strconv.Itoa(res.dim), x, z, res.path, c.action, c.detail})
+		}
+	}
+}
+
+// repairEntry describes a chunk location entry being repaired.
+type repairEntry struct {
+	slot     int
+	start, n int    // Location of the chunk data, in sectors.
+	err      error  // Why the chunk cannot be used, if it cannot.
+	data     []byte // Chunk data to copy to new sectors, if relocated.
+}
+
+// repairRegion repairs the region file identified by j, and returns the changes
+// made. In a dry run, the file is left untouched.
+func (r *Repair) repairRegion(j *checkJob) ([]repairChange, error) {
+	mode := os.O_RDWR
+	if r.dryRun {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(j.path, mode, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat file: %v", err)
+	}
+	size := fi.Size()
+	if size < 2*sectorSize {
+		log.Warnf("Region file %q is too short to hold the chunk location and timestamp tables; not repairing it.", j.path)
+		return nil, nil
+	}
+
+	var changes []repairChange
+	changef := func(slot int, action, format string, args ...interface{}) {
+		changes = append(changes, repairChange{slot, action, fmt.Sprintf(format, args...)})
+	}
+	sectors := int((size + sectorSize - 1) / sectorSize)
+	if size%sectorSize != 0 {
+		changef(-1, "pad", "padded the file from %d to %d bytes", size, int64(sectors)*sectorSize)
+	}
+	locs, err := readLocations(f)
+	if err != nil {
+		return nil, err
+	}
+	timestamps, err := readTimestamps(f)
+	if err != nil {
+		return nil, err
+	}
+	remove := func(slot int, format string, args ...interface{}) {
+		locs[slot] = 0
+		timestamps[slot] = 0
+		changef(slot, "remove", "removed location entry: "+format, args...)
+	}
+
+	// Read each chunk as far as the end of the file, so that chunks whose
+	// sector count is wrong can still be read.
+	var entries []*repairEntry
+	for i, loc := range locs {
+		if loc == 0 {
+			continue
+		}
+		start, n := int(loc>>8), locSectors(loc)
+		if start < 2 || start >= sectors {
+			remove(i, "sectors %d-%d lie outside the file", start, start+n-1)
+			continue
+		}
+		e := &repairEntry{slot: i, start: start, n: n}
+		need, err := r.readChunk(f, start, sectors, j, i)
+		if err != nil {
+			if start+n > sectors {
+				remove(i, "sectors %d-%d lie beyond the end of the file, and the chunk cannot be read: %v", start, start+n-1, err)
+				continue
+			}
+			e.err = err
+		} else if need != n {
+			changef(i, "resize", "changed sector count from %d to %d to match the chunk length", n, need)
+			e.n = need
+			locs[i] = uint32(start<<8 | need)
+		}
+		entries = append(entries, e)
+	}
+
+	// Give each sector to the first chunk which can be read and uses it
+	// (in order of location). Chunks which cannot be read only keep their
+	// sectors if no chunk which can be read uses them.
+	owner := make([]int, sectors)
+	for i := range owner {
+		owner[i] = -1
+	}
+	sort.SliceStable(entries, func(a, b int) bool {
+		if (entries[a].err == nil) != (entries[b].err == nil) {
+			return entries[a].err == nil
+		}
+		return entries[a].start < entries[b].start
+	})
+	end := sectors // Start of the next new sector.
+	var moved []*repairEntry
+	for _, e := range entries {
+		other := -1
+		for s := e.start; s < e.start+e.n; s++ {
+			if owner[s] >= 0 {
+				other = owner[s]
+				break
+			}
+		}
+		if other < 0 {
+			for s := e.start; s < e.start+e.n; s++ {
+				owner[s] = e.slot
+			}
+			continue
+		}
+		ox, oz := j.rx*32+other%32, j.rz*32+other/32
+		if e.err != nil {
+			remove(e.slot, "sectors %d-%d overlap chunk (%d, %d), and the chunk cannot be read: %v", e.start, e.start+e.n-1, ox, oz, e.err)
+			continue
+		}
+		e.data = make([]byte, e.n*sectorSize)
+		if _, err := f.ReadAt(e.data, int64(e.start)*sectorSize); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("cannot read chunk %d: %v", e.slot, err)
+		}
+		changef(e.slot, "relocate", "moved from sectors %d-%d, which overlap chunk (%d, %d), to sectors %d-%d", e.start, e.start+e.n-1, ox, oz, end, end+e.n-1)
+		e.start = end
+		end += e.n
+		locs[e.slot] = uint32(e.start<<8 | e.n)
+		moved = append(moved, e)
+	}
+
+	if r.salvage && j.kind != "poi" {
+		// The salvaged chunks are given the current time as their timestamp, as
+		// their old timestamps are lost (LastUpdate counts game ticks, not
+		// seconds), and a timestamp of zero means the chunk was never saved.
+		now := saveTime(false)
+		for _, e := range r.salvageChunks(f, owner, locs, j) {
+			changef(e.slot, "salvage", "recovered from unused sectors %d-%d", e.start, e.start+e.n-1)
+			locs[e.slot] = uint32(e.start<<8 | e.n)
+			timestamps[e.slot] = now
+		}
+	}
+
+	if len(changes) == 0 || r.dryRun {
+		return changes, nil
+	}
+	if err := r.backup.save(j.path); err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(sectors) * sectorSize); err != nil {
+		return nil, fmt.Errorf("cannot pad file: %v", err)
+	}
+	// Write the relocated chunks before pointing the location table at them.
+	for _, e := range moved {
+		if _, err := f.WriteAt(e.data, int64(e.start)*sectorSize); err != nil {
+			return nil, fmt.Errorf("cannot write chunk %d: %v", e.slot, err)
+		}
+	}
+	if err := writeLocations(f, locs); err != nil {
+		return nil, err
+	}
+	if err := writeTimestamps(f, timestamps); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// readChunk reads the chunk data starting at the specified sector of a region
+// file with the specified number of sectors, for the chunk in the specified
+// slot of the region file identified by j. It returns the number of sectors
+// the chunk needs, or an error if the chunk cannot be read, or holds the data
+// for another chunk.
+func (r *Repair) readChunk(f io.ReaderAt, start, sectors int, j *checkJob, slot int) (int, error) {
+	x, z := j.rx*32+slot%32, j.rz*32+slot/32
+	rd := io.NewSectionReader(f, int64(start)*sectorSize, int64(sectors-start)*sectorSize)
+	length, compression, err := readChunkHeader(rd)
+	if err != nil {
+		return 0, err
+	}
+	need := chunkSectors(length)
+	if length < 1 || need > sectors-start || need > 0xff {
+		return 0, fmt.Errorf("invalid length (%d bytes)", length)
+	}
+	tree, err := decodeChunkData(rd, length, compression, externalChunkPath(filepath.Dir(j.path), x, z))
+	if err != nil {
+		return 0, err
+	}
+	if cx, cz, ok := recordedPos(tree, j.kind); ok && (cx != x || cz != z) {
+		return 0, fmt.Errorf("chunk data is for chunk (%d, %d)", cx, cz)
+	}
+	return need, nil
+}
+
+// salvageChunks scans the sectors of a region file which are not used by any
+// chunk (those with no owner) for chunk data belonging to empty slots in the
+// location table, and returns the chunks found, in slot order. Where several
+// chunks are found for the same slot, the most recently saved one is used.
+func (r *Repair) salvageChunks(f io.ReaderAt, owner []int, locs []uint32, j *checkJob) []*repairEntry {
+	found := make(map[int]*repairEntry)
+	updated := make(map[int]int64)
+	for s := 2; s < len(owner); s++ {
+		if owner[s] >= 0 {
+			continue
+		}
+		rd := io.NewSectionReader(f, int64(s)*sectorSize, int64(len(owner)-s)*sectorSize)
+		length, compression, err := readChunkHeader(rd)
+		if err != nil || length < 1 {
+			continue
+		}
+		n := chunkSectors(length)
+		if n > len(owner)-s || n > 0xff {
+			continue
+		}
+		free := true
+		for t := s; t < s+n; t++ {
+			free = free && owner[t] < 0
+		}
+		if !free {
+			continue
+		}
+		// External chunk data cannot be salvaged, as the file holding it is
+		// named after the chunk, which is not known until it is decoded.
+		tree, err := decodeChunkData(rd, length, compression, "")
+		if err != nil {
+			continue
+		}
+		x, z, ok := recordedPos(tree, j.kind)
+		dx, dz := x-j.rx*32, z-j.rz*32
+		if !ok || dx < 0 || dx >= 32 || dz < 0 || dz >= 32 {
+			continue
+		}
+		slot := dz*32 + dx
+		if locs[slot] != 0 {
+			continue
+		}
+		t := lastUpdate(tree)
+		if prev, ok := found[slot]; ok && updated[slot] >= t {
+			log.Debugf("Region file %q: chunk (%d, %d): ignoring older copy in sectors %d-%d (using sectors %d-%d).", j.path, x, z, s, s+n-1, prev.start, prev.start+prev.n-1)
+		} else {
+			found[slot] = &repairEntry{slot: slot, start: s, n: n}
+			updated[slot] = t
+		}
+		s += n - 1
+	}
+	var entries []*repairEntry
+	for _, e := range found {
+		for t := e.start; t < e.start+e.n; t++ {
+			owner[t] = e.slot
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].slot < entries[b].slot })
+	return entries
+}
+
+// lastUpdate returns the value of the LastUpdate tag of a chunk (within the
+// Level tag before 1.18), or 0 if there is none.
+func lastUpdate(tree map[string]interface{}) int64 {
+	if t, ok := tree["LastUpdate"].(int64); ok {
+		return t
+	}
+	if level, ok := tree["Level"].(map[string]interface{}); ok {
+		if t, ok := level["LastUpdate"].(int64); ok {
+			return t
+		}
+	}
+	return 0
+}
@@ -0,0 +1,216 @@
+package commands
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRepairRegion(t *testing.T) {
+	// unpositioned is a chunk which does not record its position, so that it is
+	// valid in any slot.
+	unpositioned := func(t *testing.T) []byte {
+		return encodeTestChunk(t, map[string]interface{}{"DataVersion": int32(3465)})
+	}
+	// updated is a chunk at (0, 0) saved at the specified game tick.
+	updated := func(t *testing.T, tick int64) []byte {
+		return encodeTestChunk(t, map[string]interface{}{"xPos": int32(0), "zPos": int32(0), "LastUpdate": tick})
+	}
+	for _, tc := range []struct {
+		name    string
+		salvage bool
+		build   func(t *testing.T, r *testRegion)
+		want    []string // The actions expected.
+		locs    map[int]uint32
+		// moved lists the chunks whose data is expected to have been copied, as
+		// the sector they were copied from.
+		moved map[int]int
+		// salvaged lists the chunks whose timestamp is expected to be set to
+		// the current time.
+		salvaged []int
+	}{
+		{
+			name: "valid",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.put(1, 3, testChunk(t, 1, 0))
+			},
+			locs: map[int]uint32{0: 2<<8 | 1, 1: 3<<8 | 1},
+		},
+		{
+			name: "overlapping chunks which both decode",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.put(1, 3, unpositioned(t))
+				r.setLoc(2, 3<<8|1)
+			},
+			want:  []string{"relocate"},
+			locs:  map[int]uint32{0: 2<<8 | 1, 1: 3<<8 | 1, 2: 4<<8 | 1},
+			moved: map[int]int{2: 3},
+		},
+		{
+			name: "overlapping chunk for another slot",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.setLoc(1, 2<<8|1)
+			},
+			want: []string{"remove"},
+			locs: map[int]uint32{0: 2<<8 | 1},
+		},
+		{
+			name: "location past end of file",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.setLoc(1, 10<<8|1)
+			},
+			want: []string{"remove"},
+			locs: map[int]uint32{0: 2<<8 | 1},
+		},
+		{
+			name: "location in tables",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.setLoc(1, 1<<8|1)
+			},
+			want: []string{"remove"},
+			locs: map[int]uint32{0: 2<<8 | 1},
+		},
+		{
+			name: "sector count too large",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.put(1, 3, testChunk(t, 1, 0))
+				r.setLoc(0, 2<<8|2)
+			},
+			want: []string{"resize"},
+			locs: map[int]uint32{0: 2<<8 | 1, 1: 3<<8 | 1},
+		},
+		{
+			name: "sector count past end of file",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.setLoc(0, 2<<8|5)
+			},
+			want: []string{"resize"},
+			locs: map[int]uint32{0: 2<<8 | 1},
+		},
+		{
+			name: "partial sector",
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.f.data = append(r.f.data, 1)
+			},
+			want: []string{"pad"},
+			locs: map[int]uint32{0: 2<<8 | 1},
+		},
+		{
+			name:    "orphaned chunk not salvaged",
+			salvage: false,
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.put(1, 3, testChunk(t, 1, 0))
+				r.setLoc(1, 0)
+			},
+			locs: map[int]uint32{0: 2<<8 | 1},
+		},
+		{
+			name:    "orphaned chunk salvaged",
+			salvage: true,
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, testChunk(t, 0, 0))
+				r.put(1, 3, testChunk(t, 1, 0))
+				r.setLoc(1, 0)
+			},
+			want:     []string{"salvage"},
+			locs:     map[int]uint32{0: 2<<8 | 1, 1: 3<<8 | 1},
+			salvaged: []int{1},
+		},
+		{
+			name:    "newest orphaned copy salvaged",
+			salvage: true,
+			build: func(t *testing.T, r *testRegion) {
+				r.put(0, 2, updated(t, 100))
+				r.put(0, 3, updated(t, 300))
+				r.put(0, 4, updated(t, 200))
+				r.setLoc(0, 0)
+			},
+			want:     []string{"salvage"},
+			locs:     map[int]uint32{0: 3<<8 | 1},
+			salvaged: []int{0},
+		},
+	} {
+		r := newTestRegion(t)
+		tc.build(t, r)
+		path := filepath.Join(t.TempDir(), "region", "r.0.0.mca")
+		r.save(path)
+		orig := append([]byte(nil), r.f.data...)
+
+		for _, dryRun := range []bool{true, false} {
+			before := time.Now().Unix()
+			rp := &Repair{salvage: tc.salvage, dryRun: dryRun}
+			changes, err := rp.repairRegion(&checkJob{&regionRef{0, 0, 0, path}, "region"})
+			if err != nil {
+				t.Errorf("%s: repairRegion failed: %v", tc.name, err)
+				break
+			}
+			var actions []string
+			for _, c := range changes {
+				actions = append(actions, c.action)
+			}
+			if !reflect.DeepEqual(actions, tc.want) {
+				t.Errorf("%s: changes = %v, want actions %q", tc.name, changes, tc.want)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dryRun {
+				if !bytes.Equal(data, orig) {
+					t.Errorf("%s: dry run changed the region file", tc.name)
+				}
+				continue
+			}
+
+			f := &memFile{data: data}
+			locs, err := readLocations(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantLocs := make([]uint32, 1024)
+			for i, loc := range tc.locs {
+				wantLocs[i] = loc
+			}
+			if !reflect.DeepEqual(locs, wantLocs) {
+				t.Errorf("%s: locations = %x, want %x", tc.name, locs[:4], wantLocs[:4])
+			}
+			for slot, from := range tc.moved {
+				got := data[locOffset(locs[slot]):][:sectorSize]
+				if want := orig[from*sectorSize:][:sectorSize]; !bytes.Equal(got, want) {
+					t.Errorf("%s: chunk %d was not copied from sector %d", tc.name, slot, from)
+				}
+			}
+			timestamps, err := readTimestamps(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, slot := range tc.salvaged {
+				if ts := int64(timestamps[slot]); ts < before || ts > time.Now().Unix() {
+					t.Errorf("%s: timestamp of salvaged chunk %d = %d, want the current time", tc.name, slot, ts)
+				}
+			}
+			if len(data)%sectorSize != 0 {
+				t.Errorf("%s: size after repair (%d bytes) is not a whole number of sectors", tc.name, len(data))
+			}
+			res, err := checkRegion(0, 0, path, "region")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.problems) > 0 {
+				t.Errorf("%s: problems after repair: %q", tc.name, res.problems)
+			}
+		}
+	}
+}
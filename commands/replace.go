@@ -0,0 +1,228 @@
+package commands
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/google/subcommands"
+)
+
+// Replace implements the replace command.
+type Replace struct {
+	filterFlags
+	world       string
+	match       string
+	with        string
+	dryRun      bool
+	skipConfirm bool
+	force       bool
+	re          *regexp.Regexp
+	keep        filter
+	replaced    int
+	skipped     int
+
+	// keepTimestamps indicates that the chunk timestamp table should not be
+	// updated when chunks are written (see writeChunk).
+	keepTimestamps bool
+
+	// report receives the strings that would be replaced in a dry run.
+	report *csv.Writer
+
+	// shouldCompact indicates whether any chunks required resizing or relocating.
+	// If so, notify the user that they should compact the world.
+	shouldCompact bool
+
+	// backupDir is the directory to save a copy of each region file to before
+	// it is modified (see newBackup).
+	backupDir string
+	backup    *backup
+}
+
+func (*Replace) Name() string {
+	return "replace"
+}
+
+func (*Replace) Synopsis() string {
+	return "Replace text matching a regular expression in a Minecraft world."
+}
+
+func (*Replace) Usage() string {
+	return `replace -match <regex> -with <template> [<flags>...] <world>
+Replace text matching a regular expression in a Minecraft world.
+
+WARNING: This command will modify your world in-place. You should make a backup
+of your world before proceeding.
+
+Replace rewrites the strings in the Minecraft world located in the directory
+<world> in a single pass, without the need to extract, edit, and patch them.
+This should be the directory containing level.dat. Within each string selected
+by -filter (all by default), each match of the regular expression -match (see
+https://golang.org/s/re2syntax) is replaced with -with, in which $1 or ${1}
+stands for the text matched by the first capture group, ${name} for a named
+capture group, and $$ for a literal $. The -filter, -invert, -pii_names and
+-wordlist flags select strings in the same way as for the extract command.
+
+Within strings holding JSON text components (e.g., sign text and custom names),
+only the text is matched and replaced, not the keys or other attributes, and
+each piece of text in the component is matched separately. Such strings are
+left unchanged if the replacement would make them invalid JSON.
+
+If -dry_run is specified, the strings that would be replaced are written to
+stdout in CSV format (dimension, chunk_x, chunk_z, nbt_path, old_value,
+new_value), and nothing is written to the world.
+
+The timestamp of each chunk which is changed is updated in the region file's
+timestamp table, unless -keep_timestamps is specified.
+
+If -backup is specified, each region file is copied to the given directory
+before it is first modified, so that it can be put back using the restore
+command. Only the region files which are changed are copied.
+
+`
+}
+
+func (r *Replace) SetFlags(f *flag.FlagSet) {
+	r.filterFlags.SetFlags(f, "all")
+	f.StringVar(&r.match, "match", "", "Regular expression matching the text to replace (required).")
+	f.StringVar(&r.with, "with", "", "Replacement text, in which $1 or ${name} stand for the text matched by capture groups.")
+	f.BoolVar(&r.dryRun, "dry_run", false, "Report the strings that would be replaced, without modifying the world.")
+	f.BoolVar(&r.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&r.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+	f.BoolVar(&r.keepTimestamps, "keep_timestamps", false, "Do not update the timestamps of the chunks which are changed.")
+	f.StringVar(&r.backupDir, "backup", "", "Directory to save a copy of each region file to before it is modified (see the restore command).")
+}
+
+func (r *Replace) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		log.Error("<world> is required.")
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 1 {
+		log.Error("Extra positional arguments found.")
+		return subcommands.ExitUsageError
+	}
+	r.world = f.Arg(0)
+	if r.match == "" {
+		log.Error("-match is required.")
+		return subcommands.ExitUsageError
+	}
+	re, err := regexp.Compile(r.match)
+	if err != nil {
+		log.Errorf("Invalid regular expression: %v", err)
+		return subcommands.ExitUsageError
+	}
+	r.re = re
+	keep, _, err := r.filterFlags.build()
+	if err != nil {
+		log.Errorf("Invalid filter: %v", err)
+		return subcommands.ExitUsageError
+	}
+	r.keep = keep
+	if r.dryRun {
+		r.report = csv.NewWriter(os.Stdout)
+		r.report.Write([]string{"dimension", "chunk_x", "chunk_z", "nbt_path", "old_value", "new_value"})
+	} else if !r.skipConfirm {
+		confirm()
+	}
+	if !r.dryRun {
+		lock, err := lockWorld(r.world, r.force)
+		if err != nil {
+			log.Errorf("Replace: %v", err)
+			return subcommands.ExitFailure
+		}
+		defer lock.unlock()
+		if r.backupDir != "" {
+			if r.backup, err = newBackup(r.backupDir, r.world, "replace"); err != nil {
+				log.Errorf("Replace: %v", err)
+				return subcommands.ExitFailure
+			}
+		}
+	}
+	if err := walkWorld(r.world, "region", r.replaceRegion); err != nil {
+		log.Errorf("Replace: %v", err)
+		return subcommands.ExitFailure
+	}
+	if r.skipped > 0 {
+		log.Warnf("Skipped %d text components which the replacement would make invalid.", r.skipped)
+	}
+	if r.dryRun {
+		r.report.Flush()
+		if err := r.report.Error(); err != nil {
+			log.Errorf("Cannot write report: %v", err)
+			return subcommands.ExitFailure
+		}
+		log.Infof("Dry run: would replace %d strings.", r.replaced)
+		return subcommands.ExitSuccess
+	}
+	log.Infof("Replaced %d strings.", r.replaced)
+	if r.shouldCompact {
+		log.Info("Some chunks were resized or relocated. It is recommended to compact the world.")
+	}
+	return subcommands.ExitSuccess
+}
+
+// replaceRegion replaces the matching text in a single region file. See
+// Extract.readRegion.
+func (r *Replace) replaceRegion(dim, rx, rz int, path string) error {
+	replaceChunk := func(i int, tree map[string]interface{}) int {
+		x, z := rx*32+i%32, rz*32+i/32
+		dv := dataVersion(tree)
+		n := replaceStrings(tree, func(k, v string) string {
+			if _, ok := r.keep(dv, k, v); !ok {
+				return v
+			}
+			s := r.replace(dv, k, v)
+			if s != v && r.report != nil {
+				r.report.Write([]string{strconv.Itoa(dim), strconv.Itoa(x), strconv.Itoa(z), k, v, s})
+			}
+			return s
+		})
+		if n > 0 {
+			log.Debugf("Replacing %d strings in dimension %d, chunk (%d, %d).", n, dim, x, z)
+		}
+		return n
+	}
+	if r.dryRun {
+		return readRegionChunks(path, func(i int, tree map[string]interface{}) error {
+			r.replaced += replaceChunk(i, tree)
+			return nil
+		})
+	}
+	updates, resized, err := rewriteRegion(path, r.keepTimestamps, r.backup, replaceChunk)
+	r.replaced += updates
+	if resized {
+		r.shouldCompact = true
+	}
+	return err
+}
+
+// replace returns the replacement for the string v at NBT path k, in a chunk
+// with the specified DataVersion. Within JSON text components, only the text is
+// replaced (see textSpans).
+func (r *Replace) replace(dataVersion int32, k, v string) string {
+	if !isTextComponent(dataVersion, k, v) {
+		return r.re.ReplaceAllString(v, r.with)
+	}
+	var b strings.Builder
+	copied := 0 // Bytes of v copied to b so far.
+	for _, span := range textSpans(v) {
+		b.WriteString(v[copied:span[0]])
+		b.WriteString(r.re.ReplaceAllString(v[span[0]:span[1]], r.with))
+		copied = span[1]
+	}
+	b.WriteString(v[copied:])
+	s := b.String()
+	if s != v && !json.Valid([]byte(s)) {
+		log.Debugf("Not replacing text in %s: the result would not be a valid text component: %s", k, s)
+		r.skipped++
+		return v
+	}
+	return s
+}
@@ -0,0 +1,26 @@
+package commands
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	for _, tc := range []struct {
+		match, with string
+		k, v, want  string
+	}{
+		{"darn", "****", "Text1", "darn it", "**** it"},
+		{"text", "TEXT", "Entities[0]/CustomName", `{"text":"some text","color":"red"}`, `{"text":"some TEXT","color":"red"}`},
+		{"color|red", "x", "Entities[0]/CustomName", `{"text":"hi","color":"red"}`, `{"text":"hi","color":"red"}`},
+		{"(?i)steve", "Alex", "Level/TileEntities[0]/Text1", `{"text":"Steve","extra":[{"text":"steve"}]}`, `{"text":"Alex","extra":[{"text":"Alex"}]}`},
+		{"^a", "b", "Level/TileEntities[0]/Text1", `["a", {"text":"a"}]`, `["b", {"text":"b"}]`},
+		{"hi", `"`, "Entities[0]/CustomName", `{"text":"hi"}`, `{"text":"hi"}`}, // Invalid JSON.
+		{"text", "TEXT", "Entities[0]/id", "text", "TEXT"},
+	} {
+		r := &Replace{re: regexp.MustCompile(tc.match), with: tc.with}
+		if got := r.replace(3465, tc.k, tc.v); got != tc.want {
+			t.Errorf("replace(%q -> %q, %q) = %q, want %q", tc.match, tc.with, tc.v, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bwkimmel/mcstrings/log"
+	"github.com/google/subcommands"
+)
+
+// Restore implements the restore command.
+type Restore struct {
+	backup      string
+	skipConfirm bool
+	force       bool
+}
+
+func (*Restore) Name() string {
+	return "restore"
+}
+
+func (*Restore) Synopsis() string {
+	return "Restore files saved using -backup to a Minecraft world."
+}
+
+func (*Restore) Usage() string {
+	return `restore -backup <dir> <world>
+Restore files saved using -backup to a Minecraft world.
+
+WARNING: This command will modify your world in-place.
+
+The patch, compact, prune, recompress, repair and replace commands accept a
+-backup flag, which saves a copy of each file they are about to modify to a
+backup directory, along with a manifest (manifest.json) listing the files and
+their SHA-256 hashes. The restore command copies these files back into the Minecraft world
+located in the directory <world>, undoing the changes made by that command (and
+any changes made to those files since).
+
+The hash of each saved file is checked before anything is restored, so that a
+damaged backup is not restored over the world. Each restored file is checked
+again once it has been written.
+
+`
+}
+
+func (r *Restore) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&r.backup, "backup", "", "The backup directory to restore from (required).")
+	f.BoolVar(&r.skipConfirm, "skip_confirmation", false, "Do not ask for confirmation before proceeding.")
+	f.BoolVar(&r.force, "force", false, "Modify the world even if it is open in Minecraft or a server.")
+}
+
+func (r *Restore) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		log.Error("<world> is required.")
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 1 {
+		log.Error("Extra positional arguments found.")
+		return subcommands.ExitUsageError
+	}
+	if r.backup == "" {
+		log.Error("--backup is required.")
+		return subcommands.ExitUsageError
+	}
+	world := f.Arg(0)
+	m, err := readManifest(r.backup)
+	if err != nil {
+		log.Errorf("Restore: %v", err)
+		return subcommands.ExitFailure
+	}
+	if abs, err := filepath.Abs(world); err == nil && abs != m.World {
+		log.Infof("Backup was made from %q, restoring to %q.", m.World, abs)
+	}
+	if _, err := os.Stat(filepath.Join(world, journalName)); err == nil {
+		log.Errorf("Restore: found journal from an interrupted patch; use the recover command first")
+		return subcommands.ExitFailure
+	}
+	if err := verifyBackup(r.backup, m); err != nil {
+		log.Errorf("Restore: %v", err)
+		return subcommands.ExitFailure
+	}
+	if !r.skipConfirm {
+		confirm()
+	}
+	lock, err := lockWorld(world, r.force)
+	if err != nil {
+		log.Errorf("Restore: %v", err)
+		return subcommands.ExitFailure
+	}
+	defer lock.unlock()
+	for _, file := range m.Files {
+		if err := restoreFile(r.backup, world, file); err != nil {
+			log.Errorf("Restore: %v", err)
+			return subcommands.ExitFailure
+		}
+	}
+	log.Infof("Restored %d files from backup made by %s at %s.", len(m.Files), m.Command, m.Created.Local().Format("2006-01-02 15:04:05"))
+	return subcommands.ExitSuccess
+}
+
+// verifyBackup checks that each file listed in the manifest m is present in the
+// backup directory dir, and matches its size and hash.
+func verifyBackup(dir string, m *backupManifest) error {
+	for _, file := range m.Files {
+		path := filepath.Join(dir, filepath.FromSlash(file.Path))
+		size, sum, err := hashFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot read backup of %q: %v", file.Path, err)
+		}
+		if size != file.Size || sum != file.SHA256 {
+			return fmt.Errorf("backup of %q is damaged: expected %d bytes with SHA-256 %s, found %d bytes with SHA-256 %s", file.Path, file.Size, file.SHA256, size, sum)
+		}
+	}
+	return nil
+}
+
+// restoreFile copies a single file from the backup directory dir to the world.
+// The file is copied to a temporary file which then replaces the original, so
+// that the original is left intact if an error occurs.
+func restoreFile(dir, world string, file *backupFile) error {
+	src := filepath.Join(dir, filepath.FromSlash(file.Path))
+	dest := filepath.Join(world, filepath.FromSlash(file.Path))
+	tmp := dest + ".restore"
+	log.Debugf("Restoring %q to %q.", src, dest)
+	defer os.Remove(tmp) // Fails harmlessly once renamed.
+	size, sum, err := copyFile(tmp, src)
+	if err != nil {
+		return fmt.Errorf("cannot restore %q: %v", file.Path, err)
+	}
+	if size != file.Size || sum != file.SHA256 {
+		return fmt.Errorf("cannot restore %q: copy does not match backup", file.Path)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("cannot restore %q: %v", file.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package commands
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// sortBufferSize is the approximate number of bytes of rows which rowSorter
+// holds in memory before writing a sorted run to a temporary file.
+const sortBufferSize = 64 << 20
+
+// patchRow is a row of the strings file, along with its position in the file
+// and the chunk it applies to.
+type patchRow struct {
+	line      int
+	dim, x, z int
+	rec       []string
+}
+
+// less orders rows by dimension, region, and then chunk in the order the
+// chunks appear in the region file's location table, so that each region and
+// chunk is visited once. Rows for the same chunk keep their order in the file.
+func (r *patchRow) less(o *patchRow) bool {
+	rx, rz, dx, dz := chunkPos(r.x, r.z)
+	orx, orz, odx, odz := chunkPos(o.x, o.z)
+	switch {
+	case r.dim != o.dim:
+		return r.dim < o.dim
+	case rx != orx:
+		return rx < orx
+	case rz != orz:
+		return rz < orz
+	case dz != odz:
+		return dz < odz
+	case dx != odx:
+		return dx < odx
+	}
+	return r.line < o.line
+}
+
+// size returns the approximate number of bytes of memory used by the row.
+func (r *patchRow) size() int {
+	n := 64
+	for _, f := range r.rec {
+		n += 16 + len(f)
+	}
+	return n
+}
+
+// maxMergeRuns is the maximum number of runs which rowSorter merges at once,
+// which limits the number of temporary files open at the same time.
+const maxMergeRuns = 64
+
+// rowSorter sorts the rows of a strings file (see patchRow.less) using an
+// external merge sort, so that strings files larger than memory can be sorted:
+// once the rows held in memory exceed limit bytes, they are sorted and written
+// to a temporary file (a "run"), and the runs are merged at the end. If there
+// are more than fanIn runs, they are merged in several passes.
+type rowSorter struct {
+	limit int
+	fanIn int
+	rows  []*patchRow
+	size  int
+	runs  []string   // The paths of the runs.
+	open  []*os.File // The runs being read by the final merge.
+}
+
+// newRowSorter returns an empty rowSorter.
+func newRowSorter() *rowSorter {
+	return &rowSorter{limit: sortBufferSize, fanIn: maxMergeRuns}
+}
+
+// add adds a row to be sorted.
+func (s *rowSorter) add(r *patchRow) error {
+	s.rows = append(s.rows, r)
+	s.size += r.size()
+	if s.size < s.limit {
+		return nil
+	}
+	return s.spill()
+}
+
+// sortRows sorts the rows held in memory.
+func (s *rowSorter) sortRows() {
+	sort.SliceStable(s.rows, func(i, j int) bool { return s.rows[i].less(s.rows[j]) })
+}
+
+// spill writes the rows held in memory to a new run.
+func (s *rowSorter) spill() error {
+	s.sortRows()
+	rows := s.rows
+	err := s.writeRun(func() (*patchRow, error) {
+		if len(rows) == 0 {
+			return nil, io.EOF
+		}
+		r := rows[0]
+		rows = rows[1:]
+		return r, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.rows, s.size = nil, 0
+	return nil
+}
+
+// writeRun writes the rows returned by next, up to io.EOF, to a new run.
+func (s *rowSorter) writeRun(next func() (*patchRow, error)) error {
+	f, err := ioutil.TempFile("", "mcstrings-sort")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file for sorting: %v", err)
+	}
+	defer f.Close()
+	s.runs = append(s.runs, f.Name())
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for {
+		r, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := enc.Encode(&runRow{r.line, r.dim, r.x, r.z, r.rec}); err != nil {
+			return fmt.Errorf("cannot write temporary file for sorting: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("cannot write temporary file for sorting: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot write temporary file for sorting: %v", err)
+	}
+	return nil
+}
+
+// merge opens the specified runs, and returns a heap for merging them.
+func (s *rowSorter) merge(runs []string) (*runHeap, error) {
+	h := &runHeap{}
+	for _, path := range runs {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read temporary file for sorting: %v", err)
+		}
+		s.open = append(s.open, f)
+		r := &run{dec: gob.NewDecoder(bufio.NewReader(f))}
+		if err := r.next(); err == io.EOF {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		h.runs = append(h.runs, r)
+	}
+	heap.Init(h)
+	return h, nil
+}
+
+// closeRuns closes the runs opened by merge, and removes them.
+func (s *rowSorter) closeRuns() {
+	for _, f := range s.open {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.open = nil
+}
+
+// sorted returns a function which returns the rows in sorted order, and then
+// io.EOF.
+func (s *rowSorter) sorted() (func() (*patchRow, error), error) {
+	if len(s.runs) == 0 {
+		s.sortRows()
+		rows := s.rows
+		return func() (*patchRow, error) {
+			if len(rows) == 0 {
+				return nil, io.EOF
+			}
+			r := rows[0]
+			rows = rows[1:]
+			return r, nil
+		}, nil
+	}
+	if len(s.rows) > 0 {
+		if err := s.spill(); err != nil {
+			return nil, err
+		}
+	}
+	// Merge the oldest runs into a new one until few enough remain to merge
+	// them all at once.
+	for len(s.runs) > s.fanIn {
+		h, err := s.merge(s.runs[:s.fanIn])
+		if err == nil {
+			err = s.writeRun(h.next)
+		}
+		s.closeRuns()
+		if err != nil {
+			return nil, err
+		}
+		s.runs = s.runs[s.fanIn:]
+	}
+	h, err := s.merge(s.runs)
+	if err != nil {
+		return nil, err
+	}
+	return h.next, nil
+}
+
+// close removes the temporary files used for sorting. Runs which were merged
+// are removed by closeRuns, while the rest are removed here.
+func (s *rowSorter) close() {
+	s.closeRuns()
+	for _, path := range s.runs {
+		os.Remove(path)
+	}
+	s.runs = nil
+}
+
+// runRow is the encoding of a patchRow in a run.
+type runRow struct {
+	Line, Dim, X, Z int
+	Rec             []string
+}
+
+// run is a sorted run written to a temporary file by rowSorter.
+type run struct {
+	dec *gob.Decoder
+	row *patchRow // The next row in the run.
+}
+
+// next reads the next row in the run.
+func (r *run) next() error {
+	var rr runRow
+	if err := r.dec.Decode(&rr); err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("cannot read temporary file for sorting: %v", err)
+	}
+	r.row = &patchRow{line: rr.Line, dim: rr.Dim, x: rr.X, z: rr.Z, rec: rr.Rec}
+	return nil
+}
+
+// runHeap is a heap of runs, ordered by their next row. See container/heap.
+type runHeap struct {
+	runs []*run
+}
+
+// next returns the next row of the merged runs, or io.EOF once all of the rows
+// have been returned.
+func (h *runHeap) next() (*patchRow, error) {
+	if len(h.runs) == 0 {
+		return nil, io.EOF
+	}
+	r := h.runs[0]
+	row := r.row
+	if err := r.next(); err == io.EOF {
+		heap.Pop(h)
+	} else if err != nil {
+		return nil, err
+	} else {
+		heap.Fix(h, 0)
+	}
+	return row, nil
+}
+
+func (h *runHeap) Len() int           { return len(h.runs) }
+func (h *runHeap) Less(i, j int) bool { return h.runs[i].row.less(h.runs[j].row) }
+func (h *runHeap) Swap(i, j int)      { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(*run)) }
+func (h *runHeap) Pop() interface{} {
+	r := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return r
+}
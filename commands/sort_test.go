@@ -0,0 +1,155 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testRows returns n rows in random chunks of a few regions, with several rows
+// for some chunks.
+func testRows(n int) []*patchRow {
+	r := rand.New(rand.NewSource(1))
+	var rows []*patchRow
+	for i := 1; i <= n; i++ {
+		rows = append(rows, &patchRow{
+			line: i,
+			dim:  r.Intn(2) - 1,
+			x:    r.Intn(8) - 36,
+			z:    r.Intn(8) - 4,
+			rec:  []string{fmt.Sprint(i)},
+		})
+	}
+	return rows
+}
+
+// readAll returns the rows from next up to io.EOF.
+func readAll(t *testing.T, next func() (*patchRow, error)) []*patchRow {
+	var rows []*patchRow
+	for {
+		r, err := next()
+		if err == io.EOF {
+			return rows
+		} else if err != nil {
+			t.Fatalf("reading sorted rows failed: %v", err)
+		}
+		rows = append(rows, r)
+	}
+}
+
+// lines returns the line numbers of rows.
+func lines(rows []*patchRow) []int {
+	var lines []int
+	for _, r := range rows {
+		lines = append(lines, r.line)
+	}
+	return lines
+}
+
+func TestRowSorter(t *testing.T) {
+	rows := testRows(200)
+	want := append([]*patchRow(nil), rows...)
+	sort.SliceStable(want, func(i, j int) bool { return want[i].less(want[j]) })
+
+	for _, tc := range []struct {
+		name         string
+		limit, fanIn int
+		wantRuns     int
+	}{
+		{"in memory", sortBufferSize, maxMergeRuns, 0},
+		{"one merge", 2000, maxMergeRuns, 8},
+		{"several passes", 500, 3, 28},
+	} {
+		s := &rowSorter{limit: tc.limit, fanIn: tc.fanIn}
+		for _, r := range rows {
+			if err := s.add(r); err != nil {
+				t.Fatalf("%s: add failed: %v", tc.name, err)
+			}
+		}
+		if len(s.runs) != tc.wantRuns {
+			t.Errorf("%s: %d runs, want %d", tc.name, len(s.runs), tc.wantRuns)
+		}
+		next, err := s.sorted()
+		if err != nil {
+			t.Fatalf("%s: sorted failed: %v", tc.name, err)
+		}
+		if len(s.open) > tc.fanIn {
+			t.Errorf("%s: %d runs open, want at most %d", tc.name, len(s.open), tc.fanIn)
+		}
+		var paths []string
+		for _, f := range s.open {
+			paths = append(paths, f.Name())
+		}
+		got := readAll(t, next)
+		if !reflect.DeepEqual(lines(got), lines(want)) {
+			t.Errorf("%s: sorted lines = %v, want %v", tc.name, lines(got), lines(want))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: sorted rows differ from the rows added", tc.name)
+		}
+		s.close()
+		for _, path := range append(paths, s.runs...) {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s: temporary file %q still exists after close (%v)", tc.name, path, err)
+			}
+		}
+	}
+}
+
+func TestNextRegion(t *testing.T) {
+	rows := testRows(100)
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].less(rows[j]) })
+	const resumeAfter = 7
+	p := &Patch{resumeAfter: resumeAfter}
+	remaining := rows
+	nextRegion := p.nextRegion(func() (*patchRow, error) {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		r := remaining[0]
+		remaining = remaining[1:]
+		return r, nil
+	})
+
+	var got []*patchRow
+	for {
+		job, err := nextRegion()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("nextRegion failed: %v", err)
+		}
+		r := job.(*regionPatch)
+		if r.first != len(got)+resumeAfter+1 {
+			t.Errorf("region (%d, %d) in dimension %d: first = %d, want %d", r.rx, r.rz, r.dim, r.first, len(got)+resumeAfter+1)
+		}
+		go r.readRows()
+		seen := make(map[[2]int]bool)
+		for chunkRows := range r.rows {
+			c := chunkRows[0]
+			if rx, rz, _, _ := chunkPos(c.x, c.z); c.dim != r.dim || rx != r.rx || rz != r.rz {
+				t.Errorf("chunk (%d, %d) in dimension %d returned for region (%d, %d) in dimension %d", c.x, c.z, c.dim, r.rx, r.rz, r.dim)
+			}
+			if seen[[2]int{c.x, c.z}] {
+				t.Errorf("chunk (%d, %d) returned more than once", c.x, c.z)
+			}
+			seen[[2]int{c.x, c.z}] = true
+			for _, row := range chunkRows {
+				if row.dim != c.dim || row.x != c.x || row.z != c.z {
+					t.Errorf("row %d for chunk (%d, %d) returned with chunk (%d, %d)", row.line, row.x, row.z, c.x, c.z)
+				}
+			}
+			got = append(got, chunkRows...)
+		}
+		if r.readErr != nil {
+			t.Errorf("reading rows failed: %v", r.readErr)
+		}
+	}
+	if want := lines(rows[resumeAfter:]); !reflect.DeepEqual(lines(got), want) {
+		t.Errorf("rows = %v, want %v", lines(got), want)
+	}
+}
@@ -0,0 +1,160 @@
+package commands
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tagTypes maps the names used in the type column of a strings file to the Go
+// type used to represent tags of that type (see
+// https://minecraft.gamepedia.com/NBT_format). Arrays are represented by Go
+// arrays of these element types.
+var tagTypes = map[string]reflect.Type{
+	"string":     reflect.TypeOf(""),
+	"byte":       reflect.TypeOf(byte(0)),
+	"short":      reflect.TypeOf(int16(0)),
+	"int":        reflect.TypeOf(int32(0)),
+	"long":       reflect.TypeOf(int64(0)),
+	"float":      reflect.TypeOf(float32(0)),
+	"double":     reflect.TypeOf(float64(0)),
+	"byte_array": reflect.TypeOf(byte(0)),
+	"int_array":  reflect.TypeOf(int32(0)),
+	"long_array": reflect.TypeOf(int64(0)),
+}
+
+// validTagTypes returns a comma-separated list of valid tag types for usage
+// documentation.
+func validTagTypes() string {
+	var names []string
+	for k := range tagTypes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseTag parses the value of a tag of the named type (see tagTypes). Numbers
+// are written in decimal, and the elements of arrays are separated by commas.
+func parseTag(typ, v string) (interface{}, error) {
+	t, ok := tagTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("invalid type %q, must be one of %s", typ, validTagTypes())
+	}
+	if !strings.HasSuffix(typ, "_array") {
+		return parseScalar(t, v)
+	}
+	var elems []string
+	if v = strings.TrimSpace(v); v != "" {
+		elems = strings.Split(v, ",")
+	}
+	a := reflect.New(reflect.ArrayOf(len(elems), t)).Elem()
+	for i, e := range elems {
+		x, err := parseScalar(t, strings.TrimSpace(e))
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %v", i, err)
+		}
+		a.Index(i).Set(reflect.ValueOf(x))
+	}
+	return a.Interface(), nil
+}
+
+// parseScalar parses a string or number of the specified Go type.
+func parseScalar(t reflect.Type, v string) (interface{}, error) {
+	var x interface{}
+	var err error
+	switch t.Kind() {
+	case reflect.String:
+		return v, nil
+	case reflect.Uint8:
+		// Bytes are signed in NBT, but unsigned values are accepted too.
+		var n int64
+		if n, err = strconv.ParseInt(v, 10, 16); err == nil && (n < -128 || n > 255) {
+			err = fmt.Errorf("%d is out of range for a byte", n)
+		}
+		x = byte(n)
+	case reflect.Int16:
+		var n int64
+		n, err = strconv.ParseInt(v, 10, 16)
+		x = int16(n)
+	case reflect.Int32:
+		var n int64
+		n, err = strconv.ParseInt(v, 10, 32)
+		x = int32(n)
+	case reflect.Int64:
+		x, err = strconv.ParseInt(v, 10, 64)
+	case reflect.Float32:
+		var f float64
+		f, err = strconv.ParseFloat(v, 32)
+		x = float32(f)
+	case reflect.Float64:
+		x, err = strconv.ParseFloat(v, 64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", t, err)
+	}
+	return x, nil
+}
+
+// formatTag formats the value of a tag in the form accepted by parseTag. Ok is
+// false for lists and compounds.
+func formatTag(x interface{}) (s string, ok bool) {
+	switch v := x.(type) {
+	case string:
+		return v, true
+	case byte:
+		return strconv.Itoa(int(int8(v))), true
+	case int16, int32, int64:
+		return fmt.Sprint(v), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	}
+	rv := reflect.ValueOf(x)
+	if rv.Kind() != reflect.Array {
+		return "", false
+	}
+	elems := make([]string, rv.Len())
+	for i := range elems {
+		elems[i], _ = formatTag(rv.Index(i).Interface())
+	}
+	return strings.Join(elems, ","), true
+}
+
+// tagName returns the name of the type of a tag, for error messages.
+func tagName(x interface{}) string {
+	switch x.(type) {
+	case string:
+		return "TAG_String"
+	case byte:
+		return "TAG_Byte"
+	case int16:
+		return "TAG_Short"
+	case int32:
+		return "TAG_Int"
+	case int64:
+		return "TAG_Long"
+	case float32:
+		return "TAG_Float"
+	case float64:
+		return "TAG_Double"
+	case []interface{}:
+		return "TAG_List"
+	case map[string]interface{}:
+		return "TAG_Compound"
+	}
+	if rv := reflect.ValueOf(x); rv.Kind() == reflect.Array {
+		switch rv.Type().Elem().Kind() {
+		case reflect.Uint8:
+			return "TAG_Byte_Array"
+		case reflect.Int32:
+			return "TAG_Int_Array"
+		case reflect.Int64:
+			return "TAG_Long_Array"
+		}
+	}
+	return fmt.Sprintf("unknown tag (%T)", x)
+}
@@ -0,0 +1,250 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// confusables maps characters that are commonly substituted for letters (e.g.,
+// leetspeak, look-alike characters from other scripts, accented letters) to
+// the letter they resemble. Note that "1", "!", "|" and "l" are all mapped to
+// "i", as they are used interchangeably. Since both the wordlist terms and the
+// strings being searched are normalized in the same way, this is harmless.
+var confusables = map[rune]rune{
+	// Leetspeak.
+	'0': 'o', '1': 'i', '!': 'i', '|': 'i', 'l': 'i', '3': 'e', '4': 'a', '@': 'a',
+	'5': 's', '$': 's', '7': 't', '+': 't', '8': 'b', '9': 'g',
+	// Cyrillic.
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ї': 'i', 'ј': 'j',
+	'ѕ': 's', 'ԁ': 'd', 'ɡ': 'g', 'һ': 'h', 'ԛ': 'q', 'ԝ': 'w',
+	// Greek.
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	// Latin letters with diacritics.
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ç': 'c', 'è': 'e',
+	'é': 'e', 'ê': 'e', 'ë': 'e', 'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i', 'ñ': 'n',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o', 'ù': 'u', 'ú': 'u',
+	'û': 'u', 'ü': 'u', 'ý': 'y', 'ÿ': 'y',
+}
+
+// normalizeRune maps a character to the canonical form used for matching
+// wordlist terms.
+func normalizeRune(r rune) rune {
+	// Fullwidth forms of ASCII characters.
+	if r >= 0xff01 && r <= 0xff5e {
+		r -= 0xfee0
+	}
+	r = unicode.ToLower(r)
+	if c, ok := confusables[r]; ok {
+		return c
+	}
+	return r
+}
+
+// normalized is a string normalized for matching against wordlist terms, which
+// retains the location in the original string of each normalized character.
+type normalized struct {
+	runes []rune
+	// offsets holds the byte offsets in the original string of the start of
+	// each character in runes, followed by the offset of the end of the last
+	// character.
+	offsets []int
+}
+
+// normalize canonicalizes a string for matching against wordlist terms. Case is
+// folded, confusable characters are mapped to the letters they resemble, and
+// invisible formatting characters (e.g., zero-width spaces) are dropped.
+func normalize(s string) *normalized {
+	n := &normalized{}
+	for i, r := range s {
+		if unicode.Is(unicode.Cf, r) {
+			continue
+		}
+		n.runes = append(n.runes, normalizeRune(r))
+		n.offsets = append(n.offsets, i)
+	}
+	n.offsets = append(n.offsets, len(s))
+	return n
+}
+
+// wordlistTerm is a term from a wordlist.
+type wordlistTerm struct {
+	term string
+	norm []rune
+}
+
+// wordlist matches strings against a list of terms.
+type wordlist struct {
+	terms []wordlistTerm
+}
+
+// wordMatch is an occurrence of a wordlist term in a string.
+type wordMatch struct {
+	term       string
+	start, end int // Byte offsets in the original string.
+}
+
+// loadWordlists reads the terms from a comma-separated list of wordlist files.
+// Each file should contain one term per line.
+func loadWordlists(paths string) (*wordlist, error) {
+	w := &wordlist{}
+	for _, path := range strings.Split(paths, ",") {
+		if path == "" {
+			continue
+		}
+		terms, err := readList(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read wordlist: %v", err)
+		}
+		for _, term := range terms {
+			w.terms = append(w.terms, wordlistTerm{term: term, norm: normalize(term).runes})
+		}
+	}
+	if len(w.terms) == 0 {
+		return nil, fmt.Errorf("no wordlist terms found in %q", paths)
+	}
+	return w, nil
+}
+
+// newWordlistFilter constructs a filter that matches strings containing any of
+// the terms from the wordlists specified by the -wordlist flag. The note for
+// each match lists the terms that were found.
+func newWordlistFilter(ff *filterFlags) (filter, error) {
+	if ff.wordlists == "" {
+		return nil, fmt.Errorf("-wordlist is required")
+	}
+	w, err := loadWordlists(ff.wordlists)
+	if err != nil {
+		return nil, err
+	}
+	return func(_ int32, _, v string) (string, bool) {
+		var terms []string
+		seen := make(map[string]bool)
+		for _, m := range w.find(v) {
+			if !seen[m.term] {
+				seen[m.term] = true
+				terms = append(terms, m.term)
+			}
+		}
+		return strings.Join(terms, ";"), len(terms) > 0
+	}, nil
+}
+
+// isWordRune determines if a normalized character is part of a word.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// find returns the occurrences of wordlist terms in a string. Terms only match
+// whole words. If the string is a JSON text component, only the text is
+// searched, not the JSON syntax or other attributes.
+func (w *wordlist) find(v string) []wordMatch {
+	var matches []wordMatch
+	for _, span := range textSpans(v) {
+		text := v[span[0]:span[1]]
+		n := normalize(text)
+		// Word boundaries are found using the original characters, since some
+		// punctuation is normalized to letters (e.g., "!" to "i").
+		isWordAt := func(k int) bool {
+			r, _ := utf8.DecodeRuneInString(text[n.offsets[k]:])
+			return isWordRune(r)
+		}
+		for _, t := range w.terms {
+			if len(t.norm) == 0 {
+				continue
+			}
+			for i := 0; i+len(t.norm) <= len(n.runes); i++ {
+				j := i + len(t.norm)
+				if i > 0 && isWordAt(i-1) {
+					continue
+				}
+				if j < len(n.runes) && isWordAt(j) {
+					continue
+				}
+				if string(n.runes[i:j]) != string(t.norm) {
+					continue
+				}
+				matches = append(matches, wordMatch{
+					term:  t.term,
+					start: span[0] + n.offsets[i],
+					end:   span[0] + n.offsets[j],
+				})
+			}
+		}
+	}
+	return matches
+}
+
+// mask replaces every character of each occurrence of a wordlist term in a
+// string with an asterisk, leaving the rest of the string intact.
+func (w *wordlist) mask(v string) string {
+	matches := w.find(v)
+	if len(matches) == 0 {
+		return v
+	}
+	masked := make([]bool, len(v))
+	for _, m := range matches {
+		for i := m.start; i < m.end; i++ {
+			masked[i] = true
+		}
+	}
+	var b strings.Builder
+	for i, r := range v {
+		if masked[i] && !unicode.IsSpace(r) {
+			b.WriteByte('*')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// textSpans returns the byte ranges of a string containing text. For most
+// strings, this is the entire string. If the string is a JSON text component
+// (e.g., sign text or a custom name), this is the contents of the string
+// literals holding text: array elements, a lone string, or values of "text"
+// attributes. Object keys and the values of other attributes (e.g., "color")
+// are excluded.
+func textSpans(v string) [][2]int {
+	whole := [][2]int{{0, len(v)}}
+	t := strings.TrimSpace(v)
+	if t == "" || !strings.ContainsAny(t[:1], `{["`) || !json.Valid([]byte(t)) {
+		return whole
+	}
+	var (
+		spans [][2]int
+		stack []byte // Enclosing '{' and '[' characters.
+		key   string // The most recent key in the enclosing object.
+	)
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '{', '[':
+			stack = append(stack, v[i])
+		case '}', ']':
+			stack = stack[:len(stack)-1]
+		case '"':
+			start := i + 1
+			for i++; v[i] != '"'; i++ {
+				if v[i] == '\\' {
+					i++
+				}
+			}
+			end := i
+			// Determine if this string is an object key.
+			rest := strings.TrimLeftFunc(v[end+1:], unicode.IsSpace)
+			if strings.HasPrefix(rest, ":") {
+				key = v[start:end]
+				continue
+			}
+			inObject := len(stack) > 0 && stack[len(stack)-1] == '{'
+			if !inObject || key == "text" {
+				spans = append(spans, [2]int{start, end})
+			}
+		}
+	}
+	return spans
+}
@@ -0,0 +1,129 @@
+package commands
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testWordlist returns a wordlist of the specified terms.
+func testWordlist(terms ...string) *wordlist {
+	w := &wordlist{}
+	for _, term := range terms {
+		w.terms = append(w.terms, wordlistTerm{term: term, norm: normalize(term).runes})
+	}
+	return w
+}
+
+func TestWordlistFind(t *testing.T) {
+	w := testWordlist("darn", "heck", "fudge")
+	for _, tc := range []struct {
+		v    string
+		want []string
+	}{
+		{"well darn it", []string{"darn"}},
+		{"DARN", []string{"darn"}},
+		{"d4rn", []string{"darn"}},
+		{"h3ck", []string{"heck"}},
+		{"fudg3 and heck", []string{"heck", "fudge"}},
+		{"darn!", []string{"darn"}},
+		{"darn1", nil},
+		{"darned", nil},
+		{"checkers", nil},
+		{"\uff44\uff41\uff52\uff4e", []string{"darn"}}, // Fullwidth.
+		{"d\u0430rn", []string{"darn"}},                // Cyrillic а.
+		{"d\u200barn", []string{"darn"}},               // Zero-width space.
+		{"dárn", []string{"darn"}},                     // Diacritic.
+		{`{"text":"darn"}`, []string{"darn"}},
+		{`{"text":"hello","color":"darn"}`, nil},
+		{`{"darn":"hello"}`, nil},
+		{`["", "oh ", {"text":"heck"}]`, []string{"heck"}},
+		{"nothing to see", nil},
+	} {
+		var got []string
+		for _, m := range w.find(tc.v) {
+			got = append(got, m.term)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("find(%q) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestWordlistMask(t *testing.T) {
+	w := testWordlist("darn", "oh heck")
+	for _, tc := range []struct {
+		v, want string
+	}{
+		{"well darn it", "well **** it"},
+		{"d4rn!", "****!"},
+		{"oh heck", "** ****"},
+		{"\uff44\uff41\uff52\uff4e", "****"},
+		{`{"text":"darn","color":"darn"}`, `{"text":"****","color":"darn"}`},
+		{"darned", "darned"},
+	} {
+		if got := w.mask(tc.v); got != tc.want {
+			t.Errorf("mask(%q) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestTextSpans(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want []string
+	}{
+		{"plain text", []string{"plain text"}},
+		{"", []string{""}},
+		{"{not json", []string{"{not json"}},
+		{`"quoted"`, []string{"quoted"}},
+		{`{"text":"hi","color":"red"}`, []string{"hi"}},
+		{`{"text":"a","extra":[{"text":"b"},"c"]}`, []string{"a", "b", "c"}},
+		{`["x", {"text":"y", "bold":true}]`, []string{"x", "y"}},
+		{`{"text":"say \"hi\""}`, []string{`say \"hi\"`}},
+		{`{"translate":"chat.type.text","with":["Steve"]}`, []string{"Steve"}},
+	} {
+		var got []string
+		for _, span := range textSpans(tc.v) {
+			got = append(got, tc.v[span[0]:span[1]])
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("textSpans(%q) = %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestLoadWordlists(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	if err := ioutil.WriteFile(a, []byte("# Comment\ndarn\n\n  heck  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(b, []byte("fudge\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := loadWordlists(a + "," + b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var terms []string
+	for _, term := range w.terms {
+		terms = append(terms, term.term)
+	}
+	if want := []string{"darn", "heck", "fudge"}; !reflect.DeepEqual(terms, want) {
+		t.Errorf("loadWordlists = %q, want %q", terms, want)
+	}
+
+	empty := filepath.Join(dir, "empty.txt")
+	if err := ioutil.WriteFile(empty, []byte("# Nothing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadWordlists(empty); err == nil {
+		t.Errorf("loadWordlists(%q) succeeded, want an error", empty)
+	}
+	if _, err := loadWordlists(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Errorf("loadWordlists of a missing file succeeded, want an error")
+	}
+}
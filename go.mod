@@ -5,4 +5,5 @@ go 1.16
 require (
 	github.com/google/subcommands v1.2.0
 	github.com/sandertv/gophertunnel v1.11.0
+	golang.org/x/sys v0.0.0-20200803210538-64077c9b5642
 )
@@ -4,6 +4,7 @@ package log
 import (
 	"fmt"
 	"os"
+	"sync"
 )
 
 // Level is the severity level of a log message.
@@ -19,6 +20,10 @@ const (
 // minLevel is the minimum level to include in the logging output.
 var minLevel Level = InfoLevel
 
+// mu serializes writes, so that messages logged by concurrent goroutines are
+// not interleaved.
+var mu sync.Mutex
+
 // SetMinLevel sets the minimum level to include in the logging output.
 func SetMinLevel(level Level) {
 	minLevel = level
@@ -29,6 +34,8 @@ func write(level Level, msg string, args ...interface{}) {
 	if minLevel > level {
 		return
 	}
+	mu.Lock()
+	defer mu.Unlock()
 	fmt.Fprintf(os.Stderr, msg, args...)
 	fmt.Fprintln(os.Stderr)
 }
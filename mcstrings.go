@@ -20,9 +20,18 @@ func main() {
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(subcommands.FlagsCommand(), "")
 	subcommands.Register(subcommands.CommandsCommand(), "")
+	subcommands.Register(&commands.Anonymize{}, "")
+	subcommands.Register(&commands.Check{}, "")
 	subcommands.Register(&commands.Compact{}, "")
 	subcommands.Register(&commands.Extract{}, "")
 	subcommands.Register(&commands.Patch{}, "")
+	subcommands.Register(&commands.Prune{}, "")
+	subcommands.Register(&commands.Recompress{}, "")
+	subcommands.Register(&commands.Recover{}, "")
+	subcommands.Register(&commands.Redact{}, "")
+	subcommands.Register(&commands.Replace{}, "")
+	subcommands.Register(&commands.Repair{}, "")
+	subcommands.Register(&commands.Restore{}, "")
 
 	flag.Parse()
 	if *quiet && *verbose {